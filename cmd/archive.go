@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const FLAG_DROP_BROKEN = "drop-broken"
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "archive",
+		Short: "Manage the archives of env stages.",
+		Long:  ``,
+	}
+
+	prune := &cobra.Command{
+		Use:   "prune <env>:<stage>",
+		Short: "Delete the snapshots the retention policy of an env stage does not keep.",
+		Long: `Delete the snapshots the retention policy of an env stage does not keep.
+Policies are set per stage under retention: in the env of the conf file.
+Snapshots are kept or deleted as whole sets across the archives of the stage.
+Snapshots with errors count towards no generation and are kept unless
+--drop-broken.
+
+eg. jerriedr archive prune prod:backup --dry-run`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDArchivePrune(v, args[0])
+		},
+	}
+	prune.Flags().Bool(FLAG_DROP_BROKEN, false, "delete snapshots with errors older than the newest usable one")
+	v.BindPFlag(FLAG_DROP_BROKEN, prune.Flags().Lookup(FLAG_DROP_BROKEN))
+	c.AddCommand(prune)
+
+	ls := &cobra.Command{
+		Use:   "ls",
+		Short: "List the files of each archive of an env stage.",
+		Long: `List the files of each archive of an env stage with their size,
+replica and the status of the snapshot they belong to.
+
+eg. jerriedr archive ls --env prod --stage backup -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDArchiveLs(v)
+		},
+	}
+	FlagsAddEnvStageFlags(ls, v)
+	FlagsAddOutputFlag(ls, v)
+	c.AddCommand(ls)
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddConfFlag(c, v)
+	MAIN.AddCommand(c)
+}
+
+func CMDArchiveLs(v *viper.Viper) {
+	archiveSet := ArchiveSetFetch(v, "archive ls")
+	listings := archiveSet.FilesList()
+	err := Output(v, listings, func(w io.Writer) {
+		fmt.Fprintln(w, "ARCHIVE\tREPLICA\tNAME\tTIME\tSIZE\tSNAPSHOT\tSTATUS")
+		for _, l := range listings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				l.Archive, l.Replica, l.Name, l.Time.Format(time.RFC3339), l.Size, l.SnapshotID, l.Status)
+		}
+	})
+	if err != nil {
+		core.Log.Fatalf("archive ls: %v", err)
+	}
+}
+
+// ArchiveSetFetch returns the ArchiveSet for --env and --stage with its
+// files fetched
+func ArchiveSetFetch(v *viper.Viper, name string) *schema.ArchiveSet {
+	archiveSet, err := EnvArchiveSetGet(v, v.GetString(FLAG_ENV), v.GetString(FLAG_STAGE))
+	if err != nil {
+		core.Log.Fatalf("%s: %v", name, err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	if err := archiveSet.FilesFetch(kubeClient); err != nil {
+		core.Log.Fatalf("%s: could not get archive files: %v", name, err)
+	}
+	return archiveSet
+}
+
+func CMDArchivePrune(v *viper.Viper, ref string) {
+	envName, stage, err := schema.EnvStageParse(ref)
+	if err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+
+	env, err := EnvGet(v, envName)
+	if err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+
+	policy, err := env.RetentionGet(stage)
+	if err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+	if err := policy.Validate(); err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+
+	archiveSet, err := env.ArchiveSetGet(stage)
+	if err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	if err := archiveSet.FilesFetch(kubeClient); err != nil {
+		core.Log.Fatalf("archive prune: could not get archive files: %v", err)
+	}
+
+	plan := schema.PrunePlanMake(archiveSet, policy, v.GetBool(FLAG_DROP_BROKEN))
+	fmt.Printf("retention for %s: %s\n", ref, policy)
+	fmt.Print(plan)
+
+	// with --dry-run this records the removes instead
+	if err := plan.Run(kubeClient); err != nil {
+		core.Log.Fatalf("archive prune: %v", err)
+	}
+}
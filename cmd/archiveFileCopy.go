@@ -24,6 +24,8 @@ func init() {
 
 	// flag configuration
 	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
 	FlagsAddSrcFlag(c, v)
 	FlagsAddDstFlag(c, v)
 
@@ -56,6 +58,8 @@ func CMDArchiveFileCopy(v *viper.Viper) {
 	progressWatcher := ui.ProgressWatcherNew()
 	go progressWatcher.Run()
 
+	HostConfigure(v)
+	S3Configure(v)
 	kubeClient, kubeErr := KubeClientGet(v)
 	if kubeErr != nil {
 		core.Log.Errorf("could not get KubeClient: %v", kubeErr)
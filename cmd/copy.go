@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// copyAliases are the per-pair copy commands that predate copy --from --to
+var copyAliases = []struct {
+	Use  string
+	From string
+	To   string
+}{
+	{"prodSnapToProdBackup", "prod:snap", "prod:backup"},
+	{"prodBackupToProdSnap", "prod:backup", "prod:snap"},
+	{"devSnapToDevBackup", "dev:snap", "dev:backup"},
+}
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "copy",
+		Short: "Copies a snapshot between the archives of two env stages.",
+		Long: `Copies a snapshot between the archives of two env stages.
+Stages are given as <env>:<stage> where <stage> => snap | backup.
+
+eg. jerriedr copy --from prod:snap --to prod:backup`,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDCopy(v, v.GetString(FLAG_FROM), v.GetString(FLAG_TO))
+		},
+	}
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddConfFlag(c, v)
+	FlagsAddSnapshotPickFlags(c, v)
+	FlagsAddFromFlag(c, v)
+	FlagsAddToFlag(c, v)
+	MAIN.AddCommand(c)
+
+	for _, alias := range copyAliases {
+		alias := alias
+		v := viper.New()
+		c := &cobra.Command{
+			Use:   alias.Use,
+			Short: fmt.Sprintf("Alias for copy --from %s --to %s", alias.From, alias.To),
+			Long:  "",
+			Run: func(cmd *cobra.Command, args []string) {
+				CMDCopy(v, alias.From, alias.To)
+			},
+		}
+
+		FlagsAddKubeFlags(c, v)
+		FlagsAddSSHFlags(c, v)
+		FlagsAddS3Flags(c, v)
+		FlagsAddConfFlag(c, v)
+		FlagsAddSnapshotPickFlags(c, v)
+		MAIN.AddCommand(c)
+	}
+}
+
+func CMDCopy(v *viper.Viper, from, to string) {
+	srcEnvName, srcStage, err := schema.EnvStageParse(from)
+	if err != nil {
+		core.Log.Fatalf("copy: --from: %v", err)
+	}
+
+	dstEnvName, dstStage, err := schema.EnvStageParse(to)
+	if err != nil {
+		core.Log.Fatalf("copy: --to: %v", err)
+	}
+
+	srcArchiveSet, err := EnvArchiveSetGet(v, srcEnvName, srcStage)
+	if err != nil {
+		core.Log.Fatalf("copy: could not get src archives: %v", err)
+	}
+
+	dstArchiveSet, err := EnvArchiveSetGet(v, dstEnvName, dstStage)
+	if err != nil {
+		core.Log.Fatalf("copy: could not get dst archives: %v", err)
+	}
+
+	pick, err := SnapshotPickGet(v)
+	if err != nil {
+		core.Log.Fatalf("copy: %v", err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	schema.EnvCopy(kubeClient, srcArchiveSet, dstArchiveSet, pick)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/jkassis/jerrie/core"
-	"github.com/jkassis/jerriedr/cmd/schema"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -23,16 +22,16 @@ func init() {
 				core.Log.Errorf("could not get KubeClient: %v", kubeErr)
 			}
 
-			// for each service
-			for _, serviceSpec := range devServiceSpecs {
-				service := &schema.Service{}
-				if err := service.Parse(serviceSpec); err != nil {
-					core.Log.Fatalf("could not parse serviceSpec %s", serviceSpec)
-				}
+			serviceSet, err := EnvServiceSetGet(v, "dev", "")
+			if err != nil {
+				core.Log.Fatalf("could not get services: %v", err)
+			}
 
+			// for each service
+			for _, service := range serviceSet.Services {
 				n, err := service.RequestsInFlight(kubeClient)
 				if err != nil {
-					core.Log.Fatalf("could not get requests in flight", err)
+					core.Log.Fatalf("could not get requests in flight: %v", err)
 				}
 				core.Log.Warnf("dev has %d requests in flight", n)
 			}
@@ -40,5 +39,6 @@ func init() {
 	}
 
 	FlagsAddKubeFlags(c, v)
+	FlagsAddConfFlag(c, v)
 	MAIN.AddCommand(c)
 }
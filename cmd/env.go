@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "env",
+		Short: "Inspect the envs declared in the conf file.",
+		Long:  ``,
+	}
+
+	c.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the names of all envs.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDEnvList(v)
+		},
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "show <env>",
+		Short: "Show the services and archives of an env.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDEnvShow(v, args[0])
+		},
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "Parse every spec in the conf file and report problems.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDEnvValidate(v)
+		},
+	})
+
+	FlagsAddConfFlag(c, v)
+	MAIN.AddCommand(c)
+}
+
+func CMDEnvList(v *viper.Viper) {
+	envConf, err := EnvConfGet(v)
+	if err != nil {
+		core.Log.Fatalf("env list: %v", err)
+	}
+
+	for _, envName := range envConf.EnvNames() {
+		fmt.Println(envName)
+	}
+}
+
+func CMDEnvShow(v *viper.Viper, envName string) {
+	env, err := EnvGet(v, envName)
+	if err != nil {
+		core.Log.Fatalf("env show: %v", err)
+	}
+
+	out, err := yaml.Marshal(env)
+	if err != nil {
+		core.Log.Fatalf("env show: could not marshal env '%s': %v", envName, err)
+	}
+	fmt.Print(string(out))
+}
+
+func CMDEnvValidate(v *viper.Viper) {
+	envConf, err := EnvConfGet(v)
+	if err != nil {
+		core.Log.Fatalf("env validate: %v", err)
+	}
+
+	errs := envConf.Validate()
+	if len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		fmt.Fprintln(os.Stderr, strings.Join(messages, "\n"))
+		os.Exit(1)
+	}
+
+	fmt.Printf("ok: %d envs\n", len(envConf.Envs))
+}
+
+// EnvArchiveSetGet returns the ArchiveSet for a stage of an env in the conf
+func EnvArchiveSetGet(v *viper.Viper, envName, stage string) (*schema.ArchiveSet, error) {
+	env, err := EnvGet(v, envName)
+	if err != nil {
+		return nil, err
+	}
+	return env.ArchiveSetGet(stage)
+}
+
+// EnvServiceSetGet returns the ServiceSet of an env in the conf to restore
+// snapshots from srcEnvName
+func EnvServiceSetGet(v *viper.Viper, envName, srcEnvName string) (*schema.ServiceSet, error) {
+	env, err := EnvGet(v, envName)
+	if err != nil {
+		return nil, err
+	}
+	return env.ServiceSetGet(srcEnvName)
+}
@@ -0,0 +1,512 @@
+package host
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/jkassis/jerrie/core"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config configures ssh connections to hosts
+type Config struct {
+	User           string
+	Port           int
+	KeyPaths       []string
+	KnownHostsPath string
+	Timeout        time.Duration
+
+	// Auth and HostKeyCallback override the methods built from KeyPaths,
+	// the ssh agent and KnownHostsPath. Tests use these to connect to an
+	// in-process server.
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// ConfigDefault returns a Config for the current user with the usual
+// keys and known_hosts under ~/.ssh
+func ConfigDefault() *Config {
+	homeDir, _ := os.UserHomeDir()
+	sshDir := filepath.Join(homeDir, ".ssh")
+	return &Config{
+		User: os.Getenv("USER"),
+		Port: 22,
+		KeyPaths: []string{
+			filepath.Join(sshDir, "id_ed25519"),
+			filepath.Join(sshDir, "id_ecdsa"),
+			filepath.Join(sshDir, "id_rsa"),
+		},
+		KnownHostsPath: filepath.Join(sshDir, "known_hosts"),
+		Timeout:        10 * time.Second,
+	}
+}
+
+// DefaultConfig is used by ClientGet to make the shared Client
+var DefaultConfig = ConfigDefault()
+
+var defaultClient *Client
+var defaultClientMutex sync.Mutex
+
+// ClientGet returns the shared Client, making it from DefaultConfig
+// on first use
+func ClientGet() (*Client, error) {
+	defaultClientMutex.Lock()
+	defer defaultClientMutex.Unlock()
+	if defaultClient == nil {
+		client, err := NewClient(DefaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		defaultClient = client
+	}
+	return defaultClient, nil
+}
+
+// Client runs commands and moves files on hosts over ssh.
+// Connections are pooled by host.
+type Client struct {
+	Config       *Config
+	ClientConfig *ssh.ClientConfig
+	conns        map[string]*ssh.Client
+	connsMutex   sync.Mutex
+}
+
+// NewClient returns a new, init'd host client
+func NewClient(config *Config) (*Client, error) {
+	c := &Client{
+		Config: config,
+		conns:  make(map[string]*ssh.Client),
+	}
+	err := c.Init()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Init builds the ssh client config
+func (c *Client) Init() error {
+	auth := c.Config.Auth
+	if auth == nil {
+		signers := make([]ssh.Signer, 0)
+		for _, keyPath := range c.Config.KeyPaths {
+			keyBytes, err := os.ReadFile(keyPath)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return fmt.Errorf("could not read ssh key %s: %v", keyPath, err)
+			}
+			signer, err := ssh.ParsePrivateKey(keyBytes)
+			if err != nil {
+				return fmt.Errorf("could not parse ssh key %s: %v", keyPath, err)
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(signers...))
+		}
+
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if agentConn, err := net.Dial("unix", sock); err == nil {
+				auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+			} else {
+				core.Log.Warnf("could not connect to ssh agent at %s: %v", sock, err)
+			}
+		}
+	}
+	if len(auth) == 0 {
+		return fmt.Errorf("no ssh auth methods. need a key in %v or an ssh agent", c.Config.KeyPaths)
+	}
+
+	hostKeyCallback := c.Config.HostKeyCallback
+	if hostKeyCallback == nil {
+		var err error
+		hostKeyCallback, err = knownhosts.New(c.Config.KnownHostsPath)
+		if err != nil {
+			return fmt.Errorf("could not load known hosts from %s: %v", c.Config.KnownHostsPath, err)
+		}
+	}
+
+	c.ClientConfig = &ssh.ClientConfig{
+		User:            c.Config.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         c.Config.Timeout,
+	}
+	return nil
+}
+
+// addrGet returns user and host:port for a hostName of the
+// form (<user>@)?<host>(:<port>)?
+func (c *Client) addrGet(hostName string) (user, addr string) {
+	user = c.ClientConfig.User
+	if i := strings.LastIndex(hostName, "@"); i != -1 {
+		user = hostName[:i]
+		hostName = hostName[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(hostName); err == nil {
+		return user, hostName
+	}
+	return user, net.JoinHostPort(hostName, strconv.Itoa(c.Config.Port))
+}
+
+// Conn returns a pooled connection to the host
+func (c *Client) Conn(hostName string) (*ssh.Client, error) {
+	c.connsMutex.Lock()
+	defer c.connsMutex.Unlock()
+
+	if conn, ok := c.conns[hostName]; ok {
+		return conn, nil
+	}
+
+	user, addr := c.addrGet(hostName)
+	clientConfig := *c.ClientConfig
+	clientConfig.User = user
+	conn, err := ssh.Dial("tcp", addr, &clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", addr, err)
+	}
+	c.conns[hostName] = conn
+	return conn, nil
+}
+
+// connDrop closes and forgets the pooled connection to the host so the
+// next call reconnects
+func (c *Client) connDrop(hostName string) {
+	c.connsMutex.Lock()
+	defer c.connsMutex.Unlock()
+
+	if conn, ok := c.conns[hostName]; ok {
+		conn.Close()
+		delete(c.conns, hostName)
+	}
+}
+
+// Close closes all pooled connections
+func (c *Client) Close() error {
+	c.connsMutex.Lock()
+	defer c.connsMutex.Unlock()
+
+	var err error
+	for hostName, conn := range c.conns {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(c.conns, hostName)
+	}
+	return err
+}
+
+// Exec runs a command on the host.
+// stdin is piped to the remote command if provided or nothing if nil.
+// returns an error with stderr if the command fails.
+func (c *Client) Exec(hostName, command string, stdinReader io.Reader, stdoutWriter io.Writer) error {
+	conn, err := c.Conn(hostName)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		// the pooled conn may be dead. try once more with a new one.
+		c.connDrop(hostName)
+		conn, err = c.Conn(hostName)
+		if err != nil {
+			return err
+		}
+		session, err = conn.NewSession()
+		if err != nil {
+			return fmt.Errorf("could not open ssh session to %s: %v", hostName, err)
+		}
+	}
+	defer session.Close()
+
+	stderr := bytes.NewBuffer(nil)
+	session.Stdin = stdinReader
+	session.Stdout = stdoutWriter
+	session.Stderr = stderr
+	if err := session.Run(command); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("host.Exec: %s: %s: %w", hostName, strings.TrimSpace(stderr.String()), err)
+		}
+
+		// anything other than an exit status is a broken connection
+		c.connDrop(hostName)
+		return fmt.Errorf("host.Exec: %s: %w", hostName, err)
+	}
+	return nil
+}
+
+// ExecSync runs a command on the host and returns stdout as a string
+func (c *Client) ExecSync(hostName, command string, stdin io.Reader) (string, error) {
+	stdout := bytes.NewBuffer(nil)
+	err := c.Exec(hostName, command, stdin, stdout)
+	return stdout.String(), err
+}
+
+// Ls returns a list of files on the host in the given dir
+func (c *Client) Ls(hostName, dirPath string) ([]string, error) {
+	dirPath = shellescape.Quote(dirPath)
+	stdout, err := c.ExecSync(hostName, "ls "+dirPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	fileNames := make([]string, 0)
+	for _, fileName := range strings.Split(stdout, "\n") {
+		if fileName != "" {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	return fileNames, nil
+}
+
+// LsSizes returns the name and size of each file on the host in the given dir
+func (c *Client) LsSizes(hostName, dirPath string) ([]*FileStat, error) {
+	dirPath = shellescape.Quote(dirPath)
+	stdout, err := c.ExecSync(hostName,
+		"cd "+dirPath+` && for f in *; do if [ -f "$f" ]; then stat -L -c '%s %n' "$f"; fi; done`, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fileStats := make([]*FileStat, 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("LsSizes: unexpected response for %s: %s", dirPath, line)
+		}
+		size, err := strconv.ParseInt(parts[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("LsSizes: could not convert size for %s got %s", dirPath, line)
+		}
+		fileStats = append(fileStats, &FileStat{Size: size, Name: parts[1]})
+	}
+	return fileStats, nil
+}
+
+// FilesCat returns the content of all files on the host in the given dir
+// with the given suffix
+func (c *Client) FilesCat(hostName, dirPath, suffix string) (string, error) {
+	dirPath = shellescape.Quote(dirPath)
+	suffix = shellescape.Quote(suffix)
+	return c.ExecSync(hostName, "cd "+dirPath+" && cat -- *"+suffix+" 2>/dev/null; true", nil)
+}
+
+// MkDir makes a directory and its parents on the host
+func (c *Client) MkDir(hostName, dirPath string) (stdout string, err error) {
+	dirPath = shellescape.Quote(dirPath)
+	return c.ExecSync(hostName, "mkdir -p "+dirPath, nil)
+}
+
+// Ln creates a softlink on the host
+func (c *Client) Ln(hostName, srcPath, dstPath string) (stdout string, err error) {
+	srcPath = shellescape.Quote(srcPath)
+	dstPath = shellescape.Quote(dstPath)
+	return c.ExecSync(hostName, fmt.Sprintf("ln -s %s %s", srcPath, dstPath), nil)
+}
+
+// Mv renames a file on the host
+func (c *Client) Mv(hostName, srcPath, dstPath string) (stdout string, err error) {
+	srcPath = shellescape.Quote(srcPath)
+	dstPath = shellescape.Quote(dstPath)
+	return c.ExecSync(hostName, fmt.Sprintf("mv -f %s %s", srcPath, dstPath), nil)
+}
+
+// Rm removes a file or dir from the host
+func (c *Client) Rm(hostName, targetPath string) (stdout string, err error) {
+	targetPath = shellescape.Quote(targetPath)
+	return c.ExecSync(hostName, "rm -rf "+targetPath, nil)
+}
+
+type FileStat struct {
+	UID  int64
+	GID  int64
+	Size int64
+	Name string
+}
+
+// Stat returns the owner and size of a file on the host
+func (c *Client) Stat(hostName, path string) (*FileStat, error) {
+	srcFile := shellescape.Quote(path)
+	response, err := c.ExecSync(hostName, "stat -L -c '%u %g %s %n' "+srcFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(response), " ", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Stat: unexpected response for %s: %s", path, response)
+	}
+	uid, err := strconv.ParseInt(parts[0], 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: could not convert uid for %s got %s", path, response)
+	}
+	gid, err := strconv.ParseInt(parts[1], 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: could not convert gid for %s got %s", path, response)
+	}
+	size, err := strconv.ParseInt(parts[2], 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: could not convert size for %s got %s", path, response)
+	}
+
+	return &FileStat{
+		UID:  uid,
+		GID:  gid,
+		Size: size,
+		Name: parts[3],
+	}, nil
+}
+
+// StatIfExists is Stat that returns nil without an error if there is no
+// file at path
+func (c *Client) StatIfExists(hostName, path string) (*FileStat, error) {
+	srcFile := shellescape.Quote(path)
+	response, err := c.ExecSync(hostName, "if [ -e "+srcFile+" ]; then echo found; fi", nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(response) == "" {
+		return nil, nil
+	}
+	return c.Stat(hostName, path)
+}
+
+// MD5Sum returns the hex md5 of a file on the host
+func (c *Client) MD5Sum(hostName, path string) (hash string, err error) {
+	srcFile := shellescape.Quote(path)
+	response, err := c.ExecSync(hostName, "md5sum "+srcFile, nil)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(response, " ")
+	return parts[0], nil
+}
+
+// FileRead copies a file on the host to the writer.
+// like kube.Client.FileRead, a broken connection resumes from the last
+// byte received and the result is checked against the remote md5.
+func (c *Client) FileRead(hostName, src string, dst io.Writer) (err error) {
+	return c.FileReadAt(hostName, src, 0, dst)
+}
+
+// FileReadAt is FileRead from offset on. the md5 is only checked when
+// offset is 0.
+func (c *Client) FileReadAt(hostName, src string, offset int64, dst io.Writer) (err error) {
+	fileStats, err := c.Stat(hostName, src)
+	if err != nil {
+		return fmt.Errorf("could not get stats for %s: %v", src, err)
+	}
+	srcFileSize := fileStats.Size
+	srcMD5, err := c.MD5Sum(hostName, src)
+	if err != nil {
+		return fmt.Errorf("could not get md5 for %s: %v", src, err)
+	}
+
+	hasher := md5.New()
+	m := offset // count of total bytes transferred
+	retries := 0
+	for {
+		lastM := m
+		var dstErr error
+		cmd := fmt.Sprintf("tail -c +%d %s", m+1, shellescape.Quote(src))
+		err = c.Exec(hostName, cmd, nil, writerFunc(func(p []byte) (int, error) {
+			n, err := dst.Write(p)
+			hasher.Write(p[:n])
+			m += int64(n)
+			if err != nil {
+				dstErr = err
+			}
+			return n, err
+		}))
+		if dstErr != nil {
+			return fmt.Errorf("could not write %s from %s: %v", src, hostName, dstErr)
+		}
+		if err != nil {
+			// the command failed on the host. trying again will not help.
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				return err
+			}
+			if m == lastM {
+				retries++
+				if retries > 3 {
+					return fmt.Errorf("giving up reading %s from %s after %d bytes: %v", src, hostName, m, err)
+				}
+			} else {
+				retries = 0
+			}
+			core.Log.Warnf("resuming read of %s from %s at %d: %v", src, hostName, m, err)
+			continue
+		}
+
+		// did we get all the bytes? the command ran to the end, so any
+		// bytes missing are not there to get.
+		if m < srcFileSize {
+			return fmt.Errorf("read %d of %d bytes of %s from %s. did it shrink?", m, srcFileSize, src, hostName)
+		}
+		readHash := hex.EncodeToString(hasher.Sum(nil))
+		if offset == 0 && srcMD5 != readHash {
+			return fmt.Errorf("hashes do not match")
+		}
+		return nil // all done
+	}
+}
+
+// FileWrite copies content at io.Reader to a file on the host and checks
+// the remote md5 against the bytes sent
+func (c *Client) FileWrite(hostName string, src io.Reader, dstPath string) (err error) {
+	return c.FileWriteAt(hostName, src, dstPath, 0)
+}
+
+// FileWriteAt is FileWrite for a file that already has offset bytes. src
+// is appended to those. the md5 is only checked when offset is 0.
+func (c *Client) FileWriteAt(hostName string, src io.Reader, dstPath string, offset int64) (err error) {
+	hasher := md5.New()
+	redirect := ">"
+	if offset > 0 {
+		redirect = ">>"
+	}
+	cmd := "cat " + redirect + " " + shellescape.Quote(dstPath)
+	if err = c.Exec(hostName, cmd, io.TeeReader(src, hasher), io.Discard); err != nil {
+		return fmt.Errorf("could not write %s to %s: %v", dstPath, hostName, err)
+	}
+	if offset > 0 {
+		return nil
+	}
+
+	dstMD5, err := c.MD5Sum(hostName, dstPath)
+	if err != nil {
+		return fmt.Errorf("could not get md5 for %s: %v", dstPath, err)
+	}
+	if sentMD5 := hex.EncodeToString(hasher.Sum(nil)); sentMD5 != dstMD5 {
+		return fmt.Errorf("hashes do not match for %s on %s", dstPath, hostName)
+	}
+	return nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) {
+	return fn(p)
+}
@@ -0,0 +1,342 @@
+package host
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process ssh server that runs exec requests with sh.
+// fault, if set, may handle a command instead, eg. to drop the connection.
+type testServer struct {
+	t        *testing.T
+	addr     string
+	hostKey  ssh.PublicKey
+	listener net.Listener
+
+	mutex    sync.Mutex
+	commands []string
+	fault    func(command string, channel ssh.Channel, conn ssh.Conn) bool
+}
+
+func testServerStart(t *testing.T) *testServer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, addr: listener.Addr().String(), hostKey: signer.PublicKey(), listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(netConn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(netConn net.Conn, config *ssh.ServerConfig) {
+	conn, newChannels, requests, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range newChannels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(conn, channel, requests)
+	}
+}
+
+func (s *testServer) session(conn ssh.Conn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		payload := struct{ Command string }{}
+		if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+			request.Reply(false, nil)
+			return
+		}
+		request.Reply(true, nil)
+
+		s.mutex.Lock()
+		s.commands = append(s.commands, payload.Command)
+		fault := s.fault
+		s.mutex.Unlock()
+		if fault != nil && fault(payload.Command, channel, conn) {
+			return
+		}
+
+		cmd := exec.Command("/bin/sh", "-c", payload.Command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		status := uint32(0)
+		if err := cmd.Run(); err != nil {
+			exitErr := &exec.ExitError{}
+			if !errors.As(err, &exitErr) {
+				s.t.Errorf("could not run %s: %v", payload.Command, err)
+			}
+			status = uint32(exitErr.ExitCode())
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// faultSet sets the fault
+func (s *testServer) faultSet(fault func(command string, channel ssh.Channel, conn ssh.Conn) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fault = fault
+}
+
+// commandsCount counts the commands run that start with prefix
+func (s *testServer) commandsCount(prefix string) (n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *testServer) clientNew(t *testing.T) *Client {
+	c, err := NewClient(&Config{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("test")},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testFileMake writes size random bytes to a temp file
+func testFileMake(t *testing.T, size int) (path string, content []byte) {
+	content = make([]byte, size)
+	rand.Read(content)
+	path = t.TempDir() + "/src.bak"
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, content
+}
+
+func TestExec(t *testing.T) {
+	s := testServerStart(t)
+	c := s.clientNew(t)
+
+	stdout, err := c.ExecSync(s.addr, "echo hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "hello\n" {
+		t.Fatalf("stdout is %q", stdout)
+	}
+
+	stdout, err = c.ExecSync(s.addr, "cat", strings.NewReader("from stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "from stdin" {
+		t.Fatalf("stdout is %q", stdout)
+	}
+
+	// a failed command is an ExitError with stderr in the message
+	_, err = c.ExecSync(s.addr, "echo oops >&2; exit 3", nil)
+	exitErr := &ssh.ExitError{}
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("want an ExitError, have %v", err)
+	}
+	if exitErr.ExitStatus() != 3 || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("want status 3 and stderr, have %v", err)
+	}
+}
+
+func TestFileRead(t *testing.T) {
+	s := testServerStart(t)
+	c := s.clientNew(t)
+	srcPath, content := testFileMake(t, 3<<20+17)
+
+	dst := bytes.NewBuffer(nil)
+	if err := c.FileRead(s.addr, srcPath, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), content) {
+		t.Fatal("read the wrong bytes")
+	}
+
+	// from an offset
+	dst.Reset()
+	if err := c.FileReadAt(s.addr, srcPath, 1000, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), content[1000:]) {
+		t.Fatal("read the wrong bytes from 1000")
+	}
+}
+
+func TestFileReadResume(t *testing.T) {
+	s := testServerStart(t)
+	c := s.clientNew(t)
+	srcPath, content := testFileMake(t, 3<<20+17)
+
+	// the first two reads drop the connection part way through
+	drops := 2
+	s.faultSet(func(command string, channel ssh.Channel, conn ssh.Conn) bool {
+		if !strings.HasPrefix(command, "tail") || drops == 0 {
+			return false
+		}
+		drops--
+		out, err := exec.Command("/bin/sh", "-c", command).Output()
+		if err != nil {
+			t.Errorf("could not run %s: %v", command, err)
+		}
+		channel.Write(out[:len(out)/3])
+		conn.Close()
+		return true
+	})
+
+	dst := bytes.NewBuffer(nil)
+	if err := c.FileRead(s.addr, srcPath, dst); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), content) {
+		t.Fatal("read the wrong bytes")
+	}
+	if n := s.commandsCount("tail"); n != 3 {
+		t.Fatalf("want 3 reads, have %d", n)
+	}
+}
+
+func TestFileReadFails(t *testing.T) {
+	s := testServerStart(t)
+	c := s.clientNew(t)
+	srcPath, _ := testFileMake(t, 1<<20)
+
+	// a read that fails on the host is not retried
+	s.faultSet(func(command string, channel ssh.Channel, conn ssh.Conn) bool {
+		if !strings.HasPrefix(command, "tail") {
+			return false
+		}
+		channel.Stderr().Write([]byte("tail: Permission denied\n"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+		return true
+	})
+	err := c.FileRead(s.addr, srcPath, bytes.NewBuffer(nil))
+	exitErr := &ssh.ExitError{}
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("want an ExitError, have %v", err)
+	}
+	if n := s.commandsCount("tail"); n != 1 {
+		t.Fatalf("want 1 read, have %d", n)
+	}
+
+	// a read that ends short is an error, not a retry
+	s.faultSet(func(command string, channel ssh.Channel, conn ssh.Conn) bool {
+		if !strings.HasPrefix(command, "tail") {
+			return false
+		}
+		channel.Write([]byte("short"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return true
+	})
+	if err := c.FileRead(s.addr, srcPath, bytes.NewBuffer(nil)); err == nil || !strings.Contains(err.Error(), "shrink") {
+		t.Fatalf("want a short read error, have %v", err)
+	}
+	if n := s.commandsCount("tail"); n != 2 {
+		t.Fatalf("want 2 reads, have %d", n)
+	}
+
+	// a missing file
+	if err := c.FileRead(s.addr, srcPath+".missing", bytes.NewBuffer(nil)); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
+
+func TestFileWrite(t *testing.T) {
+	s := testServerStart(t)
+	c := s.clientNew(t)
+	_, content := testFileMake(t, 3<<20+17)
+	dstPath := t.TempDir() + "/dst.bak"
+
+	if err := c.FileWrite(s.addr, bytes.NewReader(content[:1<<20]), dstPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FileWriteAt(s.addr, bytes.NewReader(content[1<<20:]), dstPath, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, content) {
+		t.Fatal("wrote the wrong bytes")
+	}
+
+	hash, err := c.MD5Sum(s.addr, dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum(content); hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("md5 is %s", hash)
+	}
+
+	// StatIfExists tells a missing file from a failure
+	fileStat, err := c.StatIfExists(s.addr, dstPath+".missing")
+	if err != nil || fileStat != nil {
+		t.Fatalf("want nil, nil for a missing file, have %v, %v", fileStat, err)
+	}
+	if fileStat, err = c.StatIfExists(s.addr, dstPath); err != nil || fileStat.Size != int64(len(content)) {
+		t.Fatalf("want size %d, have %v, %v", len(content), fileStat, err)
+	}
+
+	// a write to a dir that is not there fails
+	if err := c.FileWrite(s.addr, bytes.NewReader(content), dstPath+"/nope/dst.bak"); err == nil {
+		t.Fatal("wrote to a missing dir")
+	}
+}
@@ -8,6 +8,19 @@ import (
 	"strings"
 )
 
+// StatusError is returned for a response that is not 200 OK
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s to %s: %d [%s]: %s", e.Method, e.URL, e.StatusCode, e.Status, e.Body)
+}
+
 func Post(reqURL, contentType, body string) (resBodyString string, err error) {
 	// make the request
 	var req *http.Request
@@ -35,7 +48,7 @@ func Post(reqURL, contentType, body string) (resBodyString string, err error) {
 		}
 
 		if res.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("POST to %s: %d [%s]: %s", reqURL, res.StatusCode, res.Status, resBody)
+			return "", &StatusError{Method: "POST", URL: reqURL, StatusCode: res.StatusCode, Status: res.Status, Body: resBody}
 		}
 	}
 
@@ -69,7 +82,7 @@ func Get(reqURL, contentType string) (resBodyString string, err error) {
 		}
 
 		if res.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("GET to %s: %d [%s]: %s", reqURL, res.StatusCode, res.Status, resBody)
+			return "", &StatusError{Method: "GET", URL: reqURL, StatusCode: res.StatusCode, Status: res.Status, Body: resBody}
 		}
 	}
 
@@ -8,18 +8,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math/rand"
-	"net/http"
-	"net/url"
 	"os"
-	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alessio/shellescape"
@@ -34,9 +33,7 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/tools/remotecommand"
-	"k8s.io/client-go/transport/spdy"
 	//
 	// Uncomment to load all auth plugins
 	// _ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -55,6 +52,13 @@ type Client struct {
 	KubeConfigPath string
 	MasterURL      string
 	Rand           *rand.Rand
+
+	// InCluster is true if we run in a pod of the cluster, so cluster DNS
+	// names resolve
+	InCluster bool
+
+	forwards      map[string]*portForwardPoolEntry
+	forwardsMutex sync.Mutex
 }
 
 // NewClient returns a new, init'd kube client
@@ -91,6 +95,11 @@ func (c *Client) Init() error {
 	c.Clientset = clientset
 
 	c.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// InClusterConfig only works from a pod with a service account
+	_, err = rest.InClusterConfig()
+	c.InCluster = err == nil
+	c.forwards = make(map[string]*portForwardPoolEntry)
 	return nil
 }
 
@@ -161,15 +170,56 @@ func (c *Client) ServiceGetByName(
 	name string) (*corev1.Service, error) {
 	service, err := c.Clientset.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
 	if k8sErrors.IsNotFound(err) {
-		return nil, fmt.Errorf("pod %s in namespace %s not found", service, namespace)
+		return nil, fmt.Errorf("service %s in namespace %s not found", name, namespace)
 	} else if statusError, isStatus := err.(*k8sErrors.StatusError); isStatus {
-		return nil, fmt.Errorf("error getting pod %s in namespace %s: %v", name, namespace, statusError.ErrStatus.Message)
+		return nil, fmt.Errorf("error getting service %s in namespace %s: %v", name, namespace, statusError.ErrStatus.Message)
 	} else if err != nil {
 		return nil, err
 	}
 	return service, nil
 }
 
+// ServiceUpdate gets the service, changes it with update and writes it
+// back. It starts over if the service changed in between.
+func (c *Client) ServiceUpdate(
+	namespace,
+	name string,
+	update func(service *corev1.Service) error) (*corev1.Service, error) {
+	for attempt := 1; ; attempt++ {
+		service, err := c.ServiceGetByName(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(service); err != nil {
+			return nil, err
+		}
+
+		ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+		service, err = c.Clientset.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{})
+		cancelFn()
+		if k8sErrors.IsConflict(err) && attempt < 5 {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not update service %s in namespace %s: %v", name, namespace, err)
+		}
+		return service, nil
+	}
+}
+
+// EndpointsCount returns the number of ready addresses behind the service
+func (c *Client) EndpointsCount(namespace, name string) (n int, err error) {
+	endpoints, err := c.Clientset.CoreV1().Endpoints(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("could not get endpoints of service %s in namespace %s: %v", name, namespace, err)
+	}
+	for _, subset := range endpoints.Subsets {
+		n += len(subset.Addresses)
+	}
+	return n, nil
+}
+
 // PodGetByName returns a pod
 func (c *Client) PodGetByName(
 	namespace,
@@ -334,6 +384,48 @@ func (c *Client) Ls(dirPath string, pod *corev1.Pod, containerName string) ([]st
 	return strings.Split(stdout, "\n"), nil
 }
 
+// LsSizes returns the name and size of each file on the pod in the given dir
+func (c *Client) LsSizes(dirPath string, pod *corev1.Pod, containerName string) ([]*FileStat, error) {
+	dirPath = shellescape.Quote(dirPath)
+	cmdArr := []string{"/bin/sh", "-c",
+		"cd " + dirPath + ` && for f in *; do if [ -f "$f" ]; then stat -L -c '%s %n' "$f"; fi; done`}
+	stdout, err := c.ExecSync(pod, containerName, cmdArr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fileStatsParse(stdout)
+}
+
+// FilesCat returns the content of all files in the given dir with the
+// given suffix
+func (c *Client) FilesCat(dirPath, suffix string, pod *corev1.Pod, containerName string) (string, error) {
+	dirPath = shellescape.Quote(dirPath)
+	suffix = shellescape.Quote(suffix)
+	cmdArr := []string{"/bin/sh", "-c",
+		"cd " + dirPath + " && cat -- *" + suffix + " 2>/dev/null; true"}
+	return c.ExecSync(pod, containerName, cmdArr, nil)
+}
+
+// fileStatsParse parses lines of "<size> <name>"
+func fileStatsParse(stdout string) ([]*FileStat, error) {
+	fileStats := make([]*FileStat, 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("could not parse file size from '%s'", line)
+		}
+		size, err := strconv.ParseInt(parts[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse file size from '%s'", line)
+		}
+		fileStats = append(fileStats, &FileStat{Size: size, Name: parts[1]})
+	}
+	return fileStats, nil
+}
+
 // MkDir copies a file from local dir to remote
 func (c *Client) MkDir(dirPath string, pod *corev1.Pod, containerName string) (stdout string, err error) {
 	dirPath = shellescape.Quote(dirPath)
@@ -352,16 +444,190 @@ func (c *Client) Ln(srcPath, dstPath string, pod *corev1.Pod, containerName stri
 	return c.ExecSync(pod, containerName, cmdArr, nil)
 }
 
-// FileWrite copies content at io.Reader to a file on a pod
-func (c *Client) FileWrite(src io.Reader, dstPath string, pod *corev1.Pod, containerName string) (err error) {
+// Mv renames a file on a pod
+func (c *Client) Mv(srcPath, dstPath string, pod *corev1.Pod, containerName string) (stdout string, err error) {
+	srcPath = shellescape.Quote(srcPath)
 	dstPath = shellescape.Quote(dstPath)
-	// cmdArr := []string{"/bin/sh", "-c", "mkdir -p " + filepath.Dir(dstFile) + " ; cat > " + dstFile}
-	cmdArr := []string{"env", "cat", ">", dstPath}
-	return c.Exec(pod, containerName, cmdArr, src, io.Discard)
+	cmdArr := []string{"/bin/sh", "-c",
+		fmt.Sprintf("mv -f %s %s", srcPath, dstPath)}
+	return c.ExecSync(pod, containerName, cmdArr, nil)
+}
+
+// fileWriteReplaySize is how many of the last bytes sent FileWrite keeps
+// to replay after a broken stream. it is far more than SPDY keeps in flight.
+const fileWriteReplaySize = 32 << 20
+
+// FileWrite copies content at io.Reader to a file on a pod.
+// like FileRead, a broken stream resumes from the size of the remote file.
+// bytes sent but lost with the stream are replayed from a buffer. the
+// result is checked against the remote md5.
+func (c *Client) FileWrite(src io.Reader, dstPath string, pod *corev1.Pod, containerName string) (err error) {
+	return c.FileWriteAt(src, dstPath, 0, pod, containerName)
+}
+
+// FileWriteAt is FileWrite for a file that already has offset bytes. src
+// is appended to those. the md5 is only checked when offset is 0 since we
+// never saw the rest of the file.
+func (c *Client) FileWriteAt(src io.Reader, dstPath string, offset int64, pod *corev1.Pod, containerName string) (err error) {
+	w := &fileWriter{src: src, hasher: md5.New()}
+	quotedDstPath := shellescape.Quote(dstPath)
+
+	m := offset // count of bytes that landed in the remote file
+	retries := 0
+	for {
+		// the first attempt truncates. later attempts append.
+		redirect := ">"
+		if m > 0 {
+			redirect = ">>"
+		}
+		cmdArr := []string{"/bin/sh", "-c", "cat " + redirect + " " + quotedDstPath}
+
+		attempt, err := w.attemptNew(m - offset)
+		if err != nil {
+			return fmt.Errorf("could not resume write of %s on %s: %v", dstPath, pod.Name, err)
+		}
+		execErr := c.Exec(pod, containerName, cmdArr, attempt, io.Discard)
+		attempt.close()
+
+		// how much landed?
+		lastM := m
+		fileStat, statErr := c.Stat(pod, containerName, dstPath)
+		if statErr == nil {
+			m = fileStat.Size
+		}
+
+		srcDone, sent, srcErr := w.state()
+		if srcErr != nil {
+			return fmt.Errorf("could not read src for %s on %s: %v", dstPath, pod.Name, srcErr)
+		}
+		if statErr == nil && srcDone && m == offset+sent {
+			break
+		}
+		if statErr == nil && (m > offset+sent || m < offset) {
+			return fmt.Errorf("%s on %s has %d bytes, but %d were sent after %d", dstPath, pod.Name, m, sent, offset)
+		}
+
+		if m == lastM {
+			retries++
+			if retries > 3 {
+				return fmt.Errorf("giving up writing %s to %s after %d bytes: %v %v", dstPath, pod.Name, m, execErr, statErr)
+			}
+		} else {
+			retries = 0
+		}
+		core.Log.Warnf("resuming write of %s to %s at %d: %v %v", dstPath, pod.Name, m, execErr, statErr)
+	}
+
+	if offset > 0 {
+		return nil
+	}
+
+	// compare hashes
+	dstMD5, err := c.MD5Sum(pod, containerName, dstPath)
+	if err != nil {
+		return fmt.Errorf("could not get md5 for %s: %v", dstPath, err)
+	}
+	if sentMD5 := hex.EncodeToString(w.hasher.Sum(nil)); sentMD5 != dstMD5 {
+		return fmt.Errorf("hashes do not match for %s on %s", dstPath, pod.Name)
+	}
+	return nil
+}
+
+// fileWriter reads src once for FileWrite, keeping the tail of what it
+// read so a new attempt can start from any recent offset
+type fileWriter struct {
+	mutex       sync.Mutex
+	src         io.Reader
+	srcDone     bool
+	srcErr      error
+	hasher      hash.Hash
+	replay      []byte // bytes from replayStart to sent
+	replayStart int64
+	sent        int64
+}
+
+func (w *fileWriter) state() (srcDone bool, sent int64, srcErr error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.srcDone, w.sent, w.srcErr
+}
+
+// attemptNew returns a reader of the bytes from offset on
+func (w *fileWriter) attemptNew(offset int64) (*fileWriterAttempt, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if offset < w.replayStart || offset > w.sent {
+		return nil, fmt.Errorf("offset %d is outside of the replay buffer [%d, %d]", offset, w.replayStart, w.sent)
+	}
+	return &fileWriterAttempt{w: w, offset: offset}, nil
+}
+
+// fileWriterAttempt is the stdin of one attempt. once closed it reads
+// nothing more, in case the stream that read it lingers.
+type fileWriterAttempt struct {
+	w      *fileWriter
+	offset int64
+	closed bool
+}
+
+func (a *fileWriterAttempt) Read(p []byte) (n int, err error) {
+	w := a.w
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if a.closed {
+		return 0, io.EOF
+	}
+
+	// replay what was sent before
+	if a.offset < w.sent {
+		n = copy(p, w.replay[a.offset-w.replayStart:])
+		a.offset += int64(n)
+		return n, nil
+	}
+
+	if w.srcErr != nil {
+		return 0, w.srcErr
+	}
+	if w.srcDone {
+		return 0, io.EOF
+	}
+
+	// read more from src
+	n, err = w.src.Read(p)
+	if n > 0 {
+		w.hasher.Write(p[:n])
+		w.replay = append(w.replay, p[:n]...)
+		w.sent += int64(n)
+		a.offset += int64(n)
+		// trim in big steps so we are not copying the buffer on every read
+		if len(w.replay) > 2*fileWriteReplaySize {
+			extra := len(w.replay) - fileWriteReplaySize
+			w.replay = append(w.replay[:0:0], w.replay[extra:]...)
+			w.replayStart += int64(extra)
+		}
+	}
+	if err == io.EOF {
+		w.srcDone = true
+	} else if err != nil {
+		w.srcErr = err
+	}
+	return n, err
+}
+
+func (a *fileWriterAttempt) close() {
+	a.w.mutex.Lock()
+	defer a.w.mutex.Unlock()
+	a.closed = true
 }
 
 // FileRead copies file on a pod to the writer
 func (c *Client) FileRead(src string, dst io.Writer, pod *corev1.Pod, containerName string) (err error) {
+	return c.FileReadAt(src, 0, dst, pod, containerName)
+}
+
+// FileReadAt is FileRead from offset on. the md5 is only checked when
+// offset is 0.
+func (c *Client) FileReadAt(src string, offset int64, dst io.Writer, pod *corev1.Pod, containerName string) (err error) {
 	src = shellescape.Quote(src)
 	fileStats, err := c.Stat(pod, containerName, src)
 	if err != nil {
@@ -379,7 +645,7 @@ func (c *Client) FileRead(src string, dst io.Writer, pod *corev1.Pod, containerN
 	// we are going to basically do our own rsync protocol here...
 	// if the connection fails due to a premature EOF, we retry.
 	// otherwise, we fail
-	m := int64(0) // count of total bytes transferred
+	m := offset // count of total bytes transferred
 	buf := make([]byte, 16384)
 
 	for {
@@ -427,7 +693,7 @@ func (c *Client) FileRead(src string, dst io.Writer, pod *corev1.Pod, containerN
 		if m >= srcFileSize {
 			// yes. compare hashes
 			readHash := hex.EncodeToString(hasher.Sum(nil))
-			if srcMD5 != readHash {
+			if offset == 0 && srcMD5 != readHash {
 				return fmt.Errorf("hashes do not match")
 			}
 			return nil // all done
@@ -442,6 +708,25 @@ type FileStat struct {
 	Name string
 }
 
+// ImageDigestGet returns the digest of the image the container of the pod
+// runs, eg. sha256:<hex>
+func (c *Client) ImageDigestGet(pod *corev1.Pod, containerName string) (string, error) {
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerName != "" && containerStatus.Name != containerName {
+			continue
+		}
+		imageID := containerStatus.ImageID
+		if i := strings.LastIndex(imageID, "@"); i != -1 {
+			return imageID[i+1:], nil
+		}
+		if imageID != "" {
+			return imageID, nil
+		}
+		return "", fmt.Errorf("container %s of pod %s has no image id yet", containerStatus.Name, pod.Name)
+	}
+	return "", fmt.Errorf("could not find container %s in pod %s", containerName, pod.Name)
+}
+
 func (c *Client) MD5Sum(pod *corev1.Pod, containerName, path string) (hash string, err error) {
 	srcFile := shellescape.Quote(path)
 	cmdArr := []string{"env", "md5sum", srcFile}
@@ -488,6 +773,21 @@ func (c *Client) Stat(pod *corev1.Pod, containerName, path string) (fileState *F
 	}, nil
 }
 
+// StatIfExists is Stat that returns nil without an error if there is no
+// file at path
+func (c *Client) StatIfExists(pod *corev1.Pod, containerName, path string) (*FileStat, error) {
+	srcFile := shellescape.Quote(path)
+	cmdArr := []string{"/bin/sh", "-c", "if [ -e " + srcFile + " ]; then echo found; fi"}
+	response, err := c.ExecSync(pod, containerName, cmdArr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(response) == "" {
+		return nil, nil
+	}
+	return c.Stat(pod, containerName, path)
+}
+
 // Rm removes a file from a remote
 func (c *Client) Rm(targetPath string, pod *corev1.Pod,
 	containerName string) (string, error) {
@@ -579,94 +879,3 @@ func tarMakeRecursive(srcBase, srcFile, destBase, destFile string, tw *tar.Write
 	}
 	return nil
 }
-
-type PortForwardRequest struct {
-	LocalPort    int // LocalPort is the local port that will be selected to expose the PodPort
-	PodName      string
-	PodNamespace string
-	PodPort      int // PodPort is the target port for the pod
-}
-
-// It is to forward port, and return the forwarder.
-func (c *Client) PortForward(req *PortForwardRequest) (*portforward.ForwardedPort, error) {
-	// get the pod
-	pod, err := c.PodGetByName(req.PodNamespace, req.PodName)
-	if err != nil {
-		return nil, err
-	}
-
-	// check the status
-	if pod.Status.Phase != corev1.PodRunning {
-		return nil, fmt.Errorf("unable to forward port because pod %s is not running. Current status=%v", req.PodName, pod.Status.Phase)
-	}
-
-	// make the dialer to establish port forwarding
-	kubeAPIUrl, err := url.Parse(c.Config.Host)
-	if err != nil {
-		return nil, err
-	}
-	kubeAPIUrl.Path = path.Join(
-		"api", "v1",
-		"namespaces", req.PodNamespace,
-		"pods", req.PodName,
-		"portforward",
-	)
-	transport, upgrader, err := spdy.RoundTripperFor(c.Config)
-	if err != nil {
-		return nil, err
-	}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, kubeAPIUrl)
-
-	// make the stop and ready channels
-	stopCh := make(chan struct{}, 1)
-	readyCh := make(chan struct{})
-
-	// make pipes
-	outR, outW := io.Pipe()
-	errR, errW := io.Pipe()
-
-	// TODO when should I close these pipes?
-	fw, err := portforward.New(dialer,
-		[]string{fmt.Sprintf("%d:%d", req.LocalPort, req.PodPort)},
-		stopCh,
-		readyCh,
-		outW,
-		errW)
-	if err != nil {
-		return nil, err
-	}
-	// fw.GetPorts()
-
-	// send all output to logs
-	// TODO this isn't quite what we want
-	go StreamAllToLog(fmt.Sprintf("%s/%s: ", req.PodNamespace, req.PodName), outR, errR)
-
-	// stop forwarding if the os closes
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	defer signal.Stop(signals)
-	go func() {
-		<-signals
-		if stopCh != nil {
-			close(stopCh)
-		}
-	}()
-
-	// forward
-	go func() {
-		if err := fw.ForwardPorts(); err != nil {
-			core.Log.Fatalf("could not forward port: %v", err)
-		}
-	}()
-
-	// wait on the ready channel
-	<-readyCh
-
-	// get the forwarded ports
-	ports, err := fw.GetPorts()
-	if err != nil {
-		return nil, err
-	}
-	port := ports[0]
-	return &port, nil
-}
@@ -0,0 +1,436 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+type PortForwardRequest struct {
+	LocalPort    int // LocalPort is the local port that will be selected to expose the PodPort
+	PodName      string
+	PodNamespace string
+	PodPort      int // PodPort is the target port for the pod
+}
+
+// how long a PortForwarder waits between attempts to reconnect and
+// between health checks
+const (
+	portForwardRetryMin      = time.Second
+	portForwardRetryMax      = 30 * time.Second
+	portForwardCheckInterval = 15 * time.Second
+)
+
+// PortForwarder keeps a local port forwarded to a port of a pod. If the
+// SPDY connection to the pod drops, it connects again on the same local
+// port, so callers can hold on to the port. It also checks the pod every
+// so often and reconnects if it stopped running or was replaced. Close
+// stops it.
+type PortForwarder struct {
+	Request *PortForwardRequest
+
+	client    *Client
+	mutex     sync.Mutex
+	local     int           // the local port. fixed after the first connection.
+	connected chan struct{} // closed while a connection is up
+	closed    chan struct{} // closed by Close
+	done      chan struct{} // closed when the forwarder has stopped
+	err       error         // why the last connection failed or dropped
+}
+
+// PortForward forwards a local port to the pod and keeps it forwarded
+// until Close. LocalPort 0 picks a free port. An error connecting the
+// first time is returned. Later errors are reported by Err and Ready.
+func (c *Client) PortForward(req *PortForwardRequest) (*PortForwarder, error) {
+	pf := &PortForwarder{
+		Request:   req,
+		local:     req.LocalPort,
+		client:    c,
+		connected: make(chan struct{}),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	conn, err := pf.connect()
+	if err != nil {
+		close(pf.done)
+		return nil, err
+	}
+	go pf.run(conn)
+	return pf, nil
+}
+
+// portForwardConn is one connection of a PortForwarder. dropped gets the
+// result of ForwardPorts when it stops. stop stops it.
+type portForwardConn struct {
+	dropped chan error
+	stop    func()
+	podUID  types.UID
+}
+
+// LocalPort returns the local port of the forward
+func (pf *PortForwarder) LocalPort() int {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	return pf.local
+}
+
+// Name names the forward in logs and errors
+func (pf *PortForwarder) Name() string {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	return pf.name()
+}
+
+// name is Name for callers that hold the mutex
+func (pf *PortForwarder) name() string {
+	return fmt.Sprintf("localhost:%d to %s/%s:%d",
+		pf.local, pf.Request.PodNamespace, pf.Request.PodName, pf.Request.PodPort)
+}
+
+// Err returns nil if the forward is up, or why it is not
+func (pf *PortForwarder) Err() error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	select {
+	case <-pf.closed:
+		return fmt.Errorf("port forward %s is closed", pf.name())
+	default:
+	}
+	select {
+	case <-pf.connected:
+		return nil
+	default:
+	}
+	if pf.err != nil {
+		return fmt.Errorf("port forward %s is down: %v", pf.name(), pf.err)
+	}
+	return fmt.Errorf("port forward %s is down", pf.name())
+}
+
+// Ready waits up to timeout for the forward to be up. It returns at once
+// if it is up or closed.
+func (pf *PortForwarder) Ready(timeout time.Duration) error {
+	pf.mutex.Lock()
+	connected := pf.connected
+	pf.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-connected:
+	case <-pf.closed:
+	case <-timer.C:
+	}
+	return pf.Err()
+}
+
+// IsClosed is true after Close
+func (pf *PortForwarder) IsClosed() bool {
+	select {
+	case <-pf.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the forward and waits for its connection to close
+func (pf *PortForwarder) Close() {
+	pf.mutex.Lock()
+	select {
+	case <-pf.closed:
+	default:
+		close(pf.closed)
+	}
+	pf.mutex.Unlock()
+	<-pf.done
+}
+
+// check returns an error if the pod of the connection is gone, not
+// running or was replaced. A failure to get the pod is only logged, so a
+// slow API server does not drop a working forward.
+func (pf *PortForwarder) check(conn *portForwardConn) error {
+	pod, err := pf.client.Clientset.CoreV1().Pods(pf.Request.PodNamespace).Get(context.Background(), pf.Request.PodName, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("pod %s is gone", pf.Request.PodName)
+	} else if err != nil {
+		core.Log.Debugf("could not check port forward %s: %v", pf.Name(), err)
+		return nil
+	}
+	if pod.UID != conn.podUID {
+		return fmt.Errorf("pod %s was replaced", pf.Request.PodName)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return fmt.Errorf("pod %s is not running. Current status=%v", pf.Request.PodName, pod.Status.Phase)
+	}
+	return nil
+}
+
+// run watches connections and connects again when they drop until Close
+func (pf *PortForwarder) run(conn *portForwardConn) {
+	defer close(pf.done)
+	retry := portForwardRetryMin
+	ticker := time.NewTicker(portForwardCheckInterval)
+	defer ticker.Stop()
+	for {
+		// wait for the connection to drop or fail a check
+		var dropErr error
+	watch:
+		for {
+			select {
+			case <-pf.closed:
+				<-conn.dropped
+				return
+			case <-ticker.C:
+				if err := pf.check(conn); err != nil {
+					dropErr = err
+					conn.stop()
+					<-conn.dropped
+					break watch
+				}
+			case err := <-conn.dropped:
+				dropErr = err
+				break watch
+			}
+		}
+		core.Log.Warnf("port forward %s dropped: %v", pf.Name(), pf.down(dropErr))
+
+		// connect again until it works or we are closed
+		for {
+			select {
+			case <-pf.closed:
+				return
+			case <-time.After(retry):
+			}
+
+			var err error
+			if conn, err = pf.connect(); err == nil {
+				core.Log.Warnf("port forward %s reconnected", pf.Name())
+				retry = portForwardRetryMin
+				break
+			}
+			pf.down(err)
+			core.Log.Warnf("could not reconnect port forward %s: %v", pf.Name(), err)
+			if retry *= 2; retry > portForwardRetryMax {
+				retry = portForwardRetryMax
+			}
+		}
+	}
+}
+
+// down records why the connection is down and gets a new connected chan
+func (pf *PortForwarder) down(err error) error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	if err == nil {
+		err = fmt.Errorf("lost connection to pod")
+	}
+	pf.err = err
+	select {
+	case <-pf.connected:
+		pf.connected = make(chan struct{})
+	default:
+	}
+	return err
+}
+
+// connect makes one connection to the pod and listens on the local port
+func (pf *PortForwarder) connect() (*portForwardConn, error) {
+	req := pf.Request
+	c := pf.client
+
+	// get the pod
+	pod, err := c.PodGetByName(req.PodNamespace, req.PodName)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the status
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil, fmt.Errorf("unable to forward port because pod %s is not running. Current status=%v", req.PodName, pod.Status.Phase)
+	}
+
+	// make the dialer to establish port forwarding
+	kubeAPIUrl, err := url.Parse(c.Config.Host)
+	if err != nil {
+		return nil, err
+	}
+	kubeAPIUrl.Path = path.Join(
+		"api", "v1",
+		"namespaces", req.PodNamespace,
+		"pods", req.PodName,
+		"portforward",
+	)
+	transport, upgrader, err := spdy.RoundTripperFor(c.Config)
+	if err != nil {
+		return nil, err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, kubeAPIUrl)
+
+	// make the stop and ready channels. Close stops the connection through
+	// stopCh.
+	stopCh := make(chan struct{})
+	stopOnce := sync.Once{}
+	stop := func() { stopOnce.Do(func() { close(stopCh) }) }
+	readyCh := make(chan struct{})
+
+	// make pipes for the output of the forwarder. they are closed when the
+	// connection stops.
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+	fw, err := portforward.New(dialer,
+		[]string{fmt.Sprintf("%d:%d", pf.LocalPort(), req.PodPort)},
+		stopCh,
+		readyCh,
+		outW,
+		errW)
+	if err != nil {
+		return nil, err
+	}
+
+	// send all output to logs
+	go StreamAllToLog(fmt.Sprintf("%s/%s: ", req.PodNamespace, req.PodName), outR, errR)
+
+	// forward
+	dropped := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		err := fw.ForwardPorts()
+		outW.Close()
+		errW.Close()
+		close(finished)
+		dropped <- err
+	}()
+	go func() {
+		select {
+		case <-pf.closed:
+			stop()
+		case <-finished:
+		}
+	}()
+
+	// wait on the ready channel
+	select {
+	case <-readyCh:
+	case <-pf.closed:
+		return nil, fmt.Errorf("port forward to %s/%s:%d was closed before it was ready",
+			req.PodNamespace, req.PodName, req.PodPort)
+	case err := <-dropped:
+		if err == nil {
+			err = fmt.Errorf("connection closed before it was ready")
+		}
+		return nil, fmt.Errorf("could not forward port to %s/%s:%d: %v",
+			req.PodNamespace, req.PodName, req.PodPort, err)
+	}
+
+	// get the forwarded ports. stop the connection if we cannot use it and
+	// wait for it to let go of the local port.
+	ports, err := fw.GetPorts()
+	if err != nil {
+		stop()
+		<-dropped
+		return nil, fmt.Errorf("could not get the forwarded ports to %s/%s:%d: %v",
+			req.PodNamespace, req.PodName, req.PodPort, err)
+	}
+
+	pf.mutex.Lock()
+	pf.local = int(ports[0].Local)
+	pf.err = nil
+	close(pf.connected)
+	pf.mutex.Unlock()
+	return &portForwardConn{dropped: dropped, stop: stop, podUID: pod.UID}, nil
+}
+
+// portForwardPoolEntry is a forward in the pool of a Client. ready is
+// closed once it is open or failed to open.
+type portForwardPoolEntry struct {
+	ready     chan struct{}
+	forwarder *PortForwarder
+	err       error
+}
+
+// how long PortForwardPooled waits for a pooled forward that is down
+const portForwardPooledTimeout = 30 * time.Second
+
+// PortForwardPooled returns the local port of a forward to podPort of the
+// pod. The forward is opened on first use and reused by later calls until
+// Close. Forwards to different pods open at the same time. A forward that
+// dropped is waited for while it reconnects.
+func (c *Client) PortForwardPooled(namespace, podName string, podPort int) (localPort int, err error) {
+	key := fmt.Sprintf("%s/%s:%d", namespace, podName, podPort)
+
+	c.forwardsMutex.Lock()
+	entry, ok := c.forwards[key]
+	if ok {
+		select {
+		case <-entry.ready:
+			if entry.err != nil || entry.forwarder.IsClosed() {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		entry = &portForwardPoolEntry{ready: make(chan struct{})}
+		c.forwards[key] = entry
+		c.forwardsMutex.Unlock()
+
+		entry.forwarder, entry.err = c.PortForward(&PortForwardRequest{
+			LocalPort:    0,
+			PodName:      podName,
+			PodNamespace: namespace,
+			PodPort:      podPort,
+		})
+		close(entry.ready)
+		if entry.err == nil {
+			core.Log.Debugf("forwarding %s", entry.forwarder.Name())
+		}
+	} else {
+		c.forwardsMutex.Unlock()
+	}
+
+	<-entry.ready
+	if entry.err != nil {
+		return 0, entry.err
+	}
+	if err := entry.forwarder.Ready(portForwardPooledTimeout); err != nil {
+		return 0, err
+	}
+	return entry.forwarder.LocalPort(), nil
+}
+
+// Close stops the port forwards of the pool
+func (c *Client) Close() {
+	c.forwardsMutex.Lock()
+	entries := c.forwards
+	c.forwards = make(map[string]*portForwardPoolEntry)
+	c.forwardsMutex.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, entry := range entries {
+		entry := entry
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-entry.ready
+			if entry.forwarder != nil {
+				entry.forwarder.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,29 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	_ "embed"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
 	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/host"
 	"github.com/jkassis/jerriedr/cmd/kube"
+	"github.com/jkassis/jerriedr/cmd/s3"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+//go:embed jerriedr.yaml
+var confDefault []byte
+
 // MAIN represents the base command when called without any subcommands
 var MAIN = &cobra.Command{
 	Use:   "jerriedr",
 	Short: "A CLI for operations on jerrie services.",
 }
 
+// version is set by the release build
+var version = "dev"
+
 func main() {
+	schema.Version = version
+	MAIN.Version = version
+
+	// close the port forwards however the command exits
+	logrus.RegisterExitHandler(KubeClientsClose)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		<-signals
+		KubeClientsClose()
+		os.Exit(130)
+	}()
+
 	err := MAIN.Execute()
+	KubeClientsClose()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -41,6 +73,36 @@ const (
 	FLAG_DST              = "da"
 	FLAG_SERVICE          = "se"
 	FLAG_RESTORE_ARCHIVE  = "ra"
+	FLAG_CONF             = "cf"
+	FLAG_FROM             = "from"
+	FLAG_TO               = "to"
+	FLAG_SSH_USER         = "su"
+	FLAG_SSH_PORT         = "sp"
+	FLAG_SSH_KEY          = "sk"
+	FLAG_SSH_KNOWN_HOSTS  = "kh"
+	FLAG_S3_ENDPOINT      = "s3e"
+	FLAG_S3_REGION        = "s3r"
+	FLAG_LATEST           = "latest"
+	FLAG_AT               = "at"
+	FLAG_BEFORE           = "before"
+	FLAG_LABEL            = "label"
+	FLAG_SINCE            = "since"
+	FLAG_BETWEEN          = "between"
+	FLAG_WEEKDAY          = "weekday"
+	FLAG_HOUR             = "hour"
+	FLAG_FILTER           = "filter"
+	FLAG_SNAPSHOT         = "snapshot"
+	FLAG_JOURNAL_DIR      = "jd"
+	FLAG_NO_SAFETY        = "no-safety-snapshot"
+	FLAG_SAFETY_PIN       = "safety-pin"
+	FLAG_SNAP_TIMEOUT     = "timeout"
+	FLAG_DRY_RUN          = "dry-run"
+	FLAG_PLAN_OUT         = "plan-out"
+	FLAG_PLAN_IN          = "plan-in"
+	FLAG_PLAN_FORMAT      = "plan-format"
+	FLAG_ENV              = "env"
+	FLAG_STAGE            = "stage"
+	FLAG_OUTPUT           = "output"
 )
 
 func FlagsAddDBFlags(c *cobra.Command, v *viper.Viper) {
@@ -59,6 +121,97 @@ func FlagsAddKubeFlags(c *cobra.Command, v *viper.Viper) {
 	v.BindPFlag(FLAG_KUBE_MASTER_URL, c.PersistentFlags().Lookup(FLAG_KUBE_MASTER_URL))
 }
 
+func FlagsAddSSHFlags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_SSH_USER, "", "ssh user for host archives and services. defaults to $USER")
+	v.BindPFlag(FLAG_SSH_USER, c.PersistentFlags().Lookup(FLAG_SSH_USER))
+
+	c.PersistentFlags().Int(FLAG_SSH_PORT, 22, "ssh port for host archives and services")
+	v.BindPFlag(FLAG_SSH_PORT, c.PersistentFlags().Lookup(FLAG_SSH_PORT))
+
+	c.PersistentFlags().String(FLAG_SSH_KEY, "", "path to the ssh private key. defaults to the usual keys in ~/.ssh and the ssh agent")
+	v.BindPFlag(FLAG_SSH_KEY, c.PersistentFlags().Lookup(FLAG_SSH_KEY))
+
+	c.PersistentFlags().String(FLAG_SSH_KNOWN_HOSTS, "", "path to the ssh known_hosts file. defaults to ~/.ssh/known_hosts")
+	v.BindPFlag(FLAG_SSH_KNOWN_HOSTS, c.PersistentFlags().Lookup(FLAG_SSH_KNOWN_HOSTS))
+}
+
+func FlagsAddS3Flags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_S3_ENDPOINT, "", "endpoint URL for s3 archives. defaults to $AWS_ENDPOINT_URL or AWS")
+	v.BindPFlag(FLAG_S3_ENDPOINT, c.PersistentFlags().Lookup(FLAG_S3_ENDPOINT))
+
+	c.PersistentFlags().String(FLAG_S3_REGION, "", "region for s3 archives. defaults to $AWS_REGION or us-east-1")
+	v.BindPFlag(FLAG_S3_REGION, c.PersistentFlags().Lookup(FLAG_S3_REGION))
+}
+
+func FlagsAddSnapshotPickFlags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().Bool(FLAG_LATEST, false, "pick the most recent complete snapshot instead of asking")
+	v.BindPFlag(FLAG_LATEST, c.PersistentFlags().Lookup(FLAG_LATEST))
+
+	c.PersistentFlags().String(FLAG_AT, "", "pick the snapshot nearest this RFC3339 time instead of asking")
+	v.BindPFlag(FLAG_AT, c.PersistentFlags().Lookup(FLAG_AT))
+
+	c.PersistentFlags().String(FLAG_BEFORE, "", "pick the newest snapshot before this RFC3339 time instead of asking")
+	v.BindPFlag(FLAG_BEFORE, c.PersistentFlags().Lookup(FLAG_BEFORE))
+
+	c.PersistentFlags().String(FLAG_SNAPSHOT, "", "pick the snapshot with this id instead of asking")
+	v.BindPFlag(FLAG_SNAPSHOT, c.PersistentFlags().Lookup(FLAG_SNAPSHOT))
+
+	c.PersistentFlags().String(FLAG_LABEL, "", "only pick from snapshots with this label")
+	v.BindPFlag(FLAG_LABEL, c.PersistentFlags().Lookup(FLAG_LABEL))
+
+	c.PersistentFlags().String(FLAG_SINCE, "", "only pick from snapshots since a duration ago (eg. 36h, 7d, 2w) or an RFC3339 time")
+	v.BindPFlag(FLAG_SINCE, c.PersistentFlags().Lookup(FLAG_SINCE))
+
+	c.PersistentFlags().String(FLAG_BETWEEN, "", "only pick from snapshots between two times as <from>,<to>")
+	v.BindPFlag(FLAG_BETWEEN, c.PersistentFlags().Lookup(FLAG_BETWEEN))
+
+	c.PersistentFlags().String(FLAG_WEEKDAY, "", "only pick from snapshots on these weekdays (eg. sat,sun)")
+	v.BindPFlag(FLAG_WEEKDAY, c.PersistentFlags().Lookup(FLAG_WEEKDAY))
+
+	c.PersistentFlags().String(FLAG_HOUR, "", "only pick from snapshots in these hours (eg. 0,12)")
+	v.BindPFlag(FLAG_HOUR, c.PersistentFlags().Lookup(FLAG_HOUR))
+
+	c.PersistentFlags().String(FLAG_FILTER, "", "only pick from snapshots that match any of these filters (eg. \"weekday=sun hour=0 | since=1d\"). the other filter flags apply to each")
+	v.BindPFlag(FLAG_FILTER, c.PersistentFlags().Lookup(FLAG_FILTER))
+}
+
+func FlagsAddSnapTimeoutFlag(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().Duration(FLAG_SNAP_TIMEOUT, 30*time.Minute, "how long to wait for the backup files of a snapshot")
+	v.BindPFlag(FLAG_SNAP_TIMEOUT, c.PersistentFlags().Lookup(FLAG_SNAP_TIMEOUT))
+}
+
+func FlagsAddRestoreFlags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_JOURNAL_DIR, "", "dir of the restore journals. defaults to ~/.jerriedr/journal")
+	v.BindPFlag(FLAG_JOURNAL_DIR, c.PersistentFlags().Lookup(FLAG_JOURNAL_DIR))
+
+	c.PersistentFlags().Bool(FLAG_NO_SAFETY, false, "do not snapshot the target services before restoring. the restore cannot be rolled back")
+	v.BindPFlag(FLAG_NO_SAFETY, c.PersistentFlags().Lookup(FLAG_NO_SAFETY))
+
+	c.PersistentFlags().Duration(FLAG_SAFETY_PIN, 14*24*time.Hour, "how long to pin the snapshot taken before the restore. 0 pins it until unpinned")
+	v.BindPFlag(FLAG_SAFETY_PIN, c.PersistentFlags().Lookup(FLAG_SAFETY_PIN))
+
+	FlagsAddSnapTimeoutFlag(c, v)
+}
+
+func FlagsAddDryRunFlag(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().Bool(FLAG_DRY_RUN, false, "show the plan of what would be done to services and archives without doing it")
+	v.BindPFlag(FLAG_DRY_RUN, c.PersistentFlags().Lookup(FLAG_DRY_RUN))
+}
+
+func FlagsAddPlanFlags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_PLAN_OUT, "", "write the plan to this file as JSON instead of doing it. run it with jerriedr plan --plan-in")
+	v.BindPFlag(FLAG_PLAN_OUT, c.PersistentFlags().Lookup(FLAG_PLAN_OUT))
+
+	c.PersistentFlags().String(FLAG_PLAN_FORMAT, "text", "format of the plan shown by --dry-run. text | json")
+	v.BindPFlag(FLAG_PLAN_FORMAT, c.PersistentFlags().Lookup(FLAG_PLAN_FORMAT))
+}
+
+func FlagsAddPlanInFlag(c *cobra.Command, v *viper.Viper) {
+	c.Flags().String(FLAG_PLAN_IN, "", "path to a plan written by --plan-out")
+	c.MarkFlagRequired(FLAG_PLAN_IN)
+	v.BindPFlag(FLAG_PLAN_IN, c.Flags().Lookup(FLAG_PLAN_IN))
+}
+
 func FlagsAddHostFlags(c *cobra.Command, v *viper.Viper) {
 	c.PersistentFlags().String(FLAG_HOSTPORT, "localhost:10000", "server hostport")
 	// c.MarkPersistentFlagRequired(FLAG_SERVER_HOSTPORT)
@@ -88,6 +241,37 @@ func FlagsAddDstFlag(c *cobra.Command, v *viper.Viper) {
 	v.BindPFlag(FLAG_DST, c.PersistentFlags().Lookup(FLAG_DST))
 }
 
+// FlagsAddFromFlag adds --from to c alone, so subcommands of c do not
+// require it
+func FlagsAddFromFlag(c *cobra.Command, v *viper.Viper) {
+	c.Flags().String(FLAG_FROM, "", "source as <env>:<stage>")
+	c.MarkFlagRequired(FLAG_FROM)
+	v.BindPFlag(FLAG_FROM, c.Flags().Lookup(FLAG_FROM))
+}
+
+// FlagsAddToFlag adds --to to c alone, so subcommands of c do not require
+// it
+func FlagsAddToFlag(c *cobra.Command, v *viper.Viper) {
+	c.Flags().String(FLAG_TO, "", "destination as <env>:<stage>")
+	c.MarkFlagRequired(FLAG_TO)
+	v.BindPFlag(FLAG_TO, c.Flags().Lookup(FLAG_TO))
+}
+
+func FlagsAddEnvStageFlags(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_ENV, "", "name of the env in the conf file")
+	c.MarkPersistentFlagRequired(FLAG_ENV)
+	v.BindPFlag(FLAG_ENV, c.PersistentFlags().Lookup(FLAG_ENV))
+
+	c.PersistentFlags().String(FLAG_STAGE, "", "archive stage of the env. snap | backup")
+	c.MarkPersistentFlagRequired(FLAG_STAGE)
+	v.BindPFlag(FLAG_STAGE, c.PersistentFlags().Lookup(FLAG_STAGE))
+}
+
+func FlagsAddOutputFlag(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().StringP(FLAG_OUTPUT, "o", "table", "output format. table | json | yaml")
+	v.BindPFlag(FLAG_OUTPUT, c.PersistentFlags().Lookup(FLAG_OUTPUT))
+}
+
 func FlagsAddServiceFlag(c *cobra.Command, v *viper.Viper) {
 	c.PersistentFlags().String(FLAG_SERVICE, "", "service")
 	c.MarkPersistentFlagRequired(FLAG_SERVICE)
@@ -100,11 +284,195 @@ func FlagsAddRestoreArchivesDir(c *cobra.Command, v *viper.Viper) {
 	v.BindPFlag(FLAG_RESTORE_ARCHIVE, c.PersistentFlags().Lookup(FLAG_RESTORE_ARCHIVE))
 }
 
+func FlagsAddConfFlag(c *cobra.Command, v *viper.Viper) {
+	c.PersistentFlags().String(FLAG_CONF, "", "path to the env conf file. uses the built-in conf if empty")
+	v.BindPFlag(FLAG_CONF, c.PersistentFlags().Lookup(FLAG_CONF))
+}
+
+func EnvConfGet(v *viper.Viper) (*schema.EnvConf, error) {
+	confPath := v.GetString(FLAG_CONF)
+	if confPath != "" {
+		v.SetConfigFile(confPath)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("could not read conf from %s: %w", confPath, err)
+		}
+	} else {
+		v.SetConfigType("yaml")
+		if err := v.ReadConfig(bytes.NewReader(confDefault)); err != nil {
+			return nil, fmt.Errorf("could not read built-in conf: %w", err)
+		}
+	}
+
+	envConf := schema.EnvConfNew()
+	if err := v.UnmarshalKey("envs", &envConf.Envs); err != nil {
+		return nil, fmt.Errorf("could not parse envs from conf: %w", err)
+	}
+	for envName, env := range envConf.Envs {
+		if env == nil {
+			env = &schema.Env{}
+			envConf.Envs[envName] = env
+		}
+		env.Name = envName
+	}
+	return envConf, nil
+}
+
+func EnvGet(v *viper.Viper, envName string) (*schema.Env, error) {
+	envConf, err := EnvConfGet(v)
+	if err != nil {
+		return nil, err
+	}
+	return envConf.EnvGet(envName)
+}
+
+// SnapshotPickGet reads the snapshot pick flags. The zero SnapshotPick
+// means ask the user.
+func SnapshotPickGet(v *viper.Viper) (*schema.SnapshotPick, error) {
+	pick := &schema.SnapshotPick{
+		Latest:     v.GetBool(FLAG_LATEST),
+		SnapshotID: v.GetString(FLAG_SNAPSHOT),
+		Label:      v.GetString(FLAG_LABEL),
+	}
+	picks := 0
+	if pick.Latest {
+		picks++
+	}
+	if pick.SnapshotID != "" {
+		picks++
+	}
+	if at := v.GetString(FLAG_AT); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse --%s: %w", FLAG_AT, err)
+		}
+		pick.At = t
+		picks++
+	}
+	if before := v.GetString(FLAG_BEFORE); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse --%s: %w", FLAG_BEFORE, err)
+		}
+		pick.Before = t
+		picks++
+	}
+	if picks > 1 {
+		return nil, fmt.Errorf("use only one of --%s, --%s, --%s and --%s", FLAG_LATEST, FLAG_AT, FLAG_BEFORE, FLAG_SNAPSHOT)
+	}
+
+	filters, err := TimeFiltersGet(v)
+	if err != nil {
+		return nil, err
+	}
+	pick.Filters = filters
+	return pick, nil
+}
+
+// TimeFiltersGet returns the filters given by --filter, each ANDed with
+// the conditions of the other filter flags
+func TimeFiltersGet(v *viper.Viper) ([]*schema.TimeFilter, error) {
+	flagFilter := &schema.TimeFilter{}
+	for _, flag := range []string{FLAG_SINCE, FLAG_BETWEEN, FLAG_WEEKDAY, FLAG_HOUR} {
+		if value := v.GetString(flag); value != "" {
+			if err := flagFilter.ConditionAdd(flag + "=" + value); err != nil {
+				return nil, fmt.Errorf("--%s: %w", flag, err)
+			}
+		}
+	}
+
+	filters, err := schema.TimeFiltersParse(v.GetString(FLAG_FILTER))
+	if err != nil {
+		return nil, fmt.Errorf("--%s: %w", FLAG_FILTER, err)
+	}
+	if len(filters) == 0 {
+		if flagFilter.IsEmpty() {
+			return nil, nil
+		}
+		return []*schema.TimeFilter{flagFilter}, nil
+	}
+	for _, filter := range filters {
+		filter.And(flagFilter)
+	}
+	return filters, nil
+}
+
+// Output writes value to stdout in the format given by -o. table writes
+// the table format.
+func Output(v *viper.Viper, value interface{}, table func(w io.Writer)) error {
+	switch format := v.GetString(FLAG_OUTPUT); format {
+	case "table", "":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(w)
+		return w.Flush()
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case "yaml":
+		out, err := yaml.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("could not marshal output: %w", err)
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	default:
+		return fmt.Errorf("--%s must be table | json | yaml: %s", FLAG_OUTPUT, format)
+	}
+}
+
+// HostConfigure sets the ssh config used for host archives and services
+func HostConfigure(v *viper.Viper) {
+	if user := v.GetString(FLAG_SSH_USER); user != "" {
+		host.DefaultConfig.User = user
+	}
+	if port := v.GetInt(FLAG_SSH_PORT); port != 0 {
+		host.DefaultConfig.Port = port
+	}
+	if keyPath := v.GetString(FLAG_SSH_KEY); keyPath != "" {
+		host.DefaultConfig.KeyPaths = []string{keyPath}
+	}
+	if knownHostsPath := v.GetString(FLAG_SSH_KNOWN_HOSTS); knownHostsPath != "" {
+		host.DefaultConfig.KnownHostsPath = knownHostsPath
+	}
+}
+
+// S3Configure sets the endpoint used for s3 archives.
+// credentials always come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func S3Configure(v *viper.Viper) {
+	if region := v.GetString(FLAG_S3_REGION); region != "" {
+		s3.DefaultConfig.Region = region
+	}
+	if endpoint := v.GetString(FLAG_S3_ENDPOINT); endpoint != "" {
+		s3.DefaultConfig.Endpoint = endpoint
+	}
+}
+
+// kubeClients are the kube clients made by KubeClientGet. Their port
+// forwards are closed when the command exits.
+var kubeClients = make([]*kube.Client, 0)
+var kubeClientsMutex sync.Mutex
+
 func KubeClientGet(v *viper.Viper) (*kube.Client, error) {
 	// use the current context in kubeconfig
 	kubeMasterURL := v.GetString(FLAG_KUBE_MASTER_URL)
 	kubeConfigPath := v.GetString(FLAG_KUBE_CONFIG_PATH)
-	return kube.NewClient(kubeMasterURL, kubeConfigPath)
+	kubeClient, err := kube.NewClient(kubeMasterURL, kubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	kubeClientsMutex.Lock()
+	kubeClients = append(kubeClients, kubeClient)
+	kubeClientsMutex.Unlock()
+	return kubeClient, nil
+}
+
+// KubeClientsClose closes the port forwards of the kube clients
+func KubeClientsClose() {
+	kubeClientsMutex.Lock()
+	defer kubeClientsMutex.Unlock()
+	for _, kubeClient := range kubeClients {
+		kubeClient.Close()
+	}
 }
 
 func KubeConfGet(v *viper.Viper) (*restclient.Config, error) {
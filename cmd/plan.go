@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// --dry-run and --plan-out work for every command, so they go on MAIN
+	vMain := viper.New()
+	FlagsAddDryRunFlag(MAIN, vMain)
+	FlagsAddPlanFlags(MAIN, vMain)
+	MAIN.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return PlanStart(vMain, cmd)
+	}
+	MAIN.PersistentPostRunE = func(cmd *cobra.Command, args []string) error {
+		return PlanEnd(vMain)
+	}
+
+	// commands that fail exit through the log and never get to
+	// PersistentPostRunE, so show what they recorded from there
+	logrus.RegisterExitHandler(func() {
+		PlanAbort(vMain)
+	})
+
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "plan",
+		Short: "Runs a plan written by --plan-out as it is.",
+		Long: `Runs a plan written by --plan-out as it is. The actions of the plan
+run in order without asking or picking again. The run stops at the
+first action that fails.
+
+A restore plan is journaled like any restore. Run the plan again to
+pick up a restore that stopped where it stopped.
+
+eg. jerriedr prodSnapToProdService --latest --plan-out restore.json
+    jerriedr plan --plan-in restore.json --dry-run
+    jerriedr plan --plan-in restore.json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDPlan(v)
+		},
+	}
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddPlanInFlag(c, v)
+	MAIN.AddCommand(c)
+}
+
+// PlanStart starts recording a plan for cmd if --dry-run or --plan-out
+// is set
+func PlanStart(v *viper.Viper, cmd *cobra.Command) error {
+	if format := v.GetString(FLAG_PLAN_FORMAT); format != "text" && format != "json" {
+		return fmt.Errorf("--%s must be text | json: %s", FLAG_PLAN_FORMAT, format)
+	}
+	if !v.GetBool(FLAG_DRY_RUN) && v.GetString(FLAG_PLAN_OUT) == "" {
+		return nil
+	}
+	command := strings.Join(append([]string{cmd.Root().Name()}, os.Args[1:]...), " ")
+	schema.PlanRecord(schema.PlanNew(command))
+	return nil
+}
+
+// PlanEnd stops recording and writes the plan to --plan-out and stdout
+func PlanEnd(v *viper.Viper) error {
+	plan := schema.PlanRecordingGet()
+	if plan == nil {
+		return nil
+	}
+	schema.PlanRecord(nil)
+
+	if path := v.GetString(FLAG_PLAN_OUT); path != "" {
+		if err := plan.Put(path); err != nil {
+			return err
+		}
+		core.Log.Warnf("wrote plan to %s. run it with: jerriedr plan --plan-in %s", path, path)
+	}
+	return planPrint(v, plan)
+}
+
+// PlanAbort stops recording when the command fails before PlanEnd. It
+// shows the actions recorded up to the failure. It does not write them
+// to --plan-out, since running them would do only part of the command.
+func PlanAbort(v *viper.Viper) {
+	plan := schema.PlanRecordingGet()
+	if plan == nil {
+		return
+	}
+	schema.PlanRecord(nil)
+
+	if path := v.GetString(FLAG_PLAN_OUT); path != "" {
+		core.Log.Warnf("the command failed. did not write the plan to %s", path)
+	}
+	core.Log.Warnf("the command failed. the plan is only what it recorded before it stopped")
+	if err := planPrint(v, plan); err != nil {
+		core.Log.Warnf("could not show the plan: %v", err)
+	}
+}
+
+// planPrint writes plan to stdout in --plan-format
+func planPrint(v *viper.Viper, plan *schema.Plan) error {
+	if v.GetString(FLAG_PLAN_FORMAT) == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+	fmt.Print(plan)
+	return nil
+}
+
+func CMDPlan(v *viper.Viper) {
+	plan, err := schema.PlanGet(v.GetString(FLAG_PLAN_IN))
+	if err != nil {
+		core.Log.Fatalf("plan: %v", err)
+	}
+
+	// with --dry-run, show the plan read instead of running it
+	if schema.PlanRecordingGet() != nil {
+		schema.PlanRecord(plan)
+		return
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	core.Log.Warnf("running plan for %s made %s", plan.Command, plan.Created.Format(time.RFC3339))
+	if err := plan.Run(kubeClient); err != nil {
+		if plan.Journal != nil {
+			core.Log.Fatalf("plan: %v. services may be left paused. fix the cause and run the plan again to pick up restore %s",
+				err, plan.Journal.ID)
+		}
+		core.Log.Fatalf("plan: %v. the actions before it are done", err)
+	}
+	core.Log.Warnf("plan done")
+}
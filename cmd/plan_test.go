@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+)
+
+func TestPlanAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := MAIN.PersistentFlags().Set(FLAG_PLAN_OUT, path); err != nil {
+		t.Fatal(err)
+	}
+	defer MAIN.PersistentFlags().Set(FLAG_PLAN_OUT, "")
+
+	plan := schema.PlanNew("jerriedr archive prune prod:backup --plan-out " + path)
+	plan.Actions = append(plan.Actions, &schema.PlanAction{
+		Op:     schema.PlanOpRemove,
+		Target: "local|dockie|/var/jerrie/archive/prod/dockie/2026-01-10T12:00:00Z.bak",
+		Note:   "remove /var/jerrie/archive/prod/dockie/2026-01-10T12:00:00Z.bak",
+	})
+	schema.PlanRecord(plan)
+	defer schema.PlanRecord(nil)
+
+	// fail the command the way commands do, catching the exit and stdout
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	exitFunc := core.Log.ExitFunc
+	exitCode := 0
+	core.Log.ExitFunc = func(code int) { exitCode = code }
+	core.Log.Fatalf("archive prune: could not remove a file")
+	core.Log.ExitFunc = exitFunc
+	os.Stdout = stdout
+	writer.Close()
+	shown, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exitCode != 1 {
+		t.Errorf("exited with %d, want 1", exitCode)
+	}
+	if schema.PlanRecordingGet() != nil {
+		t.Error("still recording after the command failed")
+	}
+	if !strings.Contains(string(shown), plan.Actions[0].Note) {
+		t.Errorf("did not show the actions recorded before the failure: %q", shown)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("wrote the plan of a failed command to --%s: %v", FLAG_PLAN_OUT, err)
+	}
+}
@@ -28,23 +28,28 @@ func init() {
 				core.Log.Warnf("could not init kubeClient: %v", err)
 			}
 
-			// for each service
-			services := make([]*schema.Service, 0)
-			for _, serviceSpec := range prodServiceSpecs {
-				service := &schema.Service{}
-				if err := service.Parse(serviceSpec); err != nil {
-					core.Log.Fatalf("could not parse serviceSpec %s", serviceSpec)
-				}
-
-				services = append(services, service)
+			serviceSet, err := EnvServiceSetGet(v, "prod", "")
+			if err != nil {
+				core.Log.Fatalf("could not get services: %v", err)
 			}
 
-			err = schema.EnvSnap(kubeClient, services)
+			snapArchiveSet, err := EnvArchiveSetGet(v, "prod", schema.EnvStageSnap)
+			if err != nil {
+				core.Log.Fatalf("could not get snap archives: %v", err)
+			}
+
+			HostConfigure(v)
+			S3Configure(v)
+			snapshotID, files, err := schema.EnvSnap(kubeClient, serviceSet.Services, snapArchiveSet, v.GetDuration(FLAG_SNAP_TIMEOUT))
 			if err != nil {
 				core.Log.Fatalf("could not complete production snapshot: %v", err)
 			}
 
 			duration := time.Since(start)
+			core.Log.Warnf("snapshot %s", snapshotID)
+			for _, file := range files {
+				core.Log.Warnf("  %s/%s: %d bytes", file.Archive.Spec, file.Name, file.Size)
+			}
 			core.Log.Warnf("prodSnapshotTake: took %s", duration.String())
 		},
 	}
@@ -53,6 +58,10 @@ func init() {
 	FlagsAddKubeFlags(c, v)
 	FlagsAddProtocolFlag(c, v)
 	FlagsAddAPIVersionFlag(c, v)
+	FlagsAddConfFlag(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddSnapTimeoutFlag(c, v)
 
 	MAIN.AddCommand(c)
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// restoreAliases are the per-pair restore commands that predate
+// restore --from --to
+var restoreAliases = []struct {
+	Use  string
+	From string
+	To   string
+}{
+	{"prodSnapToProdService", "prod:snap", "prod:service"},
+	{"prodBackupToDevService", "prod:backup", "dev:service"},
+	{"devBackupToDevService", "dev:backup", "dev:service"},
+}
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "restore",
+		Short: "Restores a snapshot from the archives of an env stage to the services of an env.",
+		Long: `Restores a snapshot from the archives of an env stage to the services of an env.
+The source is given as <env>:<stage> where <stage> => snap | backup.
+The destination is given as <env>:service.
+
+The target services are snapshotted into the snap archives of their env
+first and the restore is recorded in a journal, so it can be rolled back
+with restore rollback <journal-id>.
+
+eg. jerriedr restore --from prod:backup --to dev:service`,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDRestore(v, v.GetString(FLAG_FROM), v.GetString(FLAG_TO))
+		},
+	}
+
+	rollback := &cobra.Command{
+		Use:   "rollback <journal-id>",
+		Short: "Puts the target of a restore back as it was before the restore.",
+		Long: `Puts the target of a restore back as it was before the restore by
+restoring the snapshot taken before it. The id may be any unique prefix
+of the journal id.
+
+eg. jerriedr restore rollback 3f2a`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDRestoreRollback(v, args[0])
+		},
+	}
+	c.AddCommand(rollback)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "resume <journal-id>",
+		Short: "Picks up a restore that stopped at the first step that is not done.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDRestoreResume(v, args[0])
+		},
+	})
+
+	status := &cobra.Command{
+		Use:   "status [<journal-id>]",
+		Short: "Lists the restores in the journal, or shows where each service of one stands.",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				CMDRestoreStatusList(v)
+			} else {
+				CMDRestoreStatus(v, args[0])
+			}
+		},
+	}
+	FlagsAddOutputFlag(status, v)
+	c.AddCommand(status)
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddConfFlag(c, v)
+	FlagsAddRestoreFlags(c, v)
+	FlagsAddSnapshotPickFlags(c, v)
+	FlagsAddFromFlag(c, v)
+	FlagsAddToFlag(c, v)
+	MAIN.AddCommand(c)
+
+	for _, alias := range restoreAliases {
+		alias := alias
+		v := viper.New()
+		c := &cobra.Command{
+			Use:   alias.Use,
+			Short: fmt.Sprintf("Alias for restore --from %s --to %s", alias.From, alias.To),
+			Long:  "",
+			Run: func(cmd *cobra.Command, args []string) {
+				CMDRestore(v, alias.From, alias.To)
+			},
+		}
+
+		FlagsAddKubeFlags(c, v)
+		FlagsAddSSHFlags(c, v)
+		FlagsAddS3Flags(c, v)
+		FlagsAddConfFlag(c, v)
+		FlagsAddRestoreFlags(c, v)
+		FlagsAddSnapshotPickFlags(c, v)
+		MAIN.AddCommand(c)
+	}
+}
+
+func CMDRestore(v *viper.Viper, from, to string) {
+	srcEnvName, srcStage, err := schema.EnvStageParse(from)
+	if err != nil {
+		core.Log.Fatalf("restore: --from: %v", err)
+	}
+
+	dstEnvName, dstStage, err := schema.EnvStageParse(to)
+	if err != nil {
+		core.Log.Fatalf("restore: --to: %v", err)
+	}
+	if dstStage != schema.EnvStageService {
+		core.Log.Fatalf("restore: --to must be <env>:%s. got %s", schema.EnvStageService, to)
+	}
+
+	srcArchiveSet, err := EnvArchiveSetGet(v, srcEnvName, srcStage)
+	if err != nil {
+		core.Log.Fatalf("restore: could not get src archives: %v", err)
+	}
+
+	dstServiceSet, err := EnvServiceSetGet(v, dstEnvName, srcEnvName)
+	if err != nil {
+		core.Log.Fatalf("restore: could not get dst services: %v", err)
+	}
+
+	pick, err := SnapshotPickGet(v)
+	if err != nil {
+		core.Log.Fatalf("restore: %v", err)
+	}
+
+	safety, err := RestoreSafetyGet(v, dstEnvName)
+	if err != nil {
+		core.Log.Fatalf("restore: %v", err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	journal := schema.RestoreJournalNew(JournalDirGet(v), from, to)
+	schema.EnvRestore(kubeClient, srcArchiveSet, dstServiceSet, pick, safety, journal)
+}
+
+func CMDRestoreRollback(v *viper.Viper, id string) {
+	journal, err := schema.RestoreJournalGet(JournalDirGet(v), id)
+	if err != nil {
+		core.Log.Fatalf("restore rollback: %v", err)
+	}
+	if journal.SafetySnapshotID == "" {
+		core.Log.Fatalf("restore rollback: restore %s has no pre-restore snapshot", journal.ID)
+	}
+
+	dstEnvName, _, err := schema.EnvStageParse(journal.Dst)
+	if err != nil {
+		core.Log.Fatalf("restore rollback: %v", err)
+	}
+
+	safetyEnvName, safetyStage, err := schema.EnvStageParse(journal.SafetySrc)
+	if err != nil {
+		core.Log.Fatalf("restore rollback: %v", err)
+	}
+
+	srcArchiveSet, err := EnvArchiveSetGet(v, safetyEnvName, safetyStage)
+	if err != nil {
+		core.Log.Fatalf("restore rollback: could not get src archives: %v", err)
+	}
+
+	// the snapshot was taken of the endpoints the restore touched. put
+	// back only those.
+	dstServiceSet, err := journal.SafetyServiceSetGet()
+	if err != nil {
+		core.Log.Fatalf("restore rollback: could not get dst services: %v", err)
+	}
+	if len(dstServiceSet.Services) == 0 {
+		core.Log.Fatalf("restore rollback: restore %s does not say which services it touched", journal.ID)
+	}
+
+	safety, err := RestoreSafetyGet(v, dstEnvName)
+	if err != nil {
+		core.Log.Fatalf("restore rollback: %v", err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	core.Log.Warnf("rolling back restore %s of %s to %s", journal.ID, journal.Src, journal.Dst)
+	rollbackJournal := schema.RestoreJournalNew(JournalDirGet(v), journal.SafetySrc, journal.Dst)
+	rollbackJournal.RollbackOf = journal.ID
+	pick := &schema.SnapshotPick{SnapshotID: journal.SafetySnapshotID}
+	schema.EnvRestore(kubeClient, srcArchiveSet, dstServiceSet, pick, safety, rollbackJournal)
+}
+
+func CMDRestoreResume(v *viper.Viper, id string) {
+	journal, err := schema.RestoreJournalGet(JournalDirGet(v), id)
+	if err != nil {
+		core.Log.Fatalf("restore resume: %v", err)
+	}
+	if !journal.Finished.IsZero() {
+		core.Log.Fatalf("restore resume: restore %s is done", journal.ID)
+	}
+	if len(journal.Steps) == 0 {
+		core.Log.Fatalf("restore resume: restore %s stopped before it touched any service. run it again instead", journal.ID)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	core.Log.Warnf("resuming restore %s of %s to %s: %s", journal.ID, journal.Src, journal.Dst, journal.State())
+	if err := schema.EnvRestoreResume(kubeClient, journal); err != nil {
+		core.Log.Fatalf("restore %s stopped: %v. services may be left paused. fix the cause and run: jerriedr restore resume %s",
+			journal.ID, err, journal.ID)
+	}
+	core.Log.Warnf("restore %s done", journal.ID)
+}
+
+func CMDRestoreStatusList(v *viper.Viper) {
+	journals, err := schema.RestoreJournalsList(JournalDirGet(v))
+	if err != nil {
+		core.Log.Fatalf("restore status: %v", err)
+	}
+
+	err = Output(v, journals, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tSTARTED\tSRC\tDST\tSTATE")
+		for _, journal := range journals {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				journal.ID, journal.Started.Format(time.RFC3339), journal.Src, journal.Dst, journal.State())
+		}
+	})
+	if err != nil {
+		core.Log.Fatalf("restore status: %v", err)
+	}
+}
+
+func CMDRestoreStatus(v *viper.Viper, id string) {
+	journal, err := schema.RestoreJournalGet(JournalDirGet(v), id)
+	if err != nil {
+		core.Log.Fatalf("restore status: %v", err)
+	}
+
+	err = Output(v, journal, func(w io.Writer) {
+		fmt.Fprintf(w, "restore %s of %s to %s: %s\n", journal.ID, journal.Src, journal.Dst, journal.State())
+		if journal.SafetySnapshotID != "" {
+			fmt.Fprintf(w, "pre-restore snapshot %s in %s\n", journal.SafetySnapshotID, journal.SafetySrc)
+		}
+		fmt.Fprintln(w, "PHASE\tSERVICE\tFILE\tSTATUS\tSTARTED\tFINISHED\tERROR")
+		for _, step := range journal.Steps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				step.Phase, step.Service, step.File, step.Status, timeFormat(step.Started), timeFormat(step.Finished), step.Error)
+		}
+	})
+	if err != nil {
+		core.Log.Fatalf("restore status: %v", err)
+	}
+}
+
+// timeFormat formats t as RFC3339, or "" if it is zero
+func timeFormat(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// RestoreSafetyGet returns how to snapshot the services of envName before
+// a restore, or nil if --no-safety-snapshot is set
+func RestoreSafetyGet(v *viper.Viper, envName string) (*schema.RestoreSafety, error) {
+	if v.GetBool(FLAG_NO_SAFETY) {
+		return nil, nil
+	}
+
+	snapArchiveSet, err := EnvArchiveSetGet(v, envName, schema.EnvStageSnap)
+	if err != nil {
+		return nil, fmt.Errorf("could not get archives to snapshot to before the restore. use --%s to restore without: %w", FLAG_NO_SAFETY, err)
+	}
+
+	// snap the endpoints as the services of the env, which the snap
+	// archives are for
+	env, err := EnvGet(v, envName)
+	if err != nil {
+		return nil, err
+	}
+	var serviceSet *schema.ServiceSet
+	if len(env.Services) > 0 {
+		if serviceSet, err = env.ServiceSetGet(""); err != nil {
+			return nil, err
+		}
+	}
+
+	return &schema.RestoreSafety{
+		SnapArchiveSet: snapArchiveSet,
+		Services:       serviceSet,
+		Src:            envName + ":" + schema.EnvStageSnap,
+		Timeout:        v.GetDuration(FLAG_SNAP_TIMEOUT),
+		PinFor:         v.GetDuration(FLAG_SAFETY_PIN),
+	}, nil
+}
+
+// JournalDirGet returns the dir of the restore journals
+func JournalDirGet(v *viper.Viper) string {
+	if dir := v.GetString(FLAG_JOURNAL_DIR); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".jerriedr/journal"
+	}
+	return filepath.Join(home, ".jerriedr", "journal")
+}
@@ -0,0 +1,478 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures the S3-compatible endpoint
+type Config struct {
+	Endpoint  string // eg. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// PathStyle addresses buckets as <endpoint>/<bucket>/<key> rather
+	// than <bucket>.<endpoint>/<key>. MinIO and most stand-ins need it.
+	PathStyle bool
+
+	// PartSize is the size of each part of a multipart upload
+	PartSize int64
+}
+
+// ConfigDefault returns a Config from the usual AWS environment variables
+func ConfigDefault() *Config {
+	config := &Config{
+		Endpoint:  os.Getenv("AWS_ENDPOINT_URL"),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		PathStyle: true,
+		PartSize:  16 << 20,
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	return config
+}
+
+// the smallest part S3 accepts for all but the last part of an upload
+const partSizeMin = 5 << 20
+
+// DefaultConfig is used by ClientGet to make the shared Client
+var DefaultConfig = ConfigDefault()
+
+var defaultClient *Client
+var defaultClientMutex sync.Mutex
+
+// ClientGet returns the shared Client, making it from DefaultConfig
+// on first use
+func ClientGet() (*Client, error) {
+	defaultClientMutex.Lock()
+	defer defaultClientMutex.Unlock()
+	if defaultClient == nil {
+		client, err := NewClient(DefaultConfig)
+		if err != nil {
+			return nil, err
+		}
+		defaultClient = client
+	}
+	return defaultClient, nil
+}
+
+// Client is a minimal client for S3-compatible object storage that
+// signs requests with AWS signature v4
+type Client struct {
+	Config     *Config
+	Endpoint   *url.URL
+	HTTPClient *http.Client
+}
+
+// NewClient returns a new, init'd s3 client
+func NewClient(config *Config) (*Client, error) {
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("s3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if config.PartSize < partSizeMin {
+		return nil, fmt.Errorf("s3 part size must be at least %d bytes", partSizeMin)
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse s3 endpoint %s: %v", config.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %s must be <scheme>://<host>", config.Endpoint)
+	}
+
+	return &Client{
+		Config:     config,
+		Endpoint:   endpoint,
+		HTTPClient: http.DefaultClient,
+	}, nil
+}
+
+// Object describes an object in a bucket
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// ErrNotFound is returned when the object or bucket does not exist
+var ErrNotFound = errors.New("not found")
+
+// List returns all objects directly under the prefix.
+// prefix should end with "/" to list a "directory".
+func (c *Client) List(bucket, prefix string) ([]*Object, error) {
+	objects := make([]*Object, 0)
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		res, err := c.do(http.MethodGet, bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not list s3://%s/%s: %w", bucket, prefix, err)
+		}
+
+		result := struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				ETag         string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse list of s3://%s/%s: %v", bucket, prefix, err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, &Object{
+				Key:          content.Key,
+				Size:         content.Size,
+				ETag:         strings.Trim(content.ETag, `"`),
+				LastModified: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Head returns the size and etag of an object
+func (c *Client) Head(bucket, key string) (*Object, error) {
+	res, err := c.do(http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not head s3://%s/%s: %w", bucket, key, err)
+	}
+	res.Body.Close()
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &Object{
+		Key:          key,
+		Size:         res.ContentLength,
+		ETag:         strings.Trim(res.Header.Get("ETag"), `"`),
+		LastModified: lastModified,
+	}, nil
+}
+
+// Get returns a reader for an object starting at offset
+func (c *Client) Get(bucket, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := c.do(http.MethodGet, bucket, key, nil, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get s3://%s/%s: %w", bucket, key, err)
+	}
+	return res.Body, nil
+}
+
+// Delete removes an object
+func (c *Client) Delete(bucket, key string) error {
+	res, err := c.do(http.MethodDelete, bucket, key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not delete s3://%s/%s: %w", bucket, key, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Put streams src to an object. Anything larger than one part goes up
+// as a multipart upload so we never hold more than a part in memory.
+func (c *Client) Put(bucket, key string, src io.Reader) error {
+	part := make([]byte, c.Config.PartSize)
+	n, err := io.ReadFull(src, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// it all fits in one part
+		res, err := c.do(http.MethodPut, bucket, key, nil, contentMD5Header(part[:n]), part[:n])
+		if err != nil {
+			return fmt.Errorf("could not put s3://%s/%s: %w", bucket, key, err)
+		}
+		res.Body.Close()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read part 1 for s3://%s/%s: %v", bucket, key, err)
+	}
+
+	uploadID, err := c.multipartCreate(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	etags := make([]string, 0)
+	for partNumber := 1; ; partNumber++ {
+		etag, err := c.multipartPut(bucket, key, uploadID, partNumber, part[:n])
+		if err != nil {
+			c.multipartAbort(bucket, key, uploadID)
+			return err
+		}
+		etags = append(etags, etag)
+
+		n, err = io.ReadFull(src, part)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			c.multipartAbort(bucket, key, uploadID)
+			return fmt.Errorf("could not read part %d for s3://%s/%s: %v", partNumber+1, bucket, key, err)
+		}
+	}
+
+	if err := c.multipartComplete(bucket, key, uploadID, etags); err != nil {
+		c.multipartAbort(bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) multipartCreate(bucket, key string) (uploadID string, err error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+	res, err := c.do(http.MethodPost, bucket, key, query, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not start upload to s3://%s/%s: %w", bucket, key, err)
+	}
+	defer res.Body.Close()
+
+	result := struct{ UploadId string }{}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not parse upload id for s3://%s/%s: %v", bucket, key, err)
+	}
+	return result.UploadId, nil
+}
+
+func (c *Client) multipartPut(bucket, key, uploadID string, partNumber int, part []byte) (etag string, err error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", uploadID)
+	res, err := c.do(http.MethodPut, bucket, key, query, contentMD5Header(part), part)
+	if err != nil {
+		return "", fmt.Errorf("could not upload part %d to s3://%s/%s: %w", partNumber, bucket, key, err)
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+func (c *Client) multipartComplete(bucket, key, uploadID string, etags []string) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	completion := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		completion.Parts = append(completion.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(completion)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	res, err := c.do(http.MethodPost, bucket, key, query, nil, body)
+	if err != nil {
+		return fmt.Errorf("could not complete upload to s3://%s/%s: %w", bucket, key, err)
+	}
+	defer res.Body.Close()
+
+	// S3 can report a failed completion with a 200 and an Error body
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("could not read completion of s3://%s/%s: %v", bucket, key, err)
+	}
+	if bytes.Contains(resBody, []byte("<Error>")) {
+		return fmt.Errorf("could not complete upload to s3://%s/%s: %s", bucket, key, resBody)
+	}
+	return nil
+}
+
+func (c *Client) multipartAbort(bucket, key, uploadID string) {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	if res, err := c.do(http.MethodDelete, bucket, key, query, nil, nil); err == nil {
+		res.Body.Close()
+	}
+}
+
+// do signs and sends a request. non-2xx responses become errors.
+func (c *Client) do(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	reqURL := *c.Endpoint
+	if c.Config.PathStyle {
+		reqURL.Path = "/" + bucket + "/" + key
+	} else {
+		reqURL.Host = bucket + "." + reqURL.Host
+		reqURL.Path = "/" + key
+	}
+	reqURL.RawPath = uriEncode(reqURL.Path, false)
+	reqURL.RawQuery = queryEncode(query)
+
+	req, err := http.NewRequestWithContext(context.Background(), method, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req.ContentLength = int64(len(body))
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	c.sign(req, reqURL.Path, body, time.Now().UTC())
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %d [%s]: %s", method, reqURL.String(), res.StatusCode, res.Status, resBody)
+	}
+	return res, nil
+}
+
+// sign adds AWS signature v4 headers to the request
+func (c *Client) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// canonical headers are the lowercased, sorted headers we sign
+	signedHeaderNames := make([]string, 0)
+	for name := range req.Header {
+		lowerName := strings.ToLower(name)
+		if lowerName == "host" || lowerName == "range" || strings.HasPrefix(lowerName, "x-amz-") {
+			signedHeaderNames = append(signedHeaderNames, lowerName)
+		}
+	}
+	sort.Strings(signedHeaderNames)
+	canonicalHeaders := ""
+	for _, name := range signedHeaderNames {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.Config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, c.Config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.Config.AccessKey, scope, signedHeaders, signature))
+}
+
+// contentMD5Header makes S3 reject the body if it arrives corrupted
+func contentMD5Header(body []byte) http.Header {
+	sum := md5.Sum(body)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	return header
+}
+
+// queryEncode encodes the query sorted by key as signature v4 requires
+func queryEncode(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but unreserved characters.
+// slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
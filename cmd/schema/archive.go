@@ -2,8 +2,6 @@ package schema
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -11,7 +9,6 @@ import (
 
 	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/kube"
-	"golang.org/x/sync/errgroup"
 )
 
 const FLAG_ARCHIVE = "archive"
@@ -24,6 +21,7 @@ func ArchiveNew() *Archive {
 }
 
 type Archive struct {
+	Bucket        string
 	Files         []*ArchiveFile
 	FilesFiltered []*ArchiveFile
 	Filters       []*TimeFilter
@@ -150,8 +148,33 @@ func (a *Archive) Parse(spec string) error {
 		if a.Path == "" {
 			return err
 		}
+	} else if a.Scheme == "s3" {
+		err := fmt.Errorf("%s must be s3|<bucket>/<prefix>|<service>", spec)
+
+		if len(parts) != 3 {
+			return err
+		}
+
+		{
+			bucketSpec := parts[1]
+			i := strings.Index(bucketSpec, "/")
+			if i == -1 {
+				a.Bucket = bucketSpec
+			} else {
+				a.Bucket = bucketSpec[:i]
+				a.Path = strings.Trim(bucketSpec[i+1:], "/")
+			}
+			if a.Bucket == "" {
+				return err
+			}
+		}
+
+		a.ServiceName = parts[2]
+		if a.ServiceName == "" {
+			return err
+		}
 	} else {
-		return fmt.Errorf("%s must be <scheme>|<schemeSpec> where <scheme> => statefulset | pod | host | local: %s", spec, a.Scheme)
+		return fmt.Errorf("%s must be <scheme>|<schemeSpec> where <scheme> => statefulset | pod | host | local | s3: %s", spec, a.Scheme)
 	}
 	a.Spec = spec
 	return nil
@@ -169,10 +192,39 @@ func (a *Archive) IsLocal() bool {
 	return a.Scheme == "local"
 }
 
+// IsColocated is true if the files of a and other are on the same pod,
+// the same host or both local, so one can link to the other
+func (a *Archive) IsColocated(other *Archive) bool {
+	if a.Scheme != other.Scheme {
+		return false
+	}
+	switch a.Scheme {
+	case "pod":
+		return a.KubeNamespace == other.KubeNamespace && a.KubeName == other.KubeName
+	case "host":
+		return a.Host == other.Host
+	case "local":
+		return true
+	}
+	return false
+}
+
 func (a *Archive) IsStatefulSet() bool {
 	return a.Scheme == "statefulset"
 }
 
+func (a *Archive) IsS3() bool {
+	return a.Scheme == "s3"
+}
+
+// S3Key returns the object key for a file in an s3 archive
+func (a *Archive) S3Key(fileName string) string {
+	if a.Path == "" {
+		return fileName
+	}
+	return a.Path + "/" + fileName
+}
+
 func (a *Archive) PodArchiveGet(replica int) (*Archive, error) {
 	if !a.IsStatefulSet() {
 		return nil, fmt.Errorf("%s is not a statefulset spec", a.Spec)
@@ -213,92 +265,104 @@ func (a *Archive) Replicas(kubeClient *kube.Client) (n int, err error) {
 	return int(*replicas), nil
 }
 
+// StoreGet returns the ArchiveStore for the scheme of the archive
+func (a *Archive) StoreGet(kubeClient *kube.Client) (ArchiveStore, error) {
+	return ArchiveStoreGet(a.Scheme, kubeClient)
+}
+
 func (a *Archive) FilesFetch(kubeClient *kube.Client) error {
-	files := make([]*ArchiveFile, 0)
+	store, err := a.StoreGet(kubeClient)
+	if err != nil {
+		return err
+	}
 
-	if a.IsStatefulSet() {
-		// for each replica...
-		eg := errgroup.Group{}
-		replicas, err := a.Replicas(kubeClient)
-		if err != nil {
-			return err
-		}
-		for i := 0; i < replicas; i++ {
-			i := i
-			eg.Go(func() error {
-				podArchive, err := a.PodArchiveGet(i)
-				if err != nil {
-					return fmt.Errorf("could not get podArchiveSpec from statefulSetArchiveSpec: %v", err)
-				}
-
-				err = podArchive.FilesFetch(kubeClient)
-				if err != nil {
-					return fmt.Errorf("could not get files for %s of %s: %v", podArchive.Spec, a.Spec, err)
-				}
-				files = append(files, podArchive.Files...)
-				return nil
-			})
-		}
-		if err = eg.Wait(); err != nil {
-			return err
+	storeFiles, err := store.List(a)
+	if err != nil {
+		return err
+	}
+
+	files := make([]*ArchiveFile, 0, len(storeFiles))
+	for _, file := range storeFiles {
+		if ArchiveFileIsSidecar(file.Name) {
+			continue
 		}
-	} else if a.IsPod() {
-		if kubeClient == nil {
-			return fmt.Errorf("must have kubeClient")
+		err := file.TimestampParseFromName()
+		if err == nil {
+			files = append(files, file)
+			core.Log.Debugf("found %s/%s", file.Archive.Spec, file.Name)
+		} else {
+			core.Log.Warnf("could not parse archiveFile timestamp from %s", file.Name)
 		}
+	}
 
-		// get the pod
-		pod, err := kubeClient.PodGetByName(a.KubeNamespace, a.KubeName)
-		if err != nil {
-			return fmt.Errorf("could not get pod: %v", err)
+	if err := a.metasFetch(kubeClient, storeFiles, files); err != nil {
+		return err
+	}
+
+	sort.Sort(ByMostRecent(files))
+	a.Files = files
+	a.Filter()
+	return nil
+}
+
+// metasFetch reads the meta sidecars listed in storeFiles into files. The
+// files of a statefulset archive sit in the archives of its pods, so the
+// sidecars are read per archive of the files.
+func (a *Archive) metasFetch(kubeClient *kube.Client, storeFiles, files []*ArchiveFile) error {
+	metaArchives := make([]*Archive, 0)
+	metaNames := make(map[*Archive][]string)
+	for _, file := range storeFiles {
+		if !strings.HasSuffix(file.Name, ArchiveFileMetaSuffix) {
+			continue
+		}
+		if _, ok := metaNames[file.Archive]; !ok {
+			metaArchives = append(metaArchives, file.Archive)
 		}
+		metaNames[file.Archive] = append(metaNames[file.Archive], strings.TrimSuffix(file.Name, ArchiveFileMetaSuffix))
+	}
 
-		core.Log.Warnf("fetching file list for pod archive %s", a.Spec)
-		podFileNames, err := kubeClient.Ls(a.Path, pod, a.KubeContainer)
+	metas := make(map[*Archive]map[string]*ArchiveFileMeta)
+	for _, metaArchive := range metaArchives {
+		store, err := metaArchive.StoreGet(kubeClient)
 		if err != nil {
-			return fmt.Errorf("could not list files for podSpec %s: %v", a.Spec, err)
+			return err
 		}
 
-		for _, podFileName := range podFileNames {
-			file := &ArchiveFile{
-				Archive: a,
-				Name:    podFileName,
+		if sidecarReader, ok := store.(ArchiveSidecarReader); ok {
+			content, err := sidecarReader.SidecarsRead(metaArchive, ArchiveFileMetaSuffix)
+			if err != nil {
+				return err
 			}
-			err := file.TimestampParseFromName()
-			if err == nil {
-				files = append(files, file)
-				core.Log.Debugf("found %s/%s", a.Spec, podFileName)
-			} else {
-				core.Log.Warnf("could not parse archiveFile timestamp from %s", podFileName)
+			if metas[metaArchive], err = archiveFileMetasParse(content); err != nil {
+				core.Log.Warnf("could not parse all metas in %s: %v", metaArchive.Spec, err)
 			}
-		}
-	} else if a.IsLocal() {
-		dirEntries, err := os.ReadDir(a.Path)
-		if err != nil {
-			log.Fatal(err)
+			continue
 		}
 
-		for _, file := range dirEntries {
-			if file.IsDir() {
+		metas[metaArchive] = make(map[string]*ArchiveFileMeta)
+		for _, name := range metaNames[metaArchive] {
+			meta, err := ArchiveFileMetaGet(store, &ArchiveFile{Archive: metaArchive, Name: name})
+			if err != nil {
+				core.Log.Warnf("%v", err)
 				continue
 			}
-			fileName := &ArchiveFile{
-				Archive: a,
-				Name:    file.Name(),
-			}
-			err := fileName.TimestampParseFromName()
-			if err == nil {
-				files = append(files, fileName)
-				core.Log.Debugf("found %s/%s", a.Spec, fileName)
-			} else {
-				core.Log.Warnf("could not parse archiveFile timestamp from %s", fileName)
-			}
+			metas[metaArchive][name] = meta
 		}
 	}
 
-	sort.Sort(ByMostRecent(files))
-	a.Files = files
-	a.FilesFiltered = files
+	for _, file := range files {
+		file.Meta = metas[file.Archive][file.Name]
+	}
+	return nil
+}
+
+// FileGetBySnapshotID returns a file of the snapshot, filtered or not
+func (a *Archive) FileGetBySnapshotID(snapshotID string) *ArchiveFile {
+	for _, file := range a.Files {
+		if file.SnapshotID() == snapshotID {
+			return file
+		}
+	}
 	return nil
 }
 
@@ -310,16 +374,22 @@ func (a *Archive) FiltersClear() {
 	a.Filters = make([]*TimeFilter, 0)
 }
 
+// Filter keeps the files that match any of the filters in FilesFiltered.
+// With no filters it keeps them all.
 func (a *Archive) Filter() {
-	filteredArchiveFiles := make([]*ArchiveFile, 0)
+	if len(a.Filters) == 0 {
+		a.FilesFiltered = a.Files
+		return
+	}
 
+	filteredArchiveFiles := make([]*ArchiveFile, 0)
 	for _, file := range a.Files {
 		for _, filter := range a.Filters {
-			if !file.FilterIsOK(filter) {
-				continue
+			if file.FilterIsOK(filter) {
+				filteredArchiveFiles = append(filteredArchiveFiles, file)
+				break
 			}
 		}
-		filteredArchiveFiles = append(filteredArchiveFiles, file)
 	}
 
 	a.FilesFiltered = filteredArchiveFiles
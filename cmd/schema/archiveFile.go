@@ -6,10 +6,90 @@ import (
 	"time"
 )
 
+// suffixes of the files we keep next to archive files
+const (
+	// ArchiveFileChecksumSuffix names the sidecar holding the md5 of a file
+	ArchiveFileChecksumSuffix = ".md5"
+
+	// ArchiveFileTempSuffix names a file while it is being written
+	ArchiveFileTempSuffix = ".tmp"
+)
+
+// ArchiveFileIsSidecar is true for names of files kept next to archive
+// files rather than archive files themselves
+func ArchiveFileIsSidecar(name string) bool {
+	return strings.HasSuffix(name, ArchiveFileChecksumSuffix) ||
+		strings.HasSuffix(name, ArchiveFileMetaSuffix) ||
+		strings.HasSuffix(name, ArchiveFileTempSuffix)
+}
+
+// archiveFileChecksumsParse parses sidecars in md5sum format into a map
+// of file name to md5
+func archiveFileChecksumsParse(content string) map[string]string {
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		checksums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return checksums
+}
+
 type ArchiveFile struct {
 	Archive *Archive
 	Name    string
 	Time    time.Time
+
+	// Size and Checksum are as listed by the store. Checksum is empty if
+	// the store does not know it without reading the file.
+	Size     int64
+	Checksum string
+
+	// Meta is read from the meta sidecar by Archive.FilesFetch. nil if
+	// there is none.
+	Meta *ArchiveFileMeta
+}
+
+// SnapshotID returns the id of the snapshot the file belongs to, or "" if
+// it has no meta
+func (af *ArchiveFile) SnapshotID() string {
+	if af.Meta == nil {
+		return ""
+	}
+	return af.Meta.SnapshotID
+}
+
+// IsCopyOf is true if af and other hold the same snapshot. They do if
+// they share a snapshot id, or a name if neither has an id.
+func (af *ArchiveFile) IsCopyOf(other *ArchiveFile) bool {
+	snapshotID := af.SnapshotID()
+	if snapshotID != "" {
+		return other.SnapshotID() == snapshotID
+	}
+	return other.SnapshotID() == "" && other.Name == af.Name
+}
+
+// CopiesGet returns the copies of af on every replica of its statefulset
+// archive, af included. Files of other archives, and files not fetched
+// into their statefulset archive, are their only copy.
+func (af *ArchiveFile) CopiesGet() []*ArchiveFile {
+	if af.Archive.Parent == nil {
+		return []*ArchiveFile{af}
+	}
+	copies := make([]*ArchiveFile, 0)
+	found := false
+	for _, file := range af.Archive.Parent.Files {
+		if file.IsCopyOf(af) {
+			copies = append(copies, file)
+			found = found || file == af
+		}
+	}
+	if !found {
+		copies = append(copies, af)
+	}
+	return copies
 }
 
 func (af *ArchiveFile) Parse(spec string) error {
@@ -22,6 +102,11 @@ func (af *ArchiveFile) Parse(spec string) error {
 	return af.Archive.Parse(spec[:i])
 }
 
+// Spec is the spec of the file as Parse reads it
+func (af *ArchiveFile) Spec() string {
+	return af.Archive.Spec + "/" + af.Name
+}
+
 func (af *ArchiveFile) Path() string {
 	return af.Archive.Path + "/" + af.Name
 }
@@ -1,11 +1,13 @@
 package schema
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
-	"path"
-	"strconv"
+	"strings"
 
 	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/kube"
@@ -13,179 +15,407 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func ArchiveFileCopy(kubeClient *kube.Client, srcArchiveFile, dstArchiveFile *ArchiveFile, progressWatcher *ui.ProgressWatcher) (err error) {
-	core.Log.Warnf("starting copy of '%s' to '%s'", srcArchiveFile.Archive.Spec+"/"+srcArchiveFile.Name, dstArchiveFile.Archive.Spec+"/"+dstArchiveFile.Name)
+// ArchiveFileCopyStats counts what copies did with their dsts. A copy to
+// a replicated archive counts each replica.
+type ArchiveFileCopyStats struct {
+	Copied  int
+	Resumed int
+	Skipped int
+}
 
-	// make an eg
-	eg := &errgroup.Group{}
+// Add adds the counts of other
+func (s *ArchiveFileCopyStats) Add(other *ArchiveFileCopyStats) {
+	s.Copied += other.Copied
+	s.Resumed += other.Resumed
+	s.Skipped += other.Skipped
+}
 
-	// make a splitter
-	progressPipeReader, progressPipeWriter := io.Pipe()
-	dstPipeReader, dstPipeWriter := io.Pipe()
-	splitWriter := io.MultiWriter(dstPipeWriter, progressPipeWriter)
+// archiveFileCopyDst is one destination of a copy. A copy to a replicated
+// archive has one per replica.
+type archiveFileCopyDst struct {
+	file            *ArchiveFile
+	store           ArchiveStore
+	writer          ArchiveFileWriter
+	progressUpdater func(progress int64)
+	offset          int64 // where a resumed write starts
+	skipped         bool  // already there and verified
+	err             error
+}
 
-	// read from the src to the splitter
-	var srcFileSize int64
-	if srcArchiveFile.Archive.IsStatefulSet() {
-		return fmt.Errorf("cannot copy from statefulset archiveFile")
-	} else if srcArchiveFile.Archive.IsPod() {
-		if kubeClient == nil {
-			return fmt.Errorf("kube client required")
-		}
+// ArchiveFileCopy copies a file between archives. The dst is written under
+// a temp name, checked against the md5 of the src and only then moved into
+// place with a sidecar recording the md5. Copies to a replicated archive
+// (eg. a statefulset) tee the src to every replica and verify each one.
+//
+// The bytes read from the src are checked against its md5. What landed
+// on a dst is checked by its store. ArchiveResumers take the md5 of the
+// temp file where it is. S3 checks each part it is sent.
+//
+// Copies are resumable. A dst that already has the file with the same size
+// and md5 is skipped, but gets the meta of the src if its own differs, eg.
+// after the src was labelled. A dst whose store is an ArchiveResumer picks
+// up an interrupted copy from where it stopped.
+func ArchiveFileCopy(kubeClient *kube.Client, srcArchiveFile, dstArchiveFile *ArchiveFile, progressWatcher *ui.ProgressWatcher) (stats *ArchiveFileCopyStats, err error) {
+	stats = &ArchiveFileCopyStats{}
+	if planned(PlanOpCopy, dstArchiveFile.Spec(), []string{srcArchiveFile.Spec()}, "", func() string {
+		return fmt.Sprintf("copy %s to %s with its sidecars, checking the md5. skipped if there already",
+			srcArchiveFile.Spec(), dstArchiveFile.Spec())
+	}) {
+		return stats, nil
+	}
+	core.Log.Warnf("starting copy of '%s' to '%s'", srcArchiveFile.Spec(), dstArchiveFile.Spec())
 
-		// get the pod
-		pod, err := kubeClient.PodGetByName(srcArchiveFile.Archive.KubeNamespace, srcArchiveFile.Archive.KubeName)
-		if err != nil {
-			return fmt.Errorf("could not get pod: %v", err)
+	srcStore, err := srcArchiveFile.Archive.StoreGet(kubeClient)
+	if err != nil {
+		return stats, err
+	}
+
+	// get the file size
+	srcFileStat, err := srcStore.Stat(srcArchiveFile.Archive, srcArchiveFile.Name)
+	if err != nil {
+		return stats, err
+	}
+
+	// get the checksum to verify against
+	srcChecksum, err := ArchiveFileChecksumGet(srcStore, srcArchiveFile)
+	if err != nil {
+		return stats, err
+	}
+
+	// the meta goes with the file
+	srcMeta := srcArchiveFile.Meta
+	if srcMeta == nil {
+		if srcMeta, err = ArchiveFileMetaGet(srcStore, srcArchiveFile); err != nil {
+			core.Log.Warnf("copying without meta: %v", err)
 		}
+	}
 
-		// get the file size
-		srcFileFullPath := srcArchiveFile.Archive.Path + "/" + srcArchiveFile.Name
-		fileStats, err := kubeClient.Stat(pod, srcArchiveFile.Archive.KubeContainer, srcFileFullPath)
-		if err != nil {
-			return fmt.Errorf("could not get stats for %s: %v", srcFileFullPath, err)
+	// setup the dsts
+	dsts, err := archiveFileCopyDstsGet(kubeClient, dstArchiveFile)
+	if err != nil {
+		return stats, err
+	}
+	srcOffset := srcFileStat.Size
+	for _, dst := range dsts {
+		dst.open(srcFileStat.Size, srcChecksum)
+		if dst.skipped {
+			core.Log.Warnf("skipping %s/%s. already there with md5 %s", dst.file.Archive.Spec, dst.file.Name, srcChecksum)
+			stats.Skipped++
+			dst.err = dst.metaSync(srcMeta)
+			continue
+		}
+		if dst.err != nil {
+			continue
+		}
+		if dst.offset > 0 {
+			core.Log.Warnf("resuming %s/%s at %d", dst.file.Archive.Spec, dst.file.Name, dst.offset)
+		}
+		if dst.offset < srcOffset {
+			srcOffset = dst.offset
 		}
-		srcFileSize = fileStats.Size
+		dst.progressUpdater = progressWatcher.AddWatch(
+			&ui.Watch{Item: dst.item(len(dsts) > 1),
+				Unit:  "bytes",
+				Total: srcFileStat.Size})
+		dst.progressUpdater(dst.offset)
+	}
+	if archiveFileCopyDstsLive(dsts) == 0 {
+		return stats, archiveFileCopyErrGet(dsts)
+	}
 
-		// read to the splitter
-		eg.Go(func() error {
-			err := kubeClient.FileRead(srcFileFullPath, splitWriter, pod,
-				srcArchiveFile.Archive.KubeContainer)
-			if err != nil {
-				return fmt.Errorf("trouble with file read while copying file from kube: %v", err)
-			}
-			if err := progressPipeWriter.Close(); err != nil {
-				return fmt.Errorf("could not close progressPipeWriter: %v", err)
-			}
-			if err := dstPipeWriter.Close(); err != nil {
-				return fmt.Errorf("could not close dstPipeWriter: %v", err)
+	// open the src at the first byte any dst needs. dsts with all of it
+	// only need their check.
+	var srcReader io.ReadCloser = io.NopCloser(strings.NewReader(""))
+	if srcOffset < srcFileStat.Size {
+		srcReader, err = srcStore.Open(srcArchiveFile.Archive, srcArchiveFile.Name, srcOffset)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not open %s/%s: %v", srcArchiveFile.Archive.Spec, srcArchiveFile.Name, err)
+		for _, dst := range dsts {
+			if dst.isLive() {
+				dst.writer.CloseWithError(err)
 			}
-			return nil
-		})
-	} else if srcArchiveFile.Archive.IsLocal() {
-		srcFileFullPath := srcArchiveFile.Archive.Path + "/" + srcArchiveFile.Name
-
-		// get the file size
-		fileInfo, err := os.Stat(srcFileFullPath)
-		if err != nil {
-			return fmt.Errorf("could not get stats for %s: %v", srcFileFullPath, err)
 		}
-		srcFileSize = fileInfo.Size()
+		return stats, err
+	}
+	defer srcReader.Close()
 
-		srcFile, err := os.Open(srcFileFullPath)
-		if err != nil {
-			return err
+	// copy to every dst that has not failed
+	srcHasher := md5.New()
+	buf := make([]byte, 1<<20)
+	position := srcOffset
+	for {
+		if archiveFileCopyDstsLive(dsts) == 0 {
+			return stats, archiveFileCopyErrGet(dsts)
 		}
 
-		eg.Go(func() (err error) {
-			_, err = io.Copy(splitWriter, srcFile)
-			if err != nil {
-				return fmt.Errorf("trouble reading local file: %v", err)
+		n, readErr := srcReader.Read(buf)
+		if n > 0 {
+			srcHasher.Write(buf[:n])
+			eg := errgroup.Group{}
+			for _, dst := range dsts {
+				dst := dst
+				if !dst.isLive() || dst.offset >= position+int64(n) {
+					continue
+				}
+
+				// resumed dsts may need only the tail of the buffer
+				chunk := buf[:n]
+				if dst.offset > position {
+					chunk = buf[dst.offset-position : n]
+				}
+				eg.Go(func() error {
+					if _, err := dst.writer.Write(chunk); err != nil {
+						dst.err = dst.writer.CloseWithError(fmt.Errorf("could not write %s/%s: %v", dst.file.Archive.Spec, dst.file.Name, err))
+						return nil
+					}
+					dst.progressUpdater(int64(len(chunk)))
+					return nil
+				})
 			}
-			if err := progressPipeWriter.Close(); err != nil {
-				return fmt.Errorf("could not close progressPipeWriter: %v", err)
+			eg.Wait()
+			position += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = fmt.Errorf("could not copy %s/%s: %v", srcArchiveFile.Archive.Spec, srcArchiveFile.Name, readErr)
+			for _, dst := range dsts {
+				if dst.isLive() {
+					dst.err = dst.writer.CloseWithError(err)
+				}
 			}
-			if err := dstPipeWriter.Close(); err != nil {
-				return fmt.Errorf("could not close dstPipeWriter: %v", err)
+			return stats, err
+		}
+	}
+
+	// verify the src read. we can only do that if we read all of it. what
+	// we wrote is bad, so the dsts cannot keep it for a resume.
+	if checksum := hex.EncodeToString(srcHasher.Sum(nil)); srcOffset == 0 && checksum != srcChecksum {
+		err = fmt.Errorf("checksum mismatch copying %s/%s: src has %s, read %s",
+			srcArchiveFile.Archive.Spec, srcArchiveFile.Name, srcChecksum, checksum)
+		for _, dst := range dsts {
+			if dst.isLive() {
+				dst.err = dst.writer.Abort(err)
 			}
+		}
+		return stats, err
+	}
+
+	// verify each dst before we let it into place
+	eg := errgroup.Group{}
+	for _, dst := range dsts {
+		dst := dst
+		if !dst.isLive() {
+			continue
+		}
+		eg.Go(func() error {
+			dst.err = dst.commit(srcChecksum, srcMeta)
 			return nil
 		})
 	}
+	eg.Wait()
 
-	// read the progress into a discard buffer
-	// TODO wish that one could read without coping bytes
-	var progressUpdater func(progress int64)
-	dstFileFullPath := dstArchiveFile.Archive.Path + "/" + srcArchiveFile.Name
-	progressUpdater = progressWatcher.AddWatch(
-		&ui.Watch{Item: dstFileFullPath,
-			Unit:  "bytes",
-			Total: srcFileSize})
-	eg.Go(func() error {
-		discardBuffer := make([]byte, 8192) // seems to be standard size for blackhole
-		for {
-			n, err := progressPipeReader.Read(discardBuffer)
-			progressUpdater(int64(n))
-			if err != nil {
-				if err == io.EOF {
-					return nil
-				}
-				return err
-			}
+	for _, dst := range dsts {
+		if !dst.isLive() {
+			continue
+		}
+		if dst.offset > 0 {
+			stats.Resumed++
+		} else {
+			stats.Copied++
 		}
-	})
+	}
+	return stats, archiveFileCopyErrGet(dsts)
+}
 
-	writeToPod := func(podName string) error {
-		if kubeClient == nil {
-			return fmt.Errorf("kube client required")
+// open decides whether the dst can be skipped or resumed and gets it a
+// writer if not skipped
+func (dst *archiveFileCopyDst) open(size int64, checksum string) {
+	// is it there already?
+	if fileStat, err := dst.store.Stat(dst.file.Archive, dst.file.Name); err == nil && fileStat.Size == size {
+		if dstChecksum, err := ArchiveFileChecksumGet(dst.store, dst.file); err == nil && dstChecksum == checksum {
+			dst.skipped = true
+			return
 		}
+	}
 
-		// get the pod
-		pod, err := kubeClient.PodGetByName(dstArchiveFile.Archive.KubeNamespace, dstArchiveFile.Archive.KubeName)
+	// can we pick up where an earlier copy stopped? a partial of the full
+	// size only needs its check and move. resumers write from 0 too, so
+	// they check what landed.
+	if resumer, ok := dst.store.(ArchiveResumer); ok {
+		offset, err := resumer.PartialSize(dst.file.Archive, dst.file.Name)
 		if err != nil {
-			return fmt.Errorf("could not get pod: %v", err)
+			dst.err = fmt.Errorf("could not check %s/%s for a partial copy: %v", dst.file.Archive.Spec, dst.file.Name, err)
+			return
+		}
+		if offset > size {
+			offset = 0
 		}
+		dst.writer, dst.err = resumer.Resume(dst.file.Archive, dst.file.Name, offset, checksum)
+		if dst.err != nil && offset > 0 {
+			core.Log.Warnf("could not resume %s/%s. starting over: %v", dst.file.Archive.Spec, dst.file.Name, dst.err)
+			offset = 0
+			dst.writer, dst.err = resumer.Resume(dst.file.Archive, dst.file.Name, offset, checksum)
+		}
+		if dst.err != nil {
+			dst.err = fmt.Errorf("could not create %s/%s: %v", dst.file.Archive.Spec, dst.file.Name, dst.err)
+			return
+		}
+		dst.offset = offset
+		return
+	}
 
-		// read into the kube file writer
-		eg.Go(func() error {
-			return kubeClient.FileWrite(
-				dstPipeReader,
-				dstArchiveFile.Archive.Path+"/"+dstArchiveFile.Name,
-				pod,
-				srcArchiveFile.Archive.KubeContainer,
-			)
-		})
-		return nil
+	dst.writer, dst.err = dst.store.Create(dst.file.Archive, dst.file.Name)
+	if dst.err != nil {
+		dst.err = fmt.Errorf("could not create %s/%s: %v", dst.file.Archive.Spec, dst.file.Name, dst.err)
+	}
+}
+
+// isLive is true for dsts we are still writing
+func (dst *archiveFileCopyDst) isLive() bool {
+	return dst.err == nil && !dst.skipped
+}
+
+// archiveFileCopyDstsGet returns the dsts for dstArchiveFile, one for each
+// replica if its store is an ArchiveReplicator
+func archiveFileCopyDstsGet(kubeClient *kube.Client, dstArchiveFile *ArchiveFile) ([]*archiveFileCopyDst, error) {
+	dstStore, err := dstArchiveFile.Archive.StoreGet(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	replicator, ok := dstStore.(ArchiveReplicator)
+	if !ok {
+		return []*archiveFileCopyDst{{file: dstArchiveFile, store: dstStore}}, nil
 	}
 
-	// setup the dstArchive first
-	if dstArchiveFile.Archive.IsStatefulSet() {
-		n, err := dstArchiveFile.Archive.Replicas(kubeClient)
+	replicaArchives, err := replicator.ReplicaArchivesGet(dstArchiveFile.Archive)
+	if err != nil {
+		return nil, err
+	}
+	if len(replicaArchives) == 0 {
+		return nil, fmt.Errorf("%s has no replicas", dstArchiveFile.Archive.Spec)
+	}
+
+	dsts := make([]*archiveFileCopyDst, 0, len(replicaArchives))
+	for _, replicaArchive := range replicaArchives {
+		replicaStore, err := replicaArchive.StoreGet(kubeClient)
 		if err != nil {
-			return err
-		}
-		for i := 0; i < n; i++ {
-			if err = writeToPod(dstArchiveFile.Archive.KubeName +
-				"-" +
-				strconv.Itoa(i)); err != nil {
-				return err
-			}
+			return nil, err
 		}
-	} else if dstArchiveFile.Archive.IsPod() {
-		if err = writeToPod(dstArchiveFile.Archive.KubeName); err != nil {
-			return err
+		dsts = append(dsts, &archiveFileCopyDst{
+			file:  &ArchiveFile{Archive: replicaArchive, Name: dstArchiveFile.Name},
+			store: replicaStore,
+		})
+	}
+	return dsts, nil
+}
+
+// archiveFileCopyDstsLive counts the dsts we are still writing
+func archiveFileCopyDstsLive(dsts []*archiveFileCopyDst) (n int) {
+	for _, dst := range dsts {
+		if dst.isLive() {
+			n++
 		}
-	} else if dstArchiveFile.Archive.IsLocal() {
-		dstFilePath := dstArchiveFile.Archive.Path + "/" + dstArchiveFile.Name
-		dstDir := path.Dir(dstFilePath)
-		err := os.MkdirAll(dstDir, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("could not make directory '%s': %v", dstDir, err)
+	}
+	return n
+}
+
+// item names the dst in the progress watcher
+func (dst *archiveFileCopyDst) item(isReplica bool) string {
+	if isReplica {
+		return dst.file.Archive.KubeName + ":" + dst.file.Path()
+	}
+	return dst.file.Path()
+}
+
+// commit moves the file into place and writes its sidecars. the writer
+// checks what landed on Close.
+func (dst *archiveFileCopyDst) commit(srcChecksum string, srcMeta *ArchiveFileMeta) error {
+	if err := dst.writer.Close(); err != nil {
+		return fmt.Errorf("could not write %s/%s: %v", dst.file.Archive.Spec, dst.file.Name, err)
+	}
+	if err := ArchiveFileChecksumPut(dst.store, dst.file, srcChecksum); err != nil {
+		return err
+	}
+	if srcMeta == nil {
+		return nil
+	}
+	return ArchiveFileMetaPut(dst.store, dst.file, dst.metaMake(srcMeta))
+}
+
+// metaMake returns srcMeta named for the dst
+func (dst *archiveFileCopyDst) metaMake(srcMeta *ArchiveFileMeta) *ArchiveFileMeta {
+	dstMeta := *srcMeta
+	dstMeta.Name = dst.file.Name
+	return &dstMeta
+}
+
+// metaSync writes srcMeta to a skipped dst if the meta it has differs
+func (dst *archiveFileCopyDst) metaSync(srcMeta *ArchiveFileMeta) error {
+	if srcMeta == nil {
+		return nil
+	}
+	dstMeta := dst.metaMake(srcMeta)
+	if meta, err := ArchiveFileMetaGet(dst.store, dst.file); err == nil && meta != nil {
+		have, haveErr := json.Marshal(meta)
+		want, wantErr := json.Marshal(dstMeta)
+		if haveErr == nil && wantErr == nil && bytes.Equal(have, want) {
+			return nil
 		}
+	}
+	core.Log.Warnf("updating the meta of %s/%s", dst.file.Archive.Spec, dst.file.Name)
+	return ArchiveFileMetaPut(dst.store, dst.file, dstMeta)
+}
 
-		// open the dstFile
-		dstFile, err := os.OpenFile(dstFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return fmt.Errorf("could not open file  '%s': %v", dstFilePath, err)
+// archiveFileCopyErrGet reports every dst that failed
+func archiveFileCopyErrGet(dsts []*archiveFileCopyDst) error {
+	messages := make([]string, 0)
+	for _, dst := range dsts {
+		if dst.err != nil {
+			messages = append(messages, dst.err.Error())
 		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	if len(dsts) == 1 {
+		return dsts[0].err
+	}
+	return fmt.Errorf("%d of %d replicas failed:\n  %s", len(messages), len(dsts), strings.Join(messages, "\n  "))
+}
 
-		// read into the local file
-		eg.Go(func() error {
-			_, err := io.Copy(dstFile, dstPipeReader)
-			if err != nil {
-				return fmt.Errorf("copy error from dstPipeReader to dstFile: %v", err)
-			}
+// ArchiveFileChecksumGet returns the md5 of the file from its sidecar or
+// from the store if it has none
+func ArchiveFileChecksumGet(store ArchiveStore, file *ArchiveFile) (string, error) {
+	if sidecar, err := store.Open(file.Archive, file.Name+ArchiveFileChecksumSuffix, 0); err == nil {
+		content, err := io.ReadAll(sidecar)
+		sidecar.Close()
+		if fields := strings.Fields(string(content)); err == nil && len(fields) > 0 {
+			return fields[0], nil
+		}
+	}
 
-			err = dstFile.Sync()
-			if err != nil {
-				return fmt.Errorf("sync error for dstFile: %v", err)
-			}
-			err = dstFile.Close()
-			if err != nil {
-				return fmt.Errorf("close error for dstFile: %v", err)
-			}
-			return err
-		})
+	checksum, err := store.Checksum(file.Archive, file.Name)
+	if err != nil {
+		return "", fmt.Errorf("could not get checksum for %s/%s: %v", file.Archive.Spec, file.Name, err)
 	}
+	return checksum, nil
+}
 
-	return eg.Wait()
+// ArchiveFileChecksumPut writes the sidecar for the file in md5sum format
+func ArchiveFileChecksumPut(store ArchiveStore, file *ArchiveFile, checksum string) error {
+	sidecar, err := store.Create(file.Archive, file.Name+ArchiveFileChecksumSuffix)
+	if err != nil {
+		return fmt.Errorf("could not create checksum for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	if _, err := fmt.Fprintf(sidecar, "%s  %s\n", checksum, file.Name); err != nil {
+		return sidecar.Abort(fmt.Errorf("could not write checksum for %s/%s: %v", file.Archive.Spec, file.Name, err))
+	}
+	if err := sidecar.Close(); err != nil {
+		return fmt.Errorf("could not write checksum for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	return nil
 }
@@ -0,0 +1,103 @@
+package schema
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jkassis/jerriedr/cmd/ui"
+)
+
+// copyTestArchiveMake makes a local archive in a temp dir
+func copyTestArchiveMake(t *testing.T) *Archive {
+	archive := ArchiveNew()
+	if err := archive.Parse("local|svc-a|" + t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestArchiveFileCopy(t *testing.T) {
+	store := &LocalArchiveStore{}
+	content := make([]byte, 3<<20+17)
+	rand.Read(content)
+	sum := md5.Sum(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	src := &ArchiveFile{Archive: copyTestArchiveMake(t), Name: "2026-01-10T12:00:00Z.bak"}
+	if err := os.WriteFile(src.Path(), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcMeta := &ArchiveFileMeta{Name: src.Name, SnapshotID: "s0", Size: int64(len(content)), Checksum: checksum}
+	if err := ArchiveFileMetaPut(store, src, srcMeta); err != nil {
+		t.Fatal(err)
+	}
+	dst := &ArchiveFile{Archive: copyTestArchiveMake(t), Name: src.Name}
+
+	copyCheck := func(want ArchiveFileCopyStats) {
+		t.Helper()
+		stats, err := ArchiveFileCopy(nil, src, dst, ui.ProgressWatcherNew())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *stats != want {
+			t.Errorf("stats are %+v, want %+v", *stats, want)
+		}
+		copied, err := os.ReadFile(dst.Path())
+		if err != nil || !bytes.Equal(copied, content) {
+			t.Fatalf("copied the wrong bytes: %v", err)
+		}
+		if dstChecksum, err := ArchiveFileChecksumGet(store, dst); err != nil || dstChecksum != checksum {
+			t.Errorf("dst md5 is %s, want %s: %v", dstChecksum, checksum, err)
+		}
+	}
+	metaCheck := func(want *ArchiveFileMeta) {
+		t.Helper()
+		meta, err := ArchiveFileMetaGet(store, dst)
+		if err != nil || meta == nil {
+			t.Fatalf("dst has no meta: %v", err)
+		}
+		if meta.SnapshotID != want.SnapshotID || meta.Pinned != want.Pinned || len(meta.Labels) != len(want.Labels) {
+			t.Errorf("dst meta is %s, want %s", meta, want)
+		}
+	}
+
+	copyCheck(ArchiveFileCopyStats{Copied: 1})
+	metaCheck(srcMeta)
+
+	// the same meta is not written again
+	old := time.Now().Add(-time.Hour)
+	metaPath := dst.Path() + ArchiveFileMetaSuffix
+	if err := os.Chtimes(metaPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	copyCheck(ArchiveFileCopyStats{Skipped: 1})
+	if fileStat, err := os.Stat(metaPath); err != nil || !fileStat.ModTime().Equal(old) {
+		t.Errorf("rewrote the meta of a skipped dst that had it: %v", err)
+	}
+
+	// a skipped dst gets the meta of the src when it differs
+	srcMeta.Labels = []string{"pre-migration"}
+	srcMeta.Pinned = true
+	if err := ArchiveFileMetaPut(store, src, srcMeta); err != nil {
+		t.Fatal(err)
+	}
+	copyCheck(ArchiveFileCopyStats{Skipped: 1})
+	metaCheck(srcMeta)
+
+	// an interrupted copy resumes from its partial
+	if err := os.Remove(dst.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst.Path()+ArchiveFileTempSuffix, content[:1<<20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	copyCheck(ArchiveFileCopyStats{Resumed: 1})
+	if _, err := os.Stat(dst.Path() + ArchiveFileTempSuffix); !os.IsNotExist(err) {
+		t.Errorf("left the partial behind: %v", err)
+	}
+}
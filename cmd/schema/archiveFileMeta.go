@@ -0,0 +1,343 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerrie/core/kittie"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"golang.org/x/sync/errgroup"
+)
+
+// Version is the version of jerriedr recorded in metas
+var Version = "dev"
+
+// ArchiveFileMetaSuffix names the sidecar holding the ArchiveFileMeta of a file
+const ArchiveFileMetaSuffix = ".meta.json"
+
+// ArchiveFileMeta is kept next to an archive file in a <file>.meta.json
+// sidecar. SnapshotID is the UUID of the backup request that made the
+// file. EnvSnap sends the same one to every service, so it names the
+// snapshot the file belongs to. The metas of the files of a snapshot are
+// its manifest. There is no manifest file for the whole set: the files of
+// a snapshot sit in the archives of their services, so each carries its
+// part and no copy or prune can leave it out of step. snapshot ls -o json
+// shows them together.
+type ArchiveFileMeta struct {
+	Name        string `json:"name" yaml:"name"`
+	SnapshotID  string `json:"snapshotID" yaml:"snapshotID"`
+	ServiceSpec string `json:"serviceSpec,omitempty" yaml:"serviceSpec,omitempty"`
+	Pod         string `json:"pod,omitempty" yaml:"pod,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty" yaml:"imageDigest,omitempty"`
+	RaftIndex   uint64 `json:"raftIndex,omitempty" yaml:"raftIndex,omitempty"`
+	Size        int64  `json:"size" yaml:"size"`
+	Checksum    string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	Version     string `json:"version,omitempty" yaml:"version,omitempty"`
+
+	// Labels and Pinned are set on every file of a snapshot by the
+	// snapshot label and pin commands. Pinned snapshots are never pruned.
+	// PinnedUntil pins a snapshot until then, like restore does for the
+	// snapshot it takes first.
+	Labels      []string   `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Pinned      bool       `json:"pinned,omitempty" yaml:"pinned,omitempty"`
+	PinnedUntil *time.Time `json:"pinnedUntil,omitempty" yaml:"pinnedUntil,omitempty"`
+}
+
+// IsPinned is true if the file is pinned at now
+func (m *ArchiveFileMeta) IsPinned(now time.Time) bool {
+	return m.Pinned || (m.PinnedUntil != nil && now.Before(*m.PinnedUntil))
+}
+
+func (m *ArchiveFileMeta) String() string {
+	parts := []string{m.Name, "snapshot " + m.SnapshotID}
+	if m.ServiceSpec != "" {
+		parts = append(parts, "service "+m.ServiceSpec)
+	}
+	if m.Pod != "" {
+		parts = append(parts, "pod "+m.Pod)
+	}
+	if m.ImageDigest != "" {
+		parts = append(parts, "image "+m.ImageDigest)
+	}
+	if m.RaftIndex != 0 {
+		parts = append(parts, fmt.Sprintf("raft index %d", m.RaftIndex))
+	}
+	parts = append(parts, fmt.Sprintf("%d bytes", m.Size))
+	if m.Checksum != "" {
+		parts = append(parts, "md5 "+m.Checksum)
+	}
+	if m.Version != "" {
+		parts = append(parts, "jerriedr "+m.Version)
+	}
+	if len(m.Labels) > 0 {
+		parts = append(parts, "labels "+strings.Join(m.Labels, " "))
+	}
+	if m.Pinned {
+		parts = append(parts, "pinned")
+	} else if m.PinnedUntil != nil {
+		parts = append(parts, "pinned until "+m.PinnedUntil.Format(time.RFC3339))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ArchiveFileMetaMake gathers the meta of a new file of a snapshot of
+// service. The raft index is read from the file, so only a backup that is
+// done has one.
+func ArchiveFileMetaMake(kubeClient *kube.Client, store ArchiveStore, file *ArchiveFile, snapshotID string, service *Service) (*ArchiveFileMeta, error) {
+	meta := &ArchiveFileMeta{
+		Name:       file.Name,
+		SnapshotID: snapshotID,
+		Size:       file.Size,
+		Version:    Version,
+	}
+
+	// the image that made the file
+	var err error
+	if service != nil {
+		meta.ServiceSpec = service.Spec
+	}
+	if file.Archive.IsPod() {
+		meta.Pod = file.Archive.KubeName
+		containerName := file.Archive.KubeContainer
+		if service != nil && service.KubeContainer != "" {
+			containerName = service.KubeContainer
+		}
+		meta.ImageDigest, err = podImageDigestGet(kubeClient, file.Archive.KubeNamespace, file.Archive.KubeName, containerName)
+	} else if service != nil {
+		meta.ImageDigest, err = service.ImageDigestGet(kubeClient)
+	}
+	if err != nil {
+		core.Log.Warnf("could not get image digest for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+
+	if meta.RaftIndex, meta.Checksum, err = archiveFileScan(store, file); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// archiveFileScan reads the raft index and md5 of file in one pass. The
+// md5 is of the bytes read, so the rest of the file is read after the
+// raft index is found, unless the store listed the md5 already.
+func archiveFileScan(store ArchiveStore, file *ArchiveFile) (raftIndex uint64, checksum string, err error) {
+	reader, err := store.Open(file.Archive, file.Name, 0)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not open %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	defer reader.Close()
+
+	hasher := md5.New()
+	tee := io.TeeReader(reader, hasher)
+	if raftIndex, err = archiveFileRaftIndexRead(tee); err != nil {
+		core.Log.Warnf("could not get raft index for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	if file.Checksum != "" {
+		return raftIndex, file.Checksum, nil
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return 0, "", fmt.Errorf("could not get checksum for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	return raftIndex, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ArchiveFileTag writes the checksum and meta sidecars of a new file of
+// snapshot snapshotID of service
+func ArchiveFileTag(kubeClient *kube.Client, file *ArchiveFile, snapshotID string, service *Service) error {
+	store, err := file.Archive.StoreGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	meta, err := ArchiveFileMetaMake(kubeClient, store, file, snapshotID, service)
+	if err != nil {
+		return err
+	}
+	if err := ArchiveFileChecksumPut(store, file, meta.Checksum); err != nil {
+		return err
+	}
+	if err := ArchiveFileMetaPut(store, file, meta); err != nil {
+		return err
+	}
+	file.Meta = meta
+	file.Checksum = meta.Checksum
+	core.Log.Warnf("tagged %s/%s with snapshot %s", file.Archive.Spec, file.Name, snapshotID)
+	return nil
+}
+
+// ArchiveFileMetaUpdate applies update to the metas of the copies of every
+// file of sss and writes them back. Files without a meta get one without
+// a snapshot id, so they stay grouped by time.
+func ArchiveFileMetaUpdate(kubeClient *kube.Client, sss *ArchiveFileSet, update func(meta *ArchiveFileMeta)) error {
+	errGroup := errgroup.Group{}
+	for _, archiveFile := range sss.ArchiveFiles {
+		for _, file := range archiveFile.CopiesGet() {
+			file := file
+			errGroup.Go(func() error {
+				store, err := file.Archive.StoreGet(kubeClient)
+				if err != nil {
+					return err
+				}
+
+				meta := &ArchiveFileMeta{
+					Name:     file.Name,
+					Size:     file.Size,
+					Checksum: file.Checksum,
+					Version:  Version,
+				}
+				if file.Meta != nil {
+					metaCopy := *file.Meta
+					metaCopy.Labels = append([]string(nil), file.Meta.Labels...)
+					meta = &metaCopy
+				}
+				update(meta)
+
+				if err := ArchiveFileMetaPut(store, file, meta); err != nil {
+					return err
+				}
+				file.Meta = meta
+				return nil
+			})
+		}
+	}
+	return errGroup.Wait()
+}
+
+// HasLabel is true if the meta has label
+func (m *ArchiveFileMeta) HasLabel(label string) bool {
+	for _, l := range m.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelAdd adds label to the meta if it does not have it
+func (m *ArchiveFileMeta) LabelAdd(label string) {
+	if !m.HasLabel(label) {
+		m.Labels = append(m.Labels, label)
+	}
+}
+
+// LabelRemove removes label from the meta
+func (m *ArchiveFileMeta) LabelRemove(label string) {
+	labels := make([]string, 0, len(m.Labels))
+	for _, l := range m.Labels {
+		if l != label {
+			labels = append(labels, l)
+		}
+	}
+	m.Labels = labels
+}
+
+// ArchiveFileMetaGet reads the sidecar of the file. It returns nil if
+// there is none.
+func ArchiveFileMetaGet(store ArchiveStore, file *ArchiveFile) (*ArchiveFileMeta, error) {
+	if _, err := store.Stat(file.Archive, file.Name+ArchiveFileMetaSuffix); err != nil {
+		return nil, nil
+	}
+
+	sidecar, err := store.Open(file.Archive, file.Name+ArchiveFileMetaSuffix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open meta for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	defer sidecar.Close()
+
+	meta := &ArchiveFileMeta{}
+	if err := json.NewDecoder(sidecar).Decode(meta); err != nil {
+		return nil, fmt.Errorf("could not parse meta for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	return meta, nil
+}
+
+// ArchiveFileMetaPut writes the sidecar for the file
+func ArchiveFileMetaPut(store ArchiveStore, file *ArchiveFile, meta *ArchiveFileMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if planned(PlanOpMeta, file.Spec(), nil, string(content), func() string {
+		return fmt.Sprintf("write %s%s: %s", file.Path(), ArchiveFileMetaSuffix, meta)
+	}) {
+		return nil
+	}
+
+	sidecar, err := store.Create(file.Archive, file.Name+ArchiveFileMetaSuffix)
+	if err != nil {
+		return fmt.Errorf("could not create meta for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	if _, err := sidecar.Write(append(content, '\n')); err != nil {
+		return sidecar.Abort(fmt.Errorf("could not write meta for %s/%s: %v", file.Archive.Spec, file.Name, err))
+	}
+	if err := sidecar.Close(); err != nil {
+		return fmt.Errorf("could not write meta for %s/%s: %v", file.Archive.Spec, file.Name, err)
+	}
+	return nil
+}
+
+// archiveFileMetasParse decodes sidecars read one after another into a
+// map of file name to meta
+func archiveFileMetasParse(content []byte) (map[string]*ArchiveFileMeta, error) {
+	metas := make(map[string]*ArchiveFileMeta)
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for {
+		meta := &ArchiveFileMeta{}
+		if err := decoder.Decode(meta); err == io.EOF {
+			return metas, nil
+		} else if err != nil {
+			return metas, err
+		}
+		metas[meta.Name] = meta
+	}
+}
+
+// archiveFileRaftIndexRead scans a badger backup for the index of the last
+// raft proposal in it. A backup is a run of KVLists, each prefixed by its
+// size.
+func archiveFileRaftIndexRead(r io.Reader) (uint64, error) {
+	key, err := kittie.DBRaftProposalIDXK.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReaderSize(r, 16<<10)
+	buf := make([]byte, 1<<10)
+	for {
+		var size uint64
+		if err := binary.Read(br, binary.LittleEndian, &size); err == io.EOF {
+			return 0, fmt.Errorf("found no %s in backup", kittie.DBRaftProposalIDXK.Key)
+		} else if err != nil {
+			return 0, err
+		}
+
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		if _, err := io.ReadFull(br, buf[:size]); err != nil {
+			return 0, err
+		}
+
+		list := &pb.KVList{}
+		if err := list.Unmarshal(buf[:size]); err != nil {
+			return 0, fmt.Errorf("could not parse backup: %v", err)
+		}
+		for _, kv := range list.Kv {
+			if bytes.Equal(kv.Key, key) {
+				v := &core.DBInt64V{}
+				if err := v.UnmarshalBinary(kv.Value); err != nil {
+					return 0, fmt.Errorf("could not parse %s: %v", kittie.DBRaftProposalIDXK.Key, err)
+				}
+				return v.Value, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerrie/core/kittie"
+)
+
+// backupTestMake writes a badger backup of lists of filler KVs with the
+// raft index in list at, or in none if at is -1
+func backupTestMake(t *testing.T, lists int, at int, raftIndex uint64) []byte {
+	raftKey, err := kittie.DBRaftProposalIDXK.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raftValue, err := (&core.DBInt64V{Value: raftIndex}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := bytes.NewBuffer(nil)
+	for i := 0; i < lists; i++ {
+		list := &pb.KVList{}
+		for j := 0; j < 100; j++ {
+			list.Kv = append(list.Kv, &pb.KV{Key: []byte{byte(i), byte(j)}, Value: bytes.Repeat([]byte{byte(j)}, 200)})
+		}
+		if i == at {
+			list.Kv = append(list.Kv, &pb.KV{Key: raftKey, Value: raftValue})
+		}
+		content, err := list.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.Write(backup, binary.LittleEndian, uint64(len(content)))
+		backup.Write(content)
+	}
+	return backup.Bytes()
+}
+
+func TestArchiveFileScan(t *testing.T) {
+	tests := []struct {
+		name      string
+		at        int
+		checksum  string // listed by the store
+		raftIndex uint64
+	}{
+		{name: "raft index early", at: 1, raftIndex: 42},
+		{name: "raft index last", at: 49, raftIndex: 43},
+		{name: "no raft index", at: -1},
+		{name: "listed checksum", at: 1, checksum: "listed", raftIndex: 44},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := backupTestMake(t, 50, test.at, test.raftIndex)
+			archive := ArchiveNew()
+			if err := archive.Parse("local|svc-a|" + t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			file := &ArchiveFile{Archive: archive, Name: "2026-01-10T12:00:00Z.bak", Size: int64(len(content)), Checksum: test.checksum}
+			if err := os.WriteFile(file.Path(), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			raftIndex, checksum, err := archiveFileScan(&LocalArchiveStore{}, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if raftIndex != test.raftIndex {
+				t.Errorf("raft index is %d, want %d", raftIndex, test.raftIndex)
+			}
+			want := test.checksum
+			if want == "" {
+				sum := md5.Sum(content)
+				want = hex.EncodeToString(sum[:])
+			}
+			if checksum != want {
+				t.Errorf("md5 is %s, want %s", checksum, want)
+			}
+		})
+	}
+
+	// a file that cannot be opened is an error
+	archive := ArchiveNew()
+	if err := archive.Parse("local|svc-a|" + t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := archiveFileScan(&LocalArchiveStore{}, &ArchiveFile{Archive: archive, Name: "missing.bak"}); err == nil {
+		t.Error("scanned a missing file")
+	}
+}
@@ -1,7 +1,9 @@
 package schema
 
 import (
+	"fmt"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -13,6 +15,31 @@ const (
 	SSSStatusOK
 )
 
+func (s ArchvieFileSetStatus) String() string {
+	switch s {
+	case SSSStatusError:
+		return "error"
+	case SSSStatusWarn:
+		return "warning"
+	default:
+		return "ok"
+	}
+}
+
+func (s ArchvieFileSetStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ArchiveFileSetReason is one finding of EvaluateStatus
+type ArchiveFileSetReason struct {
+	Status  ArchvieFileSetStatus `json:"status" yaml:"status"`
+	Message string               `json:"message" yaml:"message"`
+}
+
+func (r *ArchiveFileSetReason) String() string {
+	return r.Status.String() + ": " + r.Message
+}
+
 func ArchiveFileSetNew() *ArchiveFileSet {
 	sss := &ArchiveFileSet{}
 	sss.ArchiveFiles = make([]*ArchiveFile, 0)
@@ -21,6 +48,10 @@ func ArchiveFileSetNew() *ArchiveFileSet {
 
 type ArchiveFileSet struct {
 	ArchiveFiles []*ArchiveFile
+
+	// Status and Reasons are set by EvaluateStatus
+	Status  ArchvieFileSetStatus
+	Reasons []*ArchiveFileSetReason
 }
 
 func (sss *ArchiveFileSet) ArchiveFileAdd(af *ArchiveFile) {
@@ -31,8 +62,156 @@ func (sss *ArchiveFileSet) SortByMostRecent() {
 	sort.Sort(ByMostRecent(sss.ArchiveFiles))
 }
 
-func (ss *ArchiveFileSet) EvaluateStatus() {
+func (sss *ArchiveFileSet) reasonAdd(status ArchvieFileSetStatus, format string, args ...interface{}) {
+	sss.Reasons = append(sss.Reasons, &ArchiveFileSetReason{Status: status, Message: fmt.Sprintf(format, args...)})
+	if status < sss.Status {
+		sss.Status = status
+	}
+}
+
+// EvaluateStatus checks that the set is a usable snapshot of the services
+// of as and sets Status to the worst of the Reasons found.
+func (sss *ArchiveFileSet) EvaluateStatus(as *ArchiveSet) {
+	sss.Status = SSSStatusOK
+	sss.Reasons = make([]*ArchiveFileSetReason, 0)
+
+	// every service needs a file
+	if missing := as.MissingServicesGet(sss); len(missing) > 0 {
+		sss.reasonAdd(SSSStatusError, "missing %d archive files for %v", len(missing), missing)
+	}
+
+	// files of one snapshot are taken together. files with the same
+	// snapshot id are from one backup request, whatever their times.
+	first, last := sss.FirstAndLastArchiveFileTime()
+	if sss.SnapshotID() == "" && last.Sub(first) > time.Second {
+		sss.reasonAdd(SSSStatusWarn, "file timestamps are %s apart. expected < 1 sec", last.Sub(first))
+	}
+
+	for _, archiveFile := range sss.ArchiveFiles {
+		if archiveFile.Size == 0 {
+			sss.reasonAdd(SSSStatusError, "%s/%s is empty", archiveFile.Archive.Spec, archiveFile.Name)
+		}
+		sss.replicasEvaluate(archiveFile)
+	}
+}
+
+// replicasEvaluate checks that the replicas of a statefulset archive agree
+// on archiveFile. Only replicas with files count.
+func (sss *ArchiveFileSet) replicasEvaluate(archiveFile *ArchiveFile) {
+	archive := archiveFile.Archive.Parent
+	if archive == nil {
+		return
+	}
+
+	replicas := make([]*Archive, 0)
+	copies := make(map[*Archive]*ArchiveFile)
+	for _, file := range archive.Files {
+		if _, ok := copies[file.Archive]; !ok {
+			replicas = append(replicas, file.Archive)
+			copies[file.Archive] = nil
+		}
+		if file.IsCopyOf(archiveFile) {
+			copies[file.Archive] = file
+		}
+	}
+	if len(replicas) < 2 {
+		return
+	}
 
+	missing := make([]string, 0)
+	sizes := make(map[int64]bool)
+	checksums := make(map[string]bool)
+	for _, replica := range replicas {
+		file := copies[replica]
+		if file == nil {
+			missing = append(missing, replica.KubeName)
+			continue
+		}
+		sizes[file.Size] = true
+		if file.Checksum != "" {
+			checksums[file.Checksum] = true
+		}
+	}
+
+	if len(missing) > 0 {
+		sss.reasonAdd(SSSStatusWarn, "%s is missing on replicas %s of %s",
+			archiveFile.Name, strings.Join(missing, ", "), archive.Spec)
+	}
+	if len(sizes) > 1 {
+		sss.reasonAdd(SSSStatusError, "replicas of %s disagree on the size of %s", archive.Spec, archiveFile.Name)
+	}
+	if len(checksums) > 1 {
+		sss.reasonAdd(SSSStatusError, "checksum mismatch between replicas of %s for %s", archive.Spec, archiveFile.Name)
+	}
+}
+
+// SnapshotID returns the snapshot id shared by all files of the set, or ""
+func (sss *ArchiveFileSet) SnapshotID() string {
+	if len(sss.ArchiveFiles) == 0 {
+		return ""
+	}
+	snapshotID := sss.ArchiveFiles[0].SnapshotID()
+	for _, archiveFile := range sss.ArchiveFiles {
+		if archiveFile.SnapshotID() != snapshotID {
+			return ""
+		}
+	}
+	return snapshotID
+}
+
+// Labels returns the labels of the files of the set in order of first
+// appearance
+func (sss *ArchiveFileSet) Labels() []string {
+	labels := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, archiveFile := range sss.ArchiveFiles {
+		if archiveFile.Meta == nil {
+			continue
+		}
+		for _, label := range archiveFile.Meta.Labels {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
+// HasLabel is true if any file of the set has label
+func (sss *ArchiveFileSet) HasLabel(label string) bool {
+	for _, archiveFile := range sss.ArchiveFiles {
+		if archiveFile.Meta != nil && archiveFile.Meta.HasLabel(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPinned is true if any file of the set is pinned now
+func (sss *ArchiveFileSet) IsPinned() bool {
+	now := time.Now()
+	for _, archiveFile := range sss.ArchiveFiles {
+		if archiveFile.Meta != nil && archiveFile.Meta.IsPinned(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusErr returns an error naming the Reasons if Status is SSSStatusError
+func (sss *ArchiveFileSet) StatusErr() error {
+	if sss.Status != SSSStatusError {
+		return nil
+	}
+	messages := make([]string, 0, len(sss.Reasons))
+	for _, reason := range sss.Reasons {
+		if reason.Status == SSSStatusError {
+			messages = append(messages, reason.Message)
+		}
+	}
+	_, last := sss.FirstAndLastArchiveFileTime()
+	return fmt.Errorf("snapshot at %s is not usable: %s", last.Format(time.RFC3339), strings.Join(messages, "; "))
 }
 
 func (sss *ArchiveFileSet) NextSeekTime(t time.Time) time.Time {
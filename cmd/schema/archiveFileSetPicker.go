@@ -3,6 +3,7 @@ package schema
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -17,6 +18,7 @@ type ArchiveFileSetPicker struct {
 	SelectedSnapshotFilesView      *tview.Table
 	SelectedSnapshotStatusView     *tview.Table
 	FiltersView                    *tview.TextView
+	FilterInput                    *tview.InputField
 	SnapshotsView                  *tview.Table
 	RootView                       *tview.Flex
 }
@@ -30,8 +32,24 @@ func ArchiveFileSetPickerNew() *ArchiveFileSetPicker {
 	p.SnapshotsView.SetSelectionChangedFunc(p.SelectedSnapshotViewRender)
 	p.SnapshotsView.SetBorders(false).SetBorder(true).SetTitle("Snapshots")
 
-	p.FiltersView = tview.NewTextView()
-	p.FiltersView.SetBorder(true).SetTitle("Filters")
+	p.FiltersView = tview.NewTextView().SetDynamicColors(true)
+
+	p.FilterInput = tview.NewInputField().SetLabel("filter: ")
+	p.FilterInput.SetDoneFunc(p.FilterInputDone)
+
+	filtersView := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(p.FiltersView, 0, 1, false).
+		AddItem(p.FilterInput, 1, 0, false)
+	filtersView.SetBorder(true).SetTitle("Filters (f to edit)")
+
+	p.SnapshotsView.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Rune() == 'f' {
+			p.FilterInput.SetText(TimeFiltersString(p.ArchiveSet.FiltersGet()))
+			p.App.SetFocus(p.FilterInput)
+			return nil
+		}
+		return event
+	})
 
 	p.SelectedSnapshotStatusView = tview.NewTable()
 	p.SelectedSnapshotStatusView.SetSelectable(false, false)
@@ -50,7 +68,7 @@ func ArchiveFileSetPickerNew() *ArchiveFileSetPicker {
 		// AddItem(tview.NewBox().SetBorder(true).SetTitle("Left (1/2 x width of Top)"), 0, 1, false).
 		AddItem(p.SnapshotsView, 0, 1, true).
 		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-			AddItem(p.FiltersView, 0, 1, false).
+			AddItem(filtersView, 0, 1, false).
 			AddItem(selectedSnapshotView, 0, 10, false),
 			0, 3, false)
 
@@ -63,6 +81,8 @@ func (p *ArchiveFileSetPicker) SelectedSnapshotViewRender(row, col int) {
 	selectedCell := p.SnapshotsView.GetCell(row, col)
 	ref := selectedCell.GetReference()
 	if ref == nil {
+		p.SelectedSnapshotStatusView.Clear()
+		p.SelectedSnapshotFilesView.Clear()
 		core.Log.Errorf("no snapshots to select")
 		return
 	}
@@ -76,34 +96,16 @@ func (p *ArchiveFileSetPicker) SelectedSnapshotViewRender(row, col int) {
 		cell := tview.NewTableCell("looks good")
 		p.SelectedSnapshotStatusView.SetCell(0, 0, cell)
 
-		// get all status messages
-		var isInError, isInWarn bool
-		var statusMessageCount int
-
-		// validate number of files
-		missingArchiveFilesNum := len(p.ArchiveSet.Archives) - len(archiveFileSet.ArchiveFiles)
-		if missingArchiveFilesNum > 0 {
-			cell := tview.NewTableCell(fmt.Sprintf("error: missing %d archive files", missingArchiveFilesNum))
-			p.SelectedSnapshotStatusView.SetCell(statusMessageCount, 0, cell)
-			statusMessageCount++
-			isInError = true
-		}
-
-		// validate timestamps
-		first, last := archiveFileSet.FirstAndLastArchiveFileTime()
-		if last.Sub(first) > time.Second {
-			cell := tview.NewTableCell("warning: expected all file timestamps to be < 1 sec apart")
-			p.SelectedSnapshotStatusView.SetCell(statusMessageCount, 0, cell)
-
-			statusMessageCount++
-			isInWarn = true
+		// list the reasons from EvaluateStatus
+		for r, reason := range archiveFileSet.Reasons {
+			p.SelectedSnapshotStatusView.SetCell(r, 0, tview.NewTableCell(reason.String()))
 		}
 
 		// set the background color
-		if isInWarn {
+		switch archiveFileSet.Status {
+		case SSSStatusWarn:
 			p.SelectedSnapshotStatusView.SetBackgroundColor(tcell.ColorYellow)
-		}
-		if isInError {
+		case SSSStatusError:
 			p.SelectedSnapshotStatusView.SetBackgroundColor(tcell.ColorRed)
 		}
 	}
@@ -148,6 +150,32 @@ func (p *ArchiveFileSetPicker) Select(row, col int) {
 
 func (p *ArchiveFileSetPicker) ArchiveSetPut(as *ArchiveSet) *ArchiveFileSetPicker {
 	p.ArchiveSet = as
+	p.SnapshotsRender()
+	return p
+}
+
+// FilterInputDone applies the filters typed into FilterInput on enter
+// and goes back to the snapshots
+func (p *ArchiveFileSetPicker) FilterInputDone(key tcell.Key) {
+	if key == tcell.KeyEnter {
+		filters, err := TimeFiltersParse(p.FilterInput.GetText())
+		if err != nil {
+			p.FiltersView.Clear()
+			fmt.Fprintf(p.FiltersView, "[red]%v", tview.Escape(err.Error()))
+			return
+		}
+		p.ArchiveSet.FiltersSet(filters)
+		p.SnapshotsRender()
+	}
+	p.FilterInput.SetText("")
+	p.App.SetFocus(p.SnapshotsView)
+}
+
+// SnapshotsRender lists the snapshots of the ArchiveSet that pass its
+// filters and shows the filters
+func (p *ArchiveFileSetPicker) SnapshotsRender() {
+	as := p.ArchiveSet
+	p.SnapshotsView.Clear()
 
 	// add 1 row per snapshot
 	as.SeekTo(time.Now())
@@ -162,11 +190,29 @@ func (p *ArchiveFileSetPicker) ArchiveSetPut(as *ArchiveSet) *ArchiveFileSetPick
 			SetReference(archiveFileSet).
 			SetTextColor(tcell.ColorBlue)
 		p.SnapshotsView.SetCell(r, 0, cell.SetAlign(tview.AlignCenter))
+
+		// labels are user text and the marker has brackets, so escape
+		// them or tview takes them for style tags
+		labels := strings.Join(archiveFileSet.Labels(), " ")
+		if archiveFileSet.IsPinned() {
+			labels = strings.TrimSpace("[pinned] " + labels)
+		}
+		labelCell := tview.NewTableCell(tview.Escape(labels)).
+			SetReference(archiveFileSet).
+			SetTextColor(tcell.ColorYellow)
+		p.SnapshotsView.SetCell(r, 1, labelCell.SetAlign(tview.AlignLeft))
 	}
 
-	p.SelectedSnapshotViewRender(0, 0)
+	p.FiltersView.Clear()
+	if as.Label != "" {
+		fmt.Fprintf(p.FiltersView, "label: %s\n", tview.Escape(as.Label))
+	}
+	for _, filter := range as.FiltersGet() {
+		fmt.Fprintf(p.FiltersView, "%s\n", tview.Escape(filter.String()))
+	}
 
-	return p
+	p.SnapshotsView.Select(0, 0)
+	p.SelectedSnapshotViewRender(0, 0)
 }
 
 func (p *ArchiveFileSetPicker) Run() *ArchiveFileSetPicker {
@@ -0,0 +1,40 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestArchiveFileSetPickerLabels(t *testing.T) {
+	as := pruneTestSetMake(t, []pruneTestSnap{{id: "s0", pinned: true}})
+	for _, archive := range as.Archives {
+		for _, file := range archive.Files {
+			file.Meta.Labels = []string{"[red]", "pre-migration"}
+		}
+	}
+	p := ArchiveFileSetPickerNew().ArchiveSetPut(as)
+
+	// draw the snapshots and read back the text on screen
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+	screen.SetSize(120, 5)
+	p.SnapshotsView.SetRect(0, 0, 120, 5)
+	p.SnapshotsView.Draw(screen)
+	screen.Show()
+	cells, width, _ := screen.GetContents()
+	row := strings.Builder{}
+	for _, cell := range cells[width : 2*width] {
+		row.WriteString(string(cell.Runes))
+	}
+
+	for _, want := range []string{"[pinned]", "[red]", "pre-migration"} {
+		if !strings.Contains(row.String(), want) {
+			t.Errorf("snapshot row %q does not show %s", row.String(), want)
+		}
+	}
+}
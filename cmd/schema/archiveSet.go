@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/kube"
 	"golang.org/x/sync/errgroup"
 )
@@ -15,9 +16,11 @@ func ArchiveSetNew() *ArchiveSet {
 }
 
 type ArchiveSet struct {
-	Archives []*Archive
-	seekTime time.Time
-	sss      *ArchiveFileSet
+	Archives    []*Archive
+	Label       string // if set, only sets with this label are returned
+	seekTime    time.Time
+	sss         *ArchiveFileSet
+	snapshotIDs map[string]bool // of the sets returned since SeekTo
 }
 
 func (as *ArchiveSet) ArchiveAdd(archiveSpec string) (archive *Archive, err error) {
@@ -55,7 +58,26 @@ func (as *ArchiveSet) ArchiveGetByService(service string) (a *Archive, err error
 	return nil, fmt.Errorf("could not find archive for service '%s' have only these... %v", service, archiveNames)
 }
 
-func (as *ArchiveSet) PickSnapshot(kubeClient *kube.Client) (archiveFileSet *ArchiveFileSet, err error) {
+// SnapshotPick picks a snapshot without the picker. Latest takes the most
+// recent usable snapshot, At the snapshot nearest a time and Before the
+// newest snapshot before a time. The zero value means ask the user.
+// SnapshotID takes the snapshot with that id. Label limits the choice to
+// snapshots with that label and Filters to snapshots led by a file that
+// matches any of them.
+type SnapshotPick struct {
+	Latest     bool
+	At         time.Time
+	Before     time.Time
+	SnapshotID string
+	Label      string
+	Filters    []*TimeFilter
+}
+
+func (p *SnapshotPick) IsInteractive() bool {
+	return p == nil || (!p.Latest && p.At.IsZero() && p.Before.IsZero() && p.SnapshotID == "")
+}
+
+func (as *ArchiveSet) PickSnapshot(kubeClient *kube.Client, pick *SnapshotPick) (archiveFileSet *ArchiveFileSet, err error) {
 	// let the user pick a srcArchiveFileSet (snapshot)
 	err = as.FilesFetch(kubeClient)
 	if err != nil {
@@ -66,6 +88,22 @@ func (as *ArchiveSet) PickSnapshot(kubeClient *kube.Client) (archiveFileSet *Arc
 		return nil, fmt.Errorf("found no snapshots in %v", as)
 	}
 
+	if pick != nil {
+		as.Label = pick.Label
+		as.FiltersSet(pick.Filters)
+	}
+
+	if !pick.IsInteractive() {
+		archiveFileSet, err = as.SnapshotSelect(pick)
+		if err != nil {
+			return nil, err
+		}
+		for _, reason := range archiveFileSet.Reasons {
+			core.Log.Warnf("picked snapshot has %s", reason)
+		}
+		return archiveFileSet, nil
+	}
+
 	picker := ArchiveFileSetPickerNew().ArchiveSetPut(as).Run()
 	archiveFileSet = picker.SelectedSnapshotArchiveFileSet
 
@@ -76,6 +114,76 @@ func (as *ArchiveSet) PickSnapshot(kubeClient *kube.Client) (archiveFileSet *Arc
 	return archiveFileSet, nil
 }
 
+// SnapshotSelect picks a snapshot from the fetched files as told by pick.
+// It fails if the status of the snapshot is SSSStatusError.
+func (as *ArchiveSet) SnapshotSelect(pick *SnapshotPick) (*ArchiveFileSet, error) {
+	if pick.SnapshotID != "" {
+		as.SeekTo(time.Now())
+		for sss := as.ArchiveFileSetGetNext(); sss != nil; sss = as.ArchiveFileSetGetNext() {
+			if sss.SnapshotID() == pick.SnapshotID {
+				return sss, sss.StatusErr()
+			}
+		}
+		return nil, fmt.Errorf("found no snapshot %s", pick.SnapshotID)
+	}
+
+	if pick.Latest {
+		as.SeekTo(time.Now())
+		for sss := as.ArchiveFileSetGetNext(); sss != nil; sss = as.ArchiveFileSetGetNext() {
+			if sss.Status != SSSStatusError {
+				return sss, nil
+			}
+		}
+		return nil, fmt.Errorf("found no usable snapshot")
+	}
+
+	if !pick.Before.IsZero() {
+		as.SeekTo(pick.Before)
+		sss := as.ArchiveFileSetGetNext()
+		if sss == nil {
+			return nil, fmt.Errorf("found no snapshot before %s", pick.Before.Format(time.RFC3339))
+		}
+		return sss, sss.StatusErr()
+	}
+
+	// walk back from now and keep the snapshot nearest pick.At
+	var nearest *ArchiveFileSet
+	var nearestDiff time.Duration
+	as.SeekTo(time.Now())
+	for sss := as.ArchiveFileSetGetNext(); sss != nil; sss = as.ArchiveFileSetGetNext() {
+		_, last := sss.FirstAndLastArchiveFileTime()
+		diff := last.Sub(pick.At)
+		if diff < 0 {
+			diff = -diff
+		}
+		if nearest == nil || diff < nearestDiff {
+			nearest, nearestDiff = sss, diff
+		}
+	}
+	if nearest == nil {
+		return nil, fmt.Errorf("found no snapshot near %s", pick.At.Format(time.RFC3339))
+	}
+	return nearest, nearest.StatusErr()
+}
+
+// MissingServicesGet returns the services with no file in sss
+func (as *ArchiveSet) MissingServicesGet(sss *ArchiveFileSet) []string {
+	missing := make([]string, 0)
+	for _, archive := range as.Archives {
+		found := false
+		for _, archiveFile := range sss.ArchiveFiles {
+			if archiveFile.Archive.ServiceName == archive.ServiceName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, archive.ServiceName)
+		}
+	}
+	return missing
+}
+
 func (as *ArchiveSet) FilesFetch(kubeClient *kube.Client) error {
 	eg := errgroup.Group{}
 
@@ -103,30 +211,81 @@ func (as *ArchiveSet) HasFiles() bool {
 func (as *ArchiveSet) SeekTo(t time.Time) {
 	as.seekTime = t
 	as.sss = nil
+	as.snapshotIDs = make(map[string]bool)
 }
 
+// ArchiveFileSetGetNext returns the next snapshot before the seek time
+// with as.Label, if set
 func (as *ArchiveSet) ArchiveFileSetGetNext() *ArchiveFileSet {
+	for {
+		sss := as.archiveFileSetGetNext()
+		if sss == nil || as.Label == "" || sss.HasLabel(as.Label) {
+			return sss
+		}
+	}
+}
+
+// archiveFileSetGetNext returns the next snapshot before the seek time.
+// The most recent file leads the set. If it has a snapshot id, the set is
+// the file of each archive with that id. Files from before snapshot ids
+// are grouped as the most recent file of each archive without one.
+func (as *ArchiveSet) archiveFileSetGetNext() *ArchiveFileSet {
 	if as.sss != nil {
 		as.seekTime = as.sss.NextSeekTime(as.seekTime)
 	}
 
-	// make the next ArchiveFileSet
-	sss := ArchiveFileSetNew()
+	// find the lead
+	var lead *ArchiveFile
 	for _, a := range as.Archives {
-		archiveFile := a.FileGetFilteredBefore(as.seekTime)
-		if archiveFile != nil {
-			sss.ArchiveFileAdd(archiveFile)
+		archiveFile := as.fileGetFilteredBefore(a, as.seekTime, false)
+		if archiveFile != nil && (lead == nil || archiveFile.Time.After(lead.Time)) {
+			lead = archiveFile
 		}
 	}
-	if len(sss.ArchiveFiles) == 0 {
+	if lead == nil {
 		return nil
 	}
+
+	// make the next ArchiveFileSet
+	sss := ArchiveFileSetNew()
+	if snapshotID := lead.SnapshotID(); snapshotID != "" {
+		as.snapshotIDs[snapshotID] = true
+		for _, a := range as.Archives {
+			archiveFile := a.FileGetBySnapshotID(snapshotID)
+			if archiveFile != nil {
+				sss.ArchiveFileAdd(archiveFile)
+			}
+		}
+	} else {
+		for _, a := range as.Archives {
+			archiveFile := as.fileGetFilteredBefore(a, as.seekTime, true)
+			if archiveFile != nil {
+				sss.ArchiveFileAdd(archiveFile)
+			}
+		}
+	}
 	sss.SortByMostRecent()
-	sss.EvaluateStatus()
+	sss.EvaluateStatus(as)
 	as.sss = sss
 	return sss
 }
 
+// fileGetFilteredBefore returns the most recent filtered file of a before
+// t that is not part of a set returned already. withoutID skips files with
+// a snapshot id.
+func (as *ArchiveSet) fileGetFilteredBefore(a *Archive, t time.Time, withoutID bool) *ArchiveFile {
+	for _, file := range a.FilesFiltered {
+		if !file.Time.Before(t) {
+			continue
+		}
+		if snapshotID := file.SnapshotID(); snapshotID != "" && (withoutID || as.snapshotIDs[snapshotID]) {
+			continue
+		}
+		return file
+	}
+	return nil
+}
+
 func (as *ArchiveSet) FilterAdd(tf *TimeFilter) {
 	for _, a := range as.Archives {
 		a.Filters = append(a.Filters, tf)
@@ -138,3 +297,19 @@ func (as *ArchiveSet) FiltersClear() {
 		a.Filters = make([]*TimeFilter, 0)
 	}
 }
+
+// FiltersSet replaces the filters of every archive and filters their files
+func (as *ArchiveSet) FiltersSet(filters []*TimeFilter) {
+	for _, a := range as.Archives {
+		a.Filters = filters
+		a.Filter()
+	}
+}
+
+// FiltersGet returns the filters of the archives
+func (as *ArchiveSet) FiltersGet() []*TimeFilter {
+	if len(as.Archives) == 0 {
+		return nil
+	}
+	return as.Archives[0].Filters
+}
@@ -0,0 +1,105 @@
+package schema
+
+import (
+	"time"
+)
+
+// SnapshotListing describes a snapshot set for archive ls and snapshot ls
+type SnapshotListing struct {
+	Time       time.Time               `json:"time" yaml:"time"`
+	SnapshotID string                  `json:"snapshotID,omitempty" yaml:"snapshotID,omitempty"`
+	Status     ArchvieFileSetStatus    `json:"status" yaml:"status"`
+	Reasons    []*ArchiveFileSetReason `json:"reasons,omitempty" yaml:"reasons,omitempty"`
+	Labels     []string                `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Pinned     bool                    `json:"pinned,omitempty" yaml:"pinned,omitempty"`
+	Files      []*ArchiveFileListing   `json:"files" yaml:"files"`
+}
+
+// ArchiveFileListing describes a file in an archive. Replica is the pod
+// of a statefulset archive the file is on. Status is the status of the
+// snapshot the file belongs to. Meta is its meta sidecar, so the files of
+// a SnapshotListing show the manifest of the snapshot.
+type ArchiveFileListing struct {
+	Archive    string               `json:"archive" yaml:"archive"`
+	Replica    string               `json:"replica,omitempty" yaml:"replica,omitempty"`
+	Name       string               `json:"name" yaml:"name"`
+	Time       time.Time            `json:"time" yaml:"time"`
+	Size       int64                `json:"size" yaml:"size"`
+	Checksum   string               `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	SnapshotID string               `json:"snapshotID,omitempty" yaml:"snapshotID,omitempty"`
+	Status     ArchvieFileSetStatus `json:"status" yaml:"status"`
+	Meta       *ArchiveFileMeta     `json:"meta,omitempty" yaml:"meta,omitempty"`
+}
+
+func archiveFileListingMake(file *ArchiveFile, status ArchvieFileSetStatus) *ArchiveFileListing {
+	listing := &ArchiveFileListing{
+		Archive:    file.Archive.Spec,
+		Name:       file.Name,
+		Time:       file.Time,
+		Size:       file.Size,
+		Checksum:   file.Checksum,
+		SnapshotID: file.SnapshotID(),
+		Status:     status,
+		Meta:       file.Meta,
+	}
+	if file.Archive.Parent != nil {
+		listing.Archive = file.Archive.Parent.Spec
+		listing.Replica = file.Archive.KubeName
+	}
+	return listing
+}
+
+// SnapshotsList lists the snapshot sets of as, most recent first, with
+// the copies of their files on every replica. as must have its files
+// fetched.
+func (as *ArchiveSet) SnapshotsList() []*SnapshotListing {
+	listings := make([]*SnapshotListing, 0)
+	as.SeekTo(time.Now())
+	for sss := as.ArchiveFileSetGetNext(); sss != nil; sss = as.ArchiveFileSetGetNext() {
+		_, last := sss.FirstAndLastArchiveFileTime()
+		listing := &SnapshotListing{
+			Time:       last,
+			SnapshotID: sss.SnapshotID(),
+			Status:     sss.Status,
+			Reasons:    sss.Reasons,
+			Labels:     sss.Labels(),
+			Pinned:     sss.IsPinned(),
+			Files:      make([]*ArchiveFileListing, 0),
+		}
+		for _, archiveFile := range sss.ArchiveFiles {
+			for _, file := range archiveFile.CopiesGet() {
+				listing.Files = append(listing.Files, archiveFileListingMake(file, sss.Status))
+			}
+		}
+		listings = append(listings, listing)
+	}
+	return listings
+}
+
+// FilesList lists the files of each archive of as, most recent first.
+// Files get the status of the most recent snapshot they belong to.
+func (as *ArchiveSet) FilesList() []*ArchiveFileListing {
+	statuses := make(map[*ArchiveFile]ArchvieFileSetStatus)
+	as.SeekTo(time.Now())
+	for sss := as.ArchiveFileSetGetNext(); sss != nil; sss = as.ArchiveFileSetGetNext() {
+		for _, archiveFile := range sss.ArchiveFiles {
+			for _, file := range archiveFile.CopiesGet() {
+				if _, ok := statuses[file]; !ok {
+					statuses[file] = sss.Status
+				}
+			}
+		}
+	}
+
+	listings := make([]*ArchiveFileListing, 0)
+	for _, archive := range as.Archives {
+		for _, file := range archive.Files {
+			status, ok := statuses[file]
+			if !ok {
+				status = SSSStatusError
+			}
+			listings = append(listings, archiveFileListingMake(file, status))
+		}
+	}
+	return listings
+}
@@ -0,0 +1,148 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"golang.org/x/sync/errgroup"
+)
+
+// snap files are done when their size holds still for snapStablePolls polls
+const (
+	snapPollInterval = 5 * time.Second
+	snapStablePolls  = 3
+)
+
+// SnapReplicasGet returns the archives a snap of the service of the archive
+// writes to. That is each pod of a statefulset archive or the archive.
+func (a *Archive) SnapReplicasGet(kubeClient *kube.Client) ([]*Archive, error) {
+	store, err := a.StoreGet(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if replicator, ok := store.(ArchiveReplicator); ok {
+		return replicator.ReplicaArchivesGet(a)
+	}
+	return []*Archive{a}, nil
+}
+
+// snapNewestFileGet returns the newest archive file in the replica, or nil
+func snapNewestFileGet(kubeClient *kube.Client, replica *Archive) (*ArchiveFile, error) {
+	store, err := replica.StoreGet(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	storeFiles, err := store.List(replica)
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *ArchiveFile
+	for _, file := range storeFiles {
+		if ArchiveFileIsSidecar(file.Name) || file.TimestampParseFromName() != nil {
+			continue
+		}
+		if newest == nil || file.Time.After(newest.Time) {
+			newest = file
+		}
+	}
+	return newest, nil
+}
+
+// SnapBaselineGet returns the newest file of each replica by replica spec.
+// Files of the next snap are newer.
+func (a *Archive) SnapBaselineGet(kubeClient *kube.Client) (map[string]*ArchiveFile, error) {
+	replicas, err := a.SnapReplicasGet(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := make(map[string]*ArchiveFile)
+	baselineMutex := sync.Mutex{}
+	eg := errgroup.Group{}
+	for _, replica := range replicas {
+		replica := replica
+		eg.Go(func() error {
+			newest, err := snapNewestFileGet(kubeClient, replica)
+			if err != nil {
+				return fmt.Errorf("could not get files of %s: %v", replica.Spec, err)
+			}
+			baselineMutex.Lock()
+			baseline[replica.Spec] = newest
+			baselineMutex.Unlock()
+			return nil
+		})
+	}
+	return baseline, eg.Wait()
+}
+
+// SnapWait waits for a file newer than baseline on each replica of the
+// archive and for its size to hold still. It returns the files or, after
+// timeout, an error with the state of each replica that is not done.
+func (a *Archive) SnapWait(kubeClient *kube.Client, baseline map[string]*ArchiveFile, timeout time.Duration) ([]*ArchiveFile, error) {
+	replicas, err := a.SnapReplicasGet(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	files := make([]*ArchiveFile, len(replicas))
+	errs := make([]error, len(replicas))
+	eg := errgroup.Group{}
+	for i, replica := range replicas {
+		i, replica := i, replica
+		eg.Go(func() error {
+			files[i], errs[i] = snapReplicaWait(kubeClient, replica, baseline[replica.Spec], deadline)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	messages := make([]string, 0)
+	for i, err := range errs {
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %v", replicas[i].Spec, err))
+		}
+	}
+	if len(messages) > 0 {
+		return nil, fmt.Errorf("snap to %s not done on %d of %d replicas after %s:\n  %s",
+			a.Spec, len(messages), len(replicas), timeout, strings.Join(messages, "\n  "))
+	}
+	return files, nil
+}
+
+// snapReplicaWait polls the replica until it has a file newer than
+// baseline with a size that holds still
+func snapReplicaWait(kubeClient *kube.Client, replica *Archive, baseline *ArchiveFile, deadline time.Time) (*ArchiveFile, error) {
+	var file *ArchiveFile
+	var state error
+	stablePolls := 0
+	for {
+		newest, err := snapNewestFileGet(kubeClient, replica)
+		switch {
+		case err != nil:
+			state = fmt.Errorf("could not get files: %v", err)
+		case newest == nil || (baseline != nil && !newest.Time.After(baseline.Time)):
+			state = fmt.Errorf("no new file")
+		default:
+			if file != nil && newest.Name == file.Name && newest.Size == file.Size {
+				stablePolls++
+			} else {
+				stablePolls = 0
+			}
+			file = newest
+			if file.Size > 0 && stablePolls >= snapStablePolls {
+				return file, nil
+			}
+			state = fmt.Errorf("%s still growing at %d bytes", file.Name, file.Size)
+		}
+
+		if time.Now().Add(snapPollInterval).After(deadline) {
+			return nil, state
+		}
+		time.Sleep(snapPollInterval)
+	}
+}
@@ -0,0 +1,205 @@
+package schema
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/jkassis/jerriedr/cmd/kube"
+)
+
+// ArchiveStore reads and writes the files of archives of one scheme.
+// Copy and restore only talk to stores, so a new backend (or a fake for
+// testing) is one more ArchiveStoreRegister call.
+type ArchiveStore interface {
+	// List returns the files in the archive. Times are not parsed.
+	List(archive *Archive) ([]*ArchiveFile, error)
+
+	// Stat returns the size of a file in the archive
+	Stat(archive *Archive, fileName string) (*ArchiveFileStat, error)
+
+	// Open returns a reader for a file in the archive from offset on
+	Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error)
+
+	// Create returns a writer for a file in the archive. The file must
+	// not appear under fileName until Close returns nil, so an interrupted
+	// write never leaves a partial file that looks complete.
+	Create(archive *Archive, fileName string) (ArchiveFileWriter, error)
+
+	// Remove deletes a file from the archive
+	Remove(archive *Archive, fileName string) error
+
+	// Checksum returns the hex md5 of a file in the archive
+	Checksum(archive *Archive, fileName string) (string, error)
+}
+
+// ArchiveStager is implemented by stores that can stage a file for a
+// service restore by linking it into a folder at the same location.
+// Service.Stage copies files from anywhere else into the folder instead.
+type ArchiveStager interface {
+	// Clear empties the archive folder, making it if needed
+	Clear(archive *Archive) error
+
+	// Link links src into the folder of dst. src must be at the same
+	// location as dst.
+	Link(src, dst *ArchiveFile) error
+}
+
+// ArchiveResumer is implemented by stores that can pick up a copy where
+// an interrupted one stopped
+type ArchiveResumer interface {
+	// PartialSize returns how much of fileName an interrupted Create
+	// or Resume left behind, or 0
+	PartialSize(archive *Archive, fileName string) (int64, error)
+
+	// Resume returns a writer that appends to what an interrupted Create
+	// left behind, starting at offset. Offset 0 starts the file over.
+	// Close checks the md5 of the whole file as it landed against
+	// checksum before moving it into place.
+	Resume(archive *Archive, fileName string, offset int64, checksum string) (ArchiveFileWriter, error)
+}
+
+// ArchiveReplicator is implemented by stores whose archives are copies
+// kept on several replicas. Copies to them go to each replica archive on
+// its own.
+type ArchiveReplicator interface {
+	ReplicaArchivesGet(archive *Archive) ([]*Archive, error)
+}
+
+// ArchiveSidecarReader is implemented by stores that can read every
+// sidecar with a suffix in an archive in one request
+type ArchiveSidecarReader interface {
+	// SidecarsRead returns the content of the sidecars one after another
+	SidecarsRead(archive *Archive, suffix string) ([]byte, error)
+}
+
+// ArchiveFileStat describes a file in an archive
+type ArchiveFileStat struct {
+	Name string
+	Size int64
+}
+
+// ArchiveFileWriter writes a file to an archive. CloseWithError stops the
+// write but keeps what landed so an ArchiveResumer can pick it up later.
+// Abort stops the write and throws away what landed.
+type ArchiveFileWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+	Abort(err error) error
+}
+
+// ArchiveStoreFactory makes the store for a scheme. kubeClient may be
+// nil for stores that do not need it.
+type ArchiveStoreFactory func(kubeClient *kube.Client) (ArchiveStore, error)
+
+var archiveStoreFactories = make(map[string]ArchiveStoreFactory)
+var archiveStoreFactoriesMutex sync.RWMutex
+
+// ArchiveStoreRegister makes the store for scheme with factory, replacing
+// any store already registered for it
+func ArchiveStoreRegister(scheme string, factory ArchiveStoreFactory) {
+	archiveStoreFactoriesMutex.Lock()
+	defer archiveStoreFactoriesMutex.Unlock()
+	archiveStoreFactories[scheme] = factory
+}
+
+// ArchiveStoreGet returns the store for scheme
+func ArchiveStoreGet(scheme string, kubeClient *kube.Client) (ArchiveStore, error) {
+	archiveStoreFactoriesMutex.RLock()
+	factory, ok := archiveStoreFactories[scheme]
+	archiveStoreFactoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no archive store for scheme '%s' have only these... %v", scheme, ArchiveStoreSchemes())
+	}
+	return factory(kubeClient)
+}
+
+// ArchiveStoreSchemes returns the sorted schemes of all registered stores
+func ArchiveStoreSchemes() []string {
+	archiveStoreFactoriesMutex.RLock()
+	defer archiveStoreFactoriesMutex.RUnlock()
+	schemes := make([]string, 0, len(archiveStoreFactories))
+	for scheme := range archiveStoreFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// pipeFileWriter adapts clients that write a file from an io.Reader to
+// ArchiveFileWriter. write runs in the background. Close waits for it
+// and then calls commit, eg. to rename a temp file into place. abort is
+// only called by Abort, eg. to remove the temp file. A failed write or
+// commit leaves it for a resume. commit and abort may be nil.
+type pipeFileWriter struct {
+	pipeWriter *io.PipeWriter
+	done       chan error
+	commit     func() error
+	abort      func()
+}
+
+func pipeFileWriterNew(write func(src io.Reader) error, commit func() error, abort func()) *pipeFileWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	w := &pipeFileWriter{
+		pipeWriter: pipeWriter,
+		done:       make(chan error, 1),
+		commit:     commit,
+		abort:      abort,
+	}
+	go func() {
+		err := write(pipeReader)
+		if err != nil {
+			pipeReader.CloseWithError(err)
+		} else {
+			pipeReader.Close()
+		}
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *pipeFileWriter) Write(p []byte) (int, error) {
+	return w.pipeWriter.Write(p)
+}
+
+func (w *pipeFileWriter) Close() error {
+	w.pipeWriter.Close()
+	if err := <-w.done; err != nil {
+		return err
+	}
+	if w.commit != nil {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *pipeFileWriter) CloseWithError(err error) error {
+	w.pipeWriter.CloseWithError(err)
+	<-w.done
+	return err
+}
+
+func (w *pipeFileWriter) Abort(err error) error {
+	w.CloseWithError(err)
+	if w.abort != nil {
+		w.abort()
+	}
+	return err
+}
+
+// pipeFileReader adapts clients that read a file to an io.Writer to an
+// io.ReadCloser
+func pipeFileReaderNew(read func(dst io.Writer) error) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(read(pipeWriter))
+	}()
+	return pipeReader
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) {
+	return fn(p)
+}
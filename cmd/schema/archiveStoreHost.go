@@ -0,0 +1,188 @@
+package schema
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/host"
+	"github.com/jkassis/jerriedr/cmd/kube"
+)
+
+func init() {
+	ArchiveStoreRegister("host", func(kubeClient *kube.Client) (ArchiveStore, error) {
+		hostClient, err := host.ClientGet()
+		if err != nil {
+			return nil, fmt.Errorf("could not get host client: %v", err)
+		}
+		return &HostArchiveStore{HostClient: hostClient}, nil
+	})
+}
+
+// HostArchiveStore keeps archives in a folder on a host reached over ssh
+type HostArchiveStore struct {
+	HostClient *host.Client
+}
+
+func (s *HostArchiveStore) List(archive *Archive) ([]*ArchiveFile, error) {
+	core.Log.Warnf("fetching file list for host archive %s", archive.Spec)
+	hostFileStats, err := s.HostClient.LsSizes(archive.Host, archive.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for hostSpec %s: %v", archive.Spec, err)
+	}
+
+	sidecars, err := s.HostClient.FilesCat(archive.Host, archive.Path, ArchiveFileChecksumSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not read checksums for hostSpec %s: %v", archive.Spec, err)
+	}
+	checksums := archiveFileChecksumsParse(sidecars)
+
+	files := make([]*ArchiveFile, 0, len(hostFileStats))
+	for _, hostFileStat := range hostFileStats {
+		files = append(files, &ArchiveFile{
+			Archive:  archive,
+			Name:     hostFileStat.Name,
+			Size:     hostFileStat.Size,
+			Checksum: checksums[hostFileStat.Name],
+		})
+	}
+	return files, nil
+}
+
+func (s *HostArchiveStore) SidecarsRead(archive *Archive, suffix string) ([]byte, error) {
+	content, err := s.HostClient.FilesCat(archive.Host, archive.Path, suffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s files for hostSpec %s: %v", suffix, archive.Spec, err)
+	}
+	return []byte(content), nil
+}
+
+func (s *HostArchiveStore) Stat(archive *Archive, fileName string) (*ArchiveFileStat, error) {
+	filePath := archive.Path + "/" + fileName
+	fileStat, err := s.HostClient.Stat(archive.Host, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stats for %s: %v", filePath, err)
+	}
+	return &ArchiveFileStat{Name: fileName, Size: fileStat.Size}, nil
+}
+
+func (s *HostArchiveStore) Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error) {
+	filePath := archive.Path + "/" + fileName
+	return pipeFileReaderNew(func(dst io.Writer) error {
+		if err := s.HostClient.FileReadAt(archive.Host, filePath, offset, dst); err != nil {
+			return fmt.Errorf("trouble with file read while copying file from host: %v", err)
+		}
+		return nil
+	}), nil
+}
+
+func (s *HostArchiveStore) Create(archive *Archive, fileName string) (ArchiveFileWriter, error) {
+	if _, err := s.HostClient.MkDir(archive.Host, archive.Path); err != nil {
+		return nil, fmt.Errorf("could not make directory '%s' on %s: %v", archive.Path, archive.Host, err)
+	}
+
+	// write to a temp file and move it into place when done
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	return pipeFileWriterNew(
+		func(src io.Reader) error {
+			return s.HostClient.FileWrite(archive.Host, src, tempPath)
+		},
+		func() error {
+			if _, err := s.HostClient.Mv(archive.Host, tempPath, filePath); err != nil {
+				return fmt.Errorf("could not move %s to %s on %s: %v", tempPath, filePath, archive.Host, err)
+			}
+			return nil
+		},
+		func() {
+			s.HostClient.Rm(archive.Host, tempPath)
+		}), nil
+}
+
+func (s *HostArchiveStore) PartialSize(archive *Archive, fileName string) (int64, error) {
+	tempPath := archive.Path + "/" + fileName + ArchiveFileTempSuffix
+	fileStat, err := s.HostClient.StatIfExists(archive.Host, tempPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not get stats for %s on %s: %v", tempPath, archive.Host, err)
+	}
+	if fileStat == nil {
+		return 0, nil
+	}
+	return fileStat.Size, nil
+}
+
+func (s *HostArchiveStore) Resume(archive *Archive, fileName string, offset int64, checksum string) (ArchiveFileWriter, error) {
+	if offset == 0 {
+		if _, err := s.HostClient.MkDir(archive.Host, archive.Path); err != nil {
+			return nil, fmt.Errorf("could not make directory '%s' on %s: %v", archive.Path, archive.Host, err)
+		}
+	}
+
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	return pipeFileWriterNew(
+		func(src io.Reader) error {
+			return s.HostClient.FileWriteAt(archive.Host, src, tempPath, offset)
+		},
+		func() error {
+			tempChecksum, err := s.HostClient.MD5Sum(archive.Host, tempPath)
+			if err != nil {
+				return fmt.Errorf("could not get md5 for %s: %v", tempPath, err)
+			}
+			if tempChecksum != checksum {
+				// the partial is bad. start over next time.
+				s.HostClient.Rm(archive.Host, tempPath)
+				return fmt.Errorf("checksum mismatch for %s on %s: want %s, have %s", tempPath, archive.Host, checksum, tempChecksum)
+			}
+			if _, err := s.HostClient.Mv(archive.Host, tempPath, filePath); err != nil {
+				return fmt.Errorf("could not move %s to %s on %s: %v", tempPath, filePath, archive.Host, err)
+			}
+			return nil
+		},
+		func() {
+			s.HostClient.Rm(archive.Host, tempPath)
+		}), nil
+}
+
+func (s *HostArchiveStore) Remove(archive *Archive, fileName string) error {
+	filePath := archive.Path + "/" + fileName
+	if _, err := s.HostClient.Rm(archive.Host, filePath); err != nil {
+		return fmt.Errorf("could not remove %s from %s: %v", filePath, archive.Host, err)
+	}
+	return nil
+}
+
+func (s *HostArchiveStore) Checksum(archive *Archive, fileName string) (string, error) {
+	filePath := archive.Path + "/" + fileName
+	hash, err := s.HostClient.MD5Sum(archive.Host, filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not get md5 for %s: %v", filePath, err)
+	}
+	return hash, nil
+}
+
+func (s *HostArchiveStore) Clear(archive *Archive) error {
+	if _, err := s.HostClient.Rm(archive.Host, archive.Path); err != nil {
+		return fmt.Errorf("cound not clear the content of the restore folder: %v", err)
+	}
+	if _, err := s.HostClient.MkDir(archive.Host, archive.Path); err != nil {
+		return fmt.Errorf("cound not create the restore folder: %v", err)
+	}
+	return nil
+}
+
+func (s *HostArchiveStore) Link(src, dst *ArchiveFile) error {
+	// can only link files on the same host
+	if !src.Archive.IsHost() || src.Archive.Host != dst.Archive.Host {
+		return fmt.Errorf("can only stage files on the same "+
+			"host. trying to stage %s on %s",
+			src.Archive.Spec,
+			dst.Archive.Host)
+	}
+
+	if _, err := s.HostClient.Ln(dst.Archive.Host, src.Path(), dst.Path()); err != nil {
+		return fmt.Errorf("cound not create symlink: src %s to %s: %v",
+			src.Path(), dst.Path(), err)
+	}
+	return nil
+}
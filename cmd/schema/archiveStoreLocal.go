@@ -0,0 +1,231 @@
+package schema
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jkassis/jerriedr/cmd/kube"
+)
+
+func init() {
+	ArchiveStoreRegister("local", func(kubeClient *kube.Client) (ArchiveStore, error) {
+		return &LocalArchiveStore{}, nil
+	})
+}
+
+// LocalArchiveStore keeps archives in a folder on this machine
+type LocalArchiveStore struct{}
+
+func (s *LocalArchiveStore) List(archive *Archive) ([]*ArchiveFile, error) {
+	dirEntries, err := os.ReadDir(archive.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for localSpec %s: %v", archive.Spec, err)
+	}
+
+	files := make([]*ArchiveFile, 0, len(dirEntries))
+	checksums := make(map[string]string)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		fileInfo, err := os.Stat(archive.Path + "/" + dirEntry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("could not get stats for %s/%s: %v", archive.Path, dirEntry.Name(), err)
+		}
+		files = append(files, &ArchiveFile{Archive: archive, Name: dirEntry.Name(), Size: fileInfo.Size()})
+
+		if strings.HasSuffix(dirEntry.Name(), ArchiveFileChecksumSuffix) {
+			if sidecar, err := os.ReadFile(archive.Path + "/" + dirEntry.Name()); err == nil {
+				for name, checksum := range archiveFileChecksumsParse(string(sidecar)) {
+					checksums[name] = checksum
+				}
+			}
+		}
+	}
+	for _, file := range files {
+		file.Checksum = checksums[file.Name]
+	}
+	return files, nil
+}
+
+func (s *LocalArchiveStore) SidecarsRead(archive *Archive, suffix string) ([]byte, error) {
+	dirEntries, err := os.ReadDir(archive.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for localSpec %s: %v", archive.Spec, err)
+	}
+
+	content := make([]byte, 0)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), suffix) {
+			continue
+		}
+		sidecar, err := os.ReadFile(archive.Path + "/" + dirEntry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s/%s: %v", archive.Path, dirEntry.Name(), err)
+		}
+		content = append(content, sidecar...)
+	}
+	return content, nil
+}
+
+func (s *LocalArchiveStore) Stat(archive *Archive, fileName string) (*ArchiveFileStat, error) {
+	filePath := archive.Path + "/" + fileName
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stats for %s: %v", filePath, err)
+	}
+	return &ArchiveFileStat{Name: fileName, Size: fileInfo.Size()}, nil
+}
+
+func (s *LocalArchiveStore) Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(archive.Path + "/" + fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *LocalArchiveStore) Create(archive *Archive, fileName string) (ArchiveFileWriter, error) {
+	if err := os.MkdirAll(archive.Path, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not make directory '%s': %v", archive.Path, err)
+	}
+
+	// write to a temp file and rename it into place on Close
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file  '%s': %v", tempPath, err)
+	}
+	return &localFileWriter{File: file, path: filePath}, nil
+}
+
+func (s *LocalArchiveStore) PartialSize(archive *Archive, fileName string) (int64, error) {
+	fileInfo, err := os.Stat(archive.Path + "/" + fileName + ArchiveFileTempSuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (s *LocalArchiveStore) Resume(archive *Archive, fileName string, offset int64, checksum string) (ArchiveFileWriter, error) {
+	if err := os.MkdirAll(archive.Path, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not make directory '%s': %v", archive.Path, err)
+	}
+
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file  '%s': %v", tempPath, err)
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not truncate '%s' to %d: %v", tempPath, offset, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localFileWriter{File: file, path: filePath, checksum: checksum}, nil
+}
+
+func (s *LocalArchiveStore) Remove(archive *Archive, fileName string) error {
+	return os.Remove(archive.Path + "/" + fileName)
+}
+
+func (s *LocalArchiveStore) Checksum(archive *Archive, fileName string) (string, error) {
+	return localChecksum(archive.Path + "/" + fileName)
+}
+
+func localChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("could not read %s for md5: %v", filePath, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (s *LocalArchiveStore) Clear(archive *Archive) error {
+	if err := os.RemoveAll(archive.Path); err != nil {
+		return fmt.Errorf("cound not clear the content of the restore folder: %v", err)
+	}
+	if err := os.MkdirAll(archive.Path, 0774); err != nil {
+		return fmt.Errorf("cound not create the restore folder: %v", err)
+	}
+	return nil
+}
+
+func (s *LocalArchiveStore) Link(src, dst *ArchiveFile) error {
+	// can only do local to local
+	if !src.Archive.IsLocal() {
+		return fmt.Errorf("can only restore to local from local. srcArchive is %s",
+			src.Archive.Spec)
+	}
+
+	if err := os.Symlink(src.Path(), dst.Path()); err != nil {
+		return fmt.Errorf("cound not create symlink: src %s to %s: %v",
+			src.Path(), dst.Path(), err)
+	}
+	return nil
+}
+
+// localFileWriter writes a temp file. Close syncs it, checks it against
+// checksum if set and renames it to path. The temp file is only removed
+// when it fails the check or by Abort. Otherwise it is left for Resume.
+type localFileWriter struct {
+	*os.File
+	path     string
+	checksum string
+}
+
+func (w *localFileWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		w.File.Close()
+		return fmt.Errorf("sync error for %s: %v", w.File.Name(), err)
+	}
+	if err := w.File.Close(); err != nil {
+		return fmt.Errorf("close error for %s: %v", w.File.Name(), err)
+	}
+	if w.checksum != "" {
+		checksum, err := localChecksum(w.File.Name())
+		if err != nil {
+			return err
+		}
+		if checksum != w.checksum {
+			os.Remove(w.File.Name())
+			return fmt.Errorf("checksum mismatch for %s: want %s, have %s", w.File.Name(), w.checksum, checksum)
+		}
+	}
+	if err := os.Rename(w.File.Name(), w.path); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", w.File.Name(), w.path, err)
+	}
+	return nil
+}
+
+func (w *localFileWriter) CloseWithError(err error) error {
+	w.File.Close()
+	return err
+}
+
+func (w *localFileWriter) Abort(err error) error {
+	w.File.Close()
+	os.Remove(w.File.Name())
+	return err
+}
@@ -0,0 +1,251 @@
+package schema
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func init() {
+	ArchiveStoreRegister("pod", func(kubeClient *kube.Client) (ArchiveStore, error) {
+		if kubeClient == nil {
+			return nil, fmt.Errorf("pod archives need a kube client")
+		}
+		return &PodArchiveStore{KubeClient: kubeClient}, nil
+	})
+}
+
+// PodArchiveStore keeps archives in a folder on a kube pod
+type PodArchiveStore struct {
+	KubeClient *kube.Client
+}
+
+func (s *PodArchiveStore) podGet(archive *Archive) (*corev1.Pod, error) {
+	pod, err := s.KubeClient.PodGetByName(archive.KubeNamespace, archive.KubeName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get pod: %v", err)
+	}
+	return pod, nil
+}
+
+func (s *PodArchiveStore) List(archive *Archive) ([]*ArchiveFile, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	core.Log.Warnf("fetching file list for pod archive %s", archive.Spec)
+	podFileStats, err := s.KubeClient.LsSizes(archive.Path, pod, archive.KubeContainer)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for podSpec %s: %v", archive.Spec, err)
+	}
+
+	sidecars, err := s.KubeClient.FilesCat(archive.Path, ArchiveFileChecksumSuffix, pod, archive.KubeContainer)
+	if err != nil {
+		return nil, fmt.Errorf("could not read checksums for podSpec %s: %v", archive.Spec, err)
+	}
+	checksums := archiveFileChecksumsParse(sidecars)
+
+	files := make([]*ArchiveFile, 0, len(podFileStats))
+	for _, podFileStat := range podFileStats {
+		files = append(files, &ArchiveFile{
+			Archive:  archive,
+			Name:     podFileStat.Name,
+			Size:     podFileStat.Size,
+			Checksum: checksums[podFileStat.Name],
+		})
+	}
+	return files, nil
+}
+
+func (s *PodArchiveStore) SidecarsRead(archive *Archive, suffix string) ([]byte, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+	content, err := s.KubeClient.FilesCat(archive.Path, suffix, pod, archive.KubeContainer)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s files for podSpec %s: %v", suffix, archive.Spec, err)
+	}
+	return []byte(content), nil
+}
+
+func (s *PodArchiveStore) Stat(archive *Archive, fileName string) (*ArchiveFileStat, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := archive.Path + "/" + fileName
+	fileStat, err := s.KubeClient.Stat(pod, archive.KubeContainer, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stats for %s: %v", filePath, err)
+	}
+	return &ArchiveFileStat{Name: fileName, Size: fileStat.Size}, nil
+}
+
+func (s *PodArchiveStore) Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := archive.Path + "/" + fileName
+	return pipeFileReaderNew(func(dst io.Writer) error {
+		if err := s.KubeClient.FileReadAt(filePath, offset, dst, pod, archive.KubeContainer); err != nil {
+			return fmt.Errorf("trouble with file read while copying file from kube: %v", err)
+		}
+		return nil
+	}), nil
+}
+
+func (s *PodArchiveStore) Create(archive *Archive, fileName string) (ArchiveFileWriter, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.KubeClient.MkDir(archive.Path, pod, archive.KubeContainer); err != nil {
+		return nil, fmt.Errorf("could not make directory '%s' on %s: %v", archive.Path, pod.Name, err)
+	}
+
+	// write to a temp file and move it into place when done
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	return pipeFileWriterNew(
+		func(src io.Reader) error {
+			return s.KubeClient.FileWrite(src, tempPath, pod, archive.KubeContainer)
+		},
+		func() error {
+			if _, err := s.KubeClient.Mv(tempPath, filePath, pod, archive.KubeContainer); err != nil {
+				return fmt.Errorf("could not move %s to %s: %v", tempPath, filePath, err)
+			}
+			return nil
+		},
+		func() {
+			s.KubeClient.Rm(tempPath, pod, archive.KubeContainer)
+		}), nil
+}
+
+func (s *PodArchiveStore) PartialSize(archive *Archive, fileName string) (int64, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return 0, err
+	}
+
+	tempPath := archive.Path + "/" + fileName + ArchiveFileTempSuffix
+	fileStat, err := s.KubeClient.StatIfExists(pod, archive.KubeContainer, tempPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not get stats for %s: %v", tempPath, err)
+	}
+	if fileStat == nil {
+		return 0, nil
+	}
+	return fileStat.Size, nil
+}
+
+func (s *PodArchiveStore) Resume(archive *Archive, fileName string, offset int64, checksum string) (ArchiveFileWriter, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 {
+		if _, err := s.KubeClient.MkDir(archive.Path, pod, archive.KubeContainer); err != nil {
+			return nil, fmt.Errorf("could not make directory '%s' on %s: %v", archive.Path, pod.Name, err)
+		}
+	}
+
+	filePath := archive.Path + "/" + fileName
+	tempPath := filePath + ArchiveFileTempSuffix
+	return pipeFileWriterNew(
+		func(src io.Reader) error {
+			return s.KubeClient.FileWriteAt(src, tempPath, offset, pod, archive.KubeContainer)
+		},
+		func() error {
+			tempChecksum, err := s.KubeClient.MD5Sum(pod, archive.KubeContainer, tempPath)
+			if err != nil {
+				return fmt.Errorf("could not get md5 for %s: %v", tempPath, err)
+			}
+			if tempChecksum != checksum {
+				// the partial is bad. start over next time.
+				s.KubeClient.Rm(tempPath, pod, archive.KubeContainer)
+				return fmt.Errorf("checksum mismatch for %s on %s: want %s, have %s", tempPath, pod.Name, checksum, tempChecksum)
+			}
+			if _, err := s.KubeClient.Mv(tempPath, filePath, pod, archive.KubeContainer); err != nil {
+				return fmt.Errorf("could not move %s to %s: %v", tempPath, filePath, err)
+			}
+			return nil
+		},
+		func() {
+			s.KubeClient.Rm(tempPath, pod, archive.KubeContainer)
+		}), nil
+}
+
+func (s *PodArchiveStore) Remove(archive *Archive, fileName string) error {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return err
+	}
+
+	filePath := archive.Path + "/" + fileName
+	if _, err := s.KubeClient.Rm(filePath, pod, archive.KubeContainer); err != nil {
+		return fmt.Errorf("could not remove %s: %v", filePath, err)
+	}
+	return nil
+}
+
+func (s *PodArchiveStore) Checksum(archive *Archive, fileName string) (string, error) {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return "", err
+	}
+
+	filePath := archive.Path + "/" + fileName
+	hash, err := s.KubeClient.MD5Sum(pod, archive.KubeContainer, filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not get md5 for %s: %v", filePath, err)
+	}
+	return hash, nil
+}
+
+func (s *PodArchiveStore) Clear(archive *Archive) error {
+	pod, err := s.podGet(archive)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.KubeClient.Rm(archive.Path, pod, archive.KubeContainer); err != nil {
+		return fmt.Errorf("cound not clear the content of the restore folder: %v", err)
+	}
+	if _, err := s.KubeClient.MkDir(archive.Path, pod, archive.KubeContainer); err != nil {
+		return fmt.Errorf("cound not create the restore folder: %v", err)
+	}
+	return nil
+}
+
+func (s *PodArchiveStore) Link(src, dst *ArchiveFile) error {
+	// can only link files on the same pod
+	if !src.Archive.IsPod() ||
+		src.Archive.KubeName != dst.Archive.KubeName ||
+		src.Archive.KubeNamespace != dst.Archive.KubeNamespace {
+		return fmt.Errorf("can only stage files on the same "+
+			"pod. trying to stage %s on %s",
+			src.Archive.Spec,
+			dst.Archive.KubeName)
+	}
+
+	pod, err := s.podGet(dst.Archive)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.KubeClient.Ln(src.Path(), dst.Path(), pod, dst.Archive.KubeContainer); err != nil {
+		return fmt.Errorf("cound not create symlink: src %s to %s: %v",
+			src.Path(), dst.Path(), err)
+	}
+	return nil
+}
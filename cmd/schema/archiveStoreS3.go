@@ -0,0 +1,99 @@
+package schema
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"github.com/jkassis/jerriedr/cmd/s3"
+)
+
+func init() {
+	ArchiveStoreRegister("s3", func(kubeClient *kube.Client) (ArchiveStore, error) {
+		s3Client, err := s3.ClientGet()
+		if err != nil {
+			return nil, fmt.Errorf("could not get s3 client: %v", err)
+		}
+		return &S3ArchiveStore{S3Client: s3Client}, nil
+	})
+}
+
+// S3ArchiveStore keeps archives under a prefix of an s3 bucket
+type S3ArchiveStore struct {
+	S3Client *s3.Client
+}
+
+func (s *S3ArchiveStore) List(archive *Archive) ([]*ArchiveFile, error) {
+	core.Log.Warnf("fetching file list for s3 archive %s", archive.Spec)
+	objects, err := s.S3Client.List(archive.Bucket, archive.S3Key(""))
+	if err != nil {
+		return nil, fmt.Errorf("could not list files for s3Spec %s: %v", archive.Spec, err)
+	}
+
+	files := make([]*ArchiveFile, 0, len(objects))
+	for _, object := range objects {
+		file := &ArchiveFile{Archive: archive, Name: path.Base(object.Key), Size: object.Size}
+		if !strings.Contains(object.ETag, "-") {
+			file.Checksum = object.ETag
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (s *S3ArchiveStore) Stat(archive *Archive, fileName string) (*ArchiveFileStat, error) {
+	key := archive.S3Key(fileName)
+	object, err := s.S3Client.Head(archive.Bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stats for s3://%s/%s: %v", archive.Bucket, key, err)
+	}
+	return &ArchiveFileStat{Name: fileName, Size: object.Size}, nil
+}
+
+func (s *S3ArchiveStore) Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error) {
+	return s.S3Client.Get(archive.Bucket, archive.S3Key(fileName), offset)
+}
+
+// Create needs no temp object. S3 only shows an object once the put or
+// multipart upload completes, and Put aborts the upload when src fails.
+func (s *S3ArchiveStore) Create(archive *Archive, fileName string) (ArchiveFileWriter, error) {
+	key := archive.S3Key(fileName)
+	return pipeFileWriterNew(func(src io.Reader) error {
+		return s.S3Client.Put(archive.Bucket, key, src)
+	}, nil, nil), nil
+}
+
+func (s *S3ArchiveStore) Remove(archive *Archive, fileName string) error {
+	return s.S3Client.Delete(archive.Bucket, archive.S3Key(fileName))
+}
+
+// Checksum uses the etag when it is the md5 of the object. Multipart
+// uploads have etags of the form <md5 of md5s>-<parts>, so for those we
+// have to read the object.
+func (s *S3ArchiveStore) Checksum(archive *Archive, fileName string) (string, error) {
+	key := archive.S3Key(fileName)
+	object, err := s.S3Client.Head(archive.Bucket, key)
+	if err != nil {
+		return "", fmt.Errorf("could not get md5 for s3://%s/%s: %v", archive.Bucket, key, err)
+	}
+	if object.ETag != "" && !strings.Contains(object.ETag, "-") {
+		return object.ETag, nil
+	}
+
+	body, err := s.S3Client.Get(archive.Bucket, key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", fmt.Errorf("could not read s3://%s/%s for md5: %v", archive.Bucket, key, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
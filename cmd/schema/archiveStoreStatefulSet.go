@@ -0,0 +1,170 @@
+package schema
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"golang.org/x/sync/errgroup"
+)
+
+func init() {
+	ArchiveStoreRegister("statefulset", func(kubeClient *kube.Client) (ArchiveStore, error) {
+		if kubeClient == nil {
+			return nil, fmt.Errorf("statefulset archives need a kube client")
+		}
+		return &StatefulSetArchiveStore{
+			KubeClient: kubeClient,
+			PodStore:   &PodArchiveStore{KubeClient: kubeClient},
+		}, nil
+	})
+}
+
+// StatefulSetArchiveStore spreads an archive over the pods of a
+// statefulset. Files live on the pods, so reads go through the pod
+// archives and writes go to every replica.
+type StatefulSetArchiveStore struct {
+	KubeClient *kube.Client
+	PodStore   *PodArchiveStore
+}
+
+// ReplicaArchivesGet returns the pod archive of each replica
+func (s *StatefulSetArchiveStore) ReplicaArchivesGet(archive *Archive) ([]*Archive, error) {
+	replicas, err := archive.Replicas(s.KubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	podArchives := make([]*Archive, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		podArchive, err := archive.PodArchiveGet(i)
+		if err != nil {
+			return nil, fmt.Errorf("could not get podArchiveSpec from statefulSetArchiveSpec: %v", err)
+		}
+		podArchives = append(podArchives, podArchive)
+	}
+	return podArchives, nil
+}
+
+// List returns the files of every replica. Each file belongs to the
+// archive of its pod.
+func (s *StatefulSetArchiveStore) List(archive *Archive) ([]*ArchiveFile, error) {
+	podArchives, err := s.ReplicaArchivesGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*ArchiveFile, 0)
+	filesMutex := sync.Mutex{}
+	eg := errgroup.Group{}
+	for _, podArchive := range podArchives {
+		podArchive := podArchive
+		eg.Go(func() error {
+			podFiles, err := s.PodStore.List(podArchive)
+			if err != nil {
+				return fmt.Errorf("could not get files for %s of %s: %v", podArchive.Spec, archive.Spec, err)
+			}
+			filesMutex.Lock()
+			files = append(files, podFiles...)
+			filesMutex.Unlock()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s *StatefulSetArchiveStore) Stat(archive *Archive, fileName string) (*ArchiveFileStat, error) {
+	return nil, fmt.Errorf("cannot stat %s in statefulset archive %s. use the archive of a pod", fileName, archive.Spec)
+}
+
+func (s *StatefulSetArchiveStore) Open(archive *Archive, fileName string, offset int64) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("cannot copy from statefulset archiveFile %s/%s. use the archive of a pod", archive.Spec, fileName)
+}
+
+func (s *StatefulSetArchiveStore) Checksum(archive *Archive, fileName string) (string, error) {
+	return "", fmt.Errorf("cannot checksum %s in statefulset archive %s. use the archive of a pod", fileName, archive.Spec)
+}
+
+// Create writes the file to every replica through one writer. Failure of
+// any replica fails them all. ArchiveFileCopy uses the replica archives
+// directly instead to verify and report on each replica.
+func (s *StatefulSetArchiveStore) Create(archive *Archive, fileName string) (ArchiveFileWriter, error) {
+	podArchives, err := s.ReplicaArchivesGet(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	podWriters := make([]ArchiveFileWriter, 0, len(podArchives))
+	for _, podArchive := range podArchives {
+		podWriter, err := s.PodStore.Create(podArchive, fileName)
+		if err != nil {
+			for _, podWriter := range podWriters {
+				podWriter.Abort(err)
+			}
+			return nil, err
+		}
+		podWriters = append(podWriters, podWriter)
+	}
+	return &multiFileWriter{fileWriters: podWriters}, nil
+}
+
+func (s *StatefulSetArchiveStore) Remove(archive *Archive, fileName string) error {
+	podArchives, err := s.ReplicaArchivesGet(archive)
+	if err != nil {
+		return err
+	}
+
+	eg := errgroup.Group{}
+	for _, podArchive := range podArchives {
+		podArchive := podArchive
+		eg.Go(func() error {
+			return s.PodStore.Remove(podArchive, fileName)
+		})
+	}
+	return eg.Wait()
+}
+
+// multiFileWriter writes to several ArchiveFileWriters at once
+type multiFileWriter struct {
+	fileWriters []ArchiveFileWriter
+}
+
+func (w *multiFileWriter) Write(p []byte) (int, error) {
+	for _, fileWriter := range w.fileWriters {
+		if _, err := fileWriter.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *multiFileWriter) Close() error {
+	var errs []error
+	for _, fileWriter := range w.fileWriters {
+		if err := fileWriter.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d writes failed: %v", len(errs), len(w.fileWriters), errs)
+	}
+	return nil
+}
+
+func (w *multiFileWriter) CloseWithError(err error) error {
+	for _, fileWriter := range w.fileWriters {
+		fileWriter.CloseWithError(err)
+	}
+	return err
+}
+
+func (w *multiFileWriter) Abort(err error) error {
+	for _, fileWriter := range w.fileWriters {
+		fileWriter.Abort(err)
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stages of an env that hold or produce snapshots
+const (
+	EnvStageService = "service"
+	EnvStageSnap    = "snap"
+	EnvStageBackup  = "backup"
+)
+
+// Env is a named environment declared in the conf file. It lists the
+// specs of its services and of the archives for each stage.
+type Env struct {
+	Name           string   `yaml:"name"`
+	Services       []string `yaml:"services,omitempty"`
+	SnapArchives   []string `yaml:"snapArchives,omitempty"`
+	BackupArchives []string `yaml:"backupArchives,omitempty"`
+
+	// RestoreServices overrides Services when restoring snapshots
+	// taken from another env. It is keyed by the name of the src env.
+	RestoreServices map[string][]string `yaml:"restoreServices,omitempty"`
+
+	// Retention is the policy used to prune the archives of a stage. It
+	// is keyed by the stage.
+	Retention map[string]*RetentionPolicy `yaml:"retention,omitempty"`
+}
+
+// ServiceSetGet returns the ServiceSet for the env. srcEnvName is the
+// name of the env that produced the snapshot to restore, if any.
+func (e *Env) ServiceSetGet(srcEnvName string) (*ServiceSet, error) {
+	serviceSpecs := e.Services
+	if restoreServiceSpecs, ok := e.RestoreServices[srcEnvName]; ok {
+		serviceSpecs = restoreServiceSpecs
+	}
+	if len(serviceSpecs) == 0 {
+		return nil, fmt.Errorf("env '%s' has no services", e.Name)
+	}
+
+	serviceSet := ServiceSetNew()
+	if err := serviceSet.ServiceAddAll(serviceSpecs); err != nil {
+		return nil, fmt.Errorf("env '%s': %w", e.Name, err)
+	}
+	return serviceSet, nil
+}
+
+// ArchiveSpecsGet returns the archive specs for the stage
+func (e *Env) ArchiveSpecsGet(stage string) ([]string, error) {
+	switch stage {
+	case EnvStageSnap:
+		return e.SnapArchives, nil
+	case EnvStageBackup:
+		return e.BackupArchives, nil
+	}
+	return nil, fmt.Errorf("'%s' is not an archive stage. must be %s | %s", stage, EnvStageSnap, EnvStageBackup)
+}
+
+// RetentionGet returns the retention policy for the archives of the stage
+func (e *Env) RetentionGet(stage string) (*RetentionPolicy, error) {
+	if _, err := e.ArchiveSpecsGet(stage); err != nil {
+		return nil, err
+	}
+	policy, ok := e.Retention[stage]
+	if !ok || policy == nil {
+		return nil, fmt.Errorf("env '%s' has no retention for %s archives", e.Name, stage)
+	}
+	return policy, nil
+}
+
+// ArchiveSetGet returns the ArchiveSet for the stage
+func (e *Env) ArchiveSetGet(stage string) (*ArchiveSet, error) {
+	archiveSpecs, err := e.ArchiveSpecsGet(stage)
+	if err != nil {
+		return nil, err
+	}
+	if len(archiveSpecs) == 0 {
+		return nil, fmt.Errorf("env '%s' has no %s archives", e.Name, stage)
+	}
+
+	archiveSet := ArchiveSetNew()
+	if err := archiveSet.ArchiveAddAll(archiveSpecs, ""); err != nil {
+		return nil, fmt.Errorf("env '%s': %w", e.Name, err)
+	}
+	return archiveSet, nil
+}
+
+// Validate parses every spec in the env and returns all problems found
+func (e *Env) Validate() (errs []error) {
+	for _, serviceSpec := range e.Services {
+		if err := ServiceNew().Parse(serviceSpec); err != nil {
+			errs = append(errs, fmt.Errorf("env '%s': services: %w", e.Name, err))
+		}
+	}
+
+	for srcEnvName, serviceSpecs := range e.RestoreServices {
+		for _, serviceSpec := range serviceSpecs {
+			if err := ServiceNew().Parse(serviceSpec); err != nil {
+				errs = append(errs, fmt.Errorf("env '%s': restoreServices '%s': %w", e.Name, srcEnvName, err))
+			}
+		}
+	}
+
+	for _, stage := range []string{EnvStageSnap, EnvStageBackup} {
+		archiveSpecs, _ := e.ArchiveSpecsGet(stage)
+		for _, archiveSpec := range archiveSpecs {
+			if err := ArchiveNew().Parse(archiveSpec); err != nil {
+				errs = append(errs, fmt.Errorf("env '%s': %s archives: %w", e.Name, stage, err))
+			}
+		}
+	}
+
+	for stage, policy := range e.Retention {
+		if _, err := e.ArchiveSpecsGet(stage); err != nil {
+			errs = append(errs, fmt.Errorf("env '%s': retention: %w", e.Name, err))
+			continue
+		}
+		if policy == nil {
+			errs = append(errs, fmt.Errorf("env '%s': retention for %s archives is empty", e.Name, stage))
+			continue
+		}
+		if err := policy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("env '%s': retention for %s archives: %w", e.Name, stage, err))
+		}
+	}
+
+	return errs
+}
+
+func EnvConfNew() *EnvConf {
+	envConf := &EnvConf{}
+	envConf.Envs = make(map[string]*Env)
+	return envConf
+}
+
+// EnvConf holds all envs declared in the conf file
+type EnvConf struct {
+	Envs map[string]*Env
+}
+
+// EnvGet returns the env with the given name
+func (ec *EnvConf) EnvGet(name string) (*Env, error) {
+	env, ok := ec.Envs[name]
+	if !ok {
+		return nil, fmt.Errorf("could not find env '%s' have only these... %v", name, ec.EnvNames())
+	}
+	return env, nil
+}
+
+// EnvNames returns the sorted names of all envs
+func (ec *EnvConf) EnvNames() []string {
+	envNames := make([]string, 0, len(ec.Envs))
+	for envName := range ec.Envs {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+	return envNames
+}
+
+// Validate validates every env and checks references between envs
+func (ec *EnvConf) Validate() (errs []error) {
+	if len(ec.Envs) == 0 {
+		return []error{fmt.Errorf("conf declares no envs")}
+	}
+
+	for _, envName := range ec.EnvNames() {
+		env := ec.Envs[envName]
+		errs = append(errs, env.Validate()...)
+		for srcEnvName := range env.RestoreServices {
+			if _, ok := ec.Envs[srcEnvName]; !ok {
+				errs = append(errs, fmt.Errorf("env '%s': restoreServices refers to unknown env '%s'", envName, srcEnvName))
+			}
+		}
+	}
+	return errs
+}
+
+// EnvStageParse splits a ref of the form <env>:<stage>
+func EnvStageParse(ref string) (envName, stage string, err error) {
+	parts := strings.Split(ref, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%s must be <env>:<stage> where <stage> => %s | %s | %s",
+			ref, EnvStageSnap, EnvStageBackup, EnvStageService)
+	}
+	envName, stage = parts[0], parts[1]
+	switch stage {
+	case EnvStageSnap, EnvStageBackup, EnvStageService:
+		return envName, stage, nil
+	}
+	return "", "", fmt.Errorf("%s must be <env>:<stage> where <stage> => %s | %s | %s: %s",
+		ref, EnvStageSnap, EnvStageBackup, EnvStageService, stage)
+}
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/jkassis/jerrie/core"
@@ -11,41 +12,30 @@ import (
 )
 
 // EnvCopy gets a list of source snapshots, prompts the user
-// to select one and copies the snapshot to the destination env.
-func EnvCopy(kubeClient *kube.Client, srcArchiveSpecs, dstArchiveSpecs []string) {
-	var err error
-
-	// get src and dst archiveSets
-	var srcArchiveSet, dstArchiveSet *ArchiveSet
-	{
-		srcArchiveSet = ArchiveSetNew()
-		err := srcArchiveSet.ArchiveAddAll(srcArchiveSpecs, "/backup")
-		if err != nil {
-			core.Log.Fatalf("could not add srcArchive %v", err)
-		}
-
-		dstArchiveSet = ArchiveSetNew()
-		err = dstArchiveSet.ArchiveAddAll(dstArchiveSpecs, "")
-		if err != nil {
-			core.Log.Fatalf("could not add dstArchive %v", err)
-		}
-	}
-
+// to select one (or picks one as told by pick) and copies the snapshot
+// to the destination env.
+// files already at the destination are skipped and interrupted copies
+// resume, so it is safe to run again after a failure.
+func EnvCopy(kubeClient *kube.Client, srcArchiveSet, dstArchiveSet *ArchiveSet, pick *SnapshotPick) {
 	// pick a snapshot set
-	srcArchiveFileSet, err := srcArchiveSet.PickSnapshot(kubeClient)
+	srcArchiveFileSet, err := srcArchiveSet.PickSnapshot(kubeClient, pick)
 	if err != nil {
 		core.Log.Fatalf("snapshot not picked... cancelling operation: %v", err)
 	}
 
 	// present a progressWatcher
 	progressWatcher := ui.ProgressWatcherNew()
-	go progressWatcher.Run()
+	if PlanRecordingGet() == nil {
+		go progressWatcher.Run()
+	}
 
 	// copy files
+	stats := &ArchiveFileCopyStats{}
 	{
 		core.Log.Warnf("snapshotGet: starting")
 		start := time.Now()
 		errGroup := errgroup.Group{}
+		statsMutex := sync.Mutex{}
 		for _, srcArchiveFile := range srcArchiveFileSet.ArchiveFiles {
 			srcArchiveFile := srcArchiveFile
 			dstArchive, err := dstArchiveSet.ArchiveGetByService(srcArchiveFile.Archive.ServiceName)
@@ -59,7 +49,10 @@ func EnvCopy(kubeClient *kube.Client, srcArchiveSpecs, dstArchiveSpecs []string)
 			}
 
 			errGroup.Go(func() error {
-				err := ArchiveFileCopy(kubeClient, srcArchiveFile, dstArchiveFile, progressWatcher)
+				fileStats, err := ArchiveFileCopy(kubeClient, srcArchiveFile, dstArchiveFile, progressWatcher)
+				statsMutex.Lock()
+				stats.Add(fileStats)
+				statsMutex.Unlock()
 				if err != nil {
 					return fmt.Errorf("could not copy archive file: %v", err)
 				}
@@ -69,7 +62,9 @@ func EnvCopy(kubeClient *kube.Client, srcArchiveSpecs, dstArchiveSpecs []string)
 
 		err := errGroup.Wait()
 		if err != nil {
-			core.Log.Fatalf("problem with copy: %v", err)
+			progressWatcher.App.Stop()
+			core.Log.Fatalf("problem with copy (copied %d, resumed %d, skipped %d files): %v",
+				stats.Copied, stats.Resumed, stats.Skipped, err)
 		}
 
 		duration := time.Since(start)
@@ -77,6 +72,9 @@ func EnvCopy(kubeClient *kube.Client, srcArchiveSpecs, dstArchiveSpecs []string)
 	}
 
 	progressWatcher.App.Stop()
+	if PlanRecordingGet() != nil {
+		return
+	}
 
 	// report at the end
 	for _, watch := range progressWatcher.Watches {
@@ -88,4 +86,5 @@ func EnvCopy(kubeClient *kube.Client, srcArchiveSpecs, dstArchiveSpecs []string)
 			watch.Item)
 		core.Log.Warnf(message)
 	}
+	fmt.Printf("copied %d, resumed %d, skipped %d files\n", stats.Copied, stats.Resumed, stats.Skipped)
 }
@@ -0,0 +1,179 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"golang.org/x/sync/errgroup"
+)
+
+// ArchiveFileSetVerdict is what a RetentionPolicy decided for a snapshot
+type ArchiveFileSetVerdict struct {
+	ArchiveFileSet *ArchiveFileSet
+
+	// Keep names the generations that keep the set, or why it is kept
+	// anyway. "" if the set is dropped.
+	Keep string
+}
+
+// PrunePlan lists the snapshots of an ArchiveSet with their verdicts and
+// the files to delete for the dropped ones
+type PrunePlan struct {
+	Verdicts []*ArchiveFileSetVerdict
+	Files    []*ArchiveFile
+}
+
+// PrunePlanMake applies policy to the snapshot sets of as, which must have
+// its files fetched. Sets are kept or dropped whole. A file is only
+// deleted if no kept set has a copy of it, so a kept set is never left
+// partial. Sets that are not usable do not count towards any generation.
+// They are kept unless dropBroken, since they may be all that is left of
+// a period and need a person to look at them. Ones newer than every
+// usable set are kept anyway, since a snapshot still being written looks
+// the same. Pinned sets are always kept.
+func PrunePlanMake(as *ArchiveSet, policy *RetentionPolicy, dropBroken bool) *PrunePlan {
+	plan := &PrunePlan{}
+
+	// get every set, most recent first
+	as.SeekTo(time.Now())
+	for {
+		archiveFileSet := as.ArchiveFileSetGetNext()
+		if archiveFileSet == nil {
+			break
+		}
+		plan.Verdicts = append(plan.Verdicts, &ArchiveFileSetVerdict{ArchiveFileSet: archiveFileSet})
+	}
+
+	// apply the policy to the usable sets
+	usable := make([]*ArchiveFileSetVerdict, 0, len(plan.Verdicts))
+	times := make([]time.Time, 0, len(plan.Verdicts))
+	for _, verdict := range plan.Verdicts {
+		if verdict.ArchiveFileSet.Status == SSSStatusError {
+			if len(usable) == 0 {
+				verdict.Keep = "newer than any usable snapshot"
+			} else if !dropBroken {
+				verdict.Keep = "broken"
+			}
+			continue
+		}
+		_, last := verdict.ArchiveFileSet.FirstAndLastArchiveFileTime()
+		usable = append(usable, verdict)
+		times = append(times, last)
+	}
+	for i, keep := range policy.Keep(times) {
+		usable[i].Keep = keep
+	}
+
+	// pinned sets are kept whatever the policy says
+	for _, verdict := range plan.Verdicts {
+		if !verdict.ArchiveFileSet.IsPinned() {
+			continue
+		}
+		if verdict.Keep == "" {
+			verdict.Keep = "pinned"
+		} else {
+			verdict.Keep += ",pinned"
+		}
+	}
+
+	// collect the copies of files of kept sets
+	kept := make(map[*ArchiveFile]bool)
+	for _, verdict := range plan.Verdicts {
+		if verdict.Keep == "" {
+			continue
+		}
+		for _, archiveFile := range verdict.ArchiveFileSet.ArchiveFiles {
+			for _, file := range archiveFile.CopiesGet() {
+				kept[file] = true
+			}
+		}
+	}
+
+	// delete the copies of files of dropped sets that are not kept
+	dropped := make(map[*ArchiveFile]bool)
+	for _, verdict := range plan.Verdicts {
+		if verdict.Keep != "" {
+			continue
+		}
+		for _, archiveFile := range verdict.ArchiveFileSet.ArchiveFiles {
+			for _, file := range archiveFile.CopiesGet() {
+				if kept[file] || dropped[file] {
+					continue
+				}
+				dropped[file] = true
+				plan.Files = append(plan.Files, file)
+			}
+		}
+	}
+
+	return plan
+}
+
+// String lists the verdict for each snapshot and the files to delete
+func (p *PrunePlan) String() string {
+	b := strings.Builder{}
+	for _, verdict := range p.Verdicts {
+		_, last := verdict.ArchiveFileSet.FirstAndLastArchiveFileTime()
+		keep := "drop"
+		if verdict.Keep != "" {
+			keep = "keep (" + verdict.Keep + ")"
+		}
+		fmt.Fprintf(&b, "%s  %s\n", last.Format(time.RFC3339), keep)
+	}
+	fmt.Fprintf(&b, "%d of %d snapshots dropped, %d files to delete\n", p.DroppedCount(), len(p.Verdicts), len(p.Files))
+	for _, file := range p.Files {
+		fmt.Fprintf(&b, "  %s/%s\n", file.Archive.Spec, file.Name)
+	}
+	return b.String()
+}
+
+// DroppedCount returns the number of snapshots the plan drops
+func (p *PrunePlan) DroppedCount() (n int) {
+	for _, verdict := range p.Verdicts {
+		if verdict.Keep == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Run deletes the files of the plan with their sidecars through the
+// stores of their archives
+func (p *PrunePlan) Run(kubeClient *kube.Client) error {
+	errGroup := errgroup.Group{}
+	for _, file := range p.Files {
+		file := file
+		errGroup.Go(func() error {
+			return archiveFileRemove(kubeClient, file)
+		})
+	}
+	return errGroup.Wait()
+}
+
+// archiveFileRemove deletes the file and then its sidecars, so a failure
+// never leaves a file without its meta
+func archiveFileRemove(kubeClient *kube.Client, file *ArchiveFile) error {
+	if planned(PlanOpRemove, file.Spec(), nil, "", func() string {
+		return fmt.Sprintf("rm %s and its sidecars in %s", file.Path(), file.Archive.Spec)
+	}) {
+		return nil
+	}
+
+	store, err := file.Archive.StoreGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	if err := store.Remove(file.Archive, file.Name); err != nil {
+		return fmt.Errorf("could not remove %s/%s: %w", file.Archive.Spec, file.Name, err)
+	}
+	for _, suffix := range []string{ArchiveFileChecksumSuffix, ArchiveFileMetaSuffix} {
+		if err := store.Remove(file.Archive, file.Name+suffix); err != nil {
+			core.Log.Debugf("could not remove sidecar %s/%s%s: %v", file.Archive.Spec, file.Name, suffix, err)
+		}
+	}
+	core.Log.Warnf("removed %s/%s", file.Archive.Spec, file.Name)
+	return nil
+}
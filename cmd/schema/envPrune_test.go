@@ -0,0 +1,204 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pruneTestBase is well before now, so every test snapshot is in the past
+var pruneTestBase = time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+// pruneTestSnap is a snapshot to lay out in the archives of pruneTestSetMake
+type pruneTestSnap struct {
+	ago         time.Duration // before pruneTestBase
+	id          string        // "" for files from before snapshot ids
+	broken      bool          // the file of svc-b is empty
+	pinned      bool
+	pinnedUntil time.Duration // from now, if not 0
+	services    string        // the services with a file. "" is all of them
+}
+
+// pruneTestSetMake makes an ArchiveSet with a local archive for svc-a and
+// a statefulset archive for svc-b with replicas svc-b-0 and svc-b-1, and lays
+// out the files of snaps in them
+func pruneTestSetMake(t *testing.T, snaps []pruneTestSnap) *ArchiveSet {
+	as := ArchiveSetNew()
+	local, err := as.ArchiveAdd("local|svc-a|/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sts, err := as.ArchiveAdd("statefulset|ns/svc-b|/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := make([]*Archive, 0)
+	for _, pod := range []string{"svc-b-0", "svc-b-1"} {
+		replica := ArchiveNew()
+		if err := replica.Parse("pod|ns/svc-b/" + pod + "|/backup"); err != nil {
+			t.Fatal(err)
+		}
+		replica.Parent = sts
+		replicas = append(replicas, replica)
+	}
+
+	for _, snap := range snaps {
+		at := pruneTestBase.Add(-snap.ago)
+		fileMake := func(archive *Archive, size int64) *ArchiveFile {
+			file := &ArchiveFile{Archive: archive, Name: at.Format(time.RFC3339) + ".bak", Time: at, Size: size}
+			if snap.id == "" && !snap.pinned && snap.pinnedUntil == 0 {
+				return file
+			}
+			file.Meta = &ArchiveFileMeta{Name: file.Name, SnapshotID: snap.id, Size: size, Pinned: snap.pinned}
+			if snap.pinnedUntil != 0 {
+				until := time.Now().Add(snap.pinnedUntil)
+				file.Meta.PinnedUntil = &until
+			}
+			return file
+		}
+		if snap.services == "" || strings.Contains(snap.services, "a") {
+			local.Files = append(local.Files, fileMake(local, 10))
+		}
+		if snap.services == "" || strings.Contains(snap.services, "b") {
+			size := int64(10)
+			if snap.broken {
+				size = 0
+			}
+			for _, replica := range replicas {
+				sts.Files = append(sts.Files, fileMake(replica, size))
+			}
+		}
+	}
+
+	for _, archive := range as.Archives {
+		sort.Sort(ByMostRecent(archive.Files))
+		archive.Filter()
+	}
+	return as
+}
+
+// pruneTestVerdicts writes the verdicts of plan as "<ago> <keep>"
+func pruneTestVerdicts(plan *PrunePlan) []string {
+	verdicts := make([]string, 0, len(plan.Verdicts))
+	for _, verdict := range plan.Verdicts {
+		_, last := verdict.ArchiveFileSet.FirstAndLastArchiveFileTime()
+		keep := verdict.Keep
+		if keep == "" {
+			keep = "drop"
+		}
+		verdicts = append(verdicts, fmt.Sprintf("%s %s", pruneTestBase.Sub(last), keep))
+	}
+	return verdicts
+}
+
+// pruneTestFiles writes the files of plan as "<archive spec>/<ago>"
+func pruneTestFiles(plan *PrunePlan) []string {
+	files := make([]string, 0, len(plan.Files))
+	for _, file := range plan.Files {
+		files = append(files, fmt.Sprintf("%s/%s", file.Archive.Spec, pruneTestBase.Sub(file.Time)))
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestPrunePlanMake(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     RetentionPolicy
+		dropBroken bool
+		snaps      []pruneTestSnap
+		verdicts   []string
+		files      []string
+	}{
+		{
+			name:     "latest",
+			policy:   RetentionPolicy{Latest: 2},
+			snaps:    []pruneTestSnap{{ago: 0, id: "s0"}, {ago: time.Hour, id: "s1"}, {ago: 2 * time.Hour, id: "s2"}},
+			verdicts: []string{"0s latest", "1h0m0s latest", "2h0m0s drop"},
+			files: []string{
+				"local|svc-a|/backup/2h0m0s",
+				"pod|ns/svc-b/svc-b-0|/backup/2h0m0s",
+				"pod|ns/svc-b/svc-b-1|/backup/2h0m0s",
+			},
+		},
+		{
+			name:     "broken sets are kept",
+			policy:   RetentionPolicy{Latest: 1},
+			snaps:    []pruneTestSnap{{ago: 0, id: "s0"}, {ago: time.Hour, id: "s1", broken: true}, {ago: 2 * time.Hour, id: "s2"}},
+			verdicts: []string{"0s latest", "1h0m0s broken", "2h0m0s drop"},
+			files: []string{
+				"local|svc-a|/backup/2h0m0s",
+				"pod|ns/svc-b/svc-b-0|/backup/2h0m0s",
+				"pod|ns/svc-b/svc-b-1|/backup/2h0m0s",
+			},
+		},
+		{
+			name:       "broken sets are dropped with dropBroken",
+			policy:     RetentionPolicy{Latest: 1},
+			dropBroken: true,
+			snaps:      []pruneTestSnap{{ago: 0, id: "s0"}, {ago: time.Hour, id: "s1", broken: true}},
+			verdicts:   []string{"0s latest", "1h0m0s drop"},
+			files: []string{
+				"local|svc-a|/backup/1h0m0s",
+				"pod|ns/svc-b/svc-b-0|/backup/1h0m0s",
+				"pod|ns/svc-b/svc-b-1|/backup/1h0m0s",
+			},
+		},
+		{
+			name:       "broken sets do not count towards a generation",
+			policy:     RetentionPolicy{Latest: 2},
+			dropBroken: true,
+			snaps:      []pruneTestSnap{{ago: 0, id: "s0"}, {ago: time.Hour, id: "s1", services: "a"}, {ago: 2 * time.Hour, id: "s2"}},
+			verdicts:   []string{"0s latest", "1h0m0s drop", "2h0m0s latest"},
+			files:      []string{"local|svc-a|/backup/1h0m0s"},
+		},
+		{
+			name:       "sets newer than any usable set are kept with dropBroken",
+			policy:     RetentionPolicy{Latest: 1},
+			dropBroken: true,
+			snaps:      []pruneTestSnap{{ago: 0, id: "s0", services: "b"}, {ago: time.Hour, id: "s1"}},
+			verdicts:   []string{"0s newer than any usable snapshot", "1h0m0s latest"},
+			files:      []string{},
+		},
+		{
+			name:   "pinned sets are kept",
+			policy: RetentionPolicy{Latest: 1},
+			snaps: []pruneTestSnap{
+				{ago: 0, id: "s0", pinned: true},
+				{ago: time.Hour, id: "s1", pinned: true},
+				{ago: 2 * time.Hour, id: "s2", pinnedUntil: time.Hour},
+				{ago: 3 * time.Hour, id: "s3", pinnedUntil: -time.Hour},
+			},
+			verdicts: []string{"0s latest,pinned", "1h0m0s pinned", "2h0m0s pinned", "3h0m0s drop"},
+			files: []string{
+				"local|svc-a|/backup/3h0m0s",
+				"pod|ns/svc-b/svc-b-0|/backup/3h0m0s",
+				"pod|ns/svc-b/svc-b-1|/backup/3h0m0s",
+			},
+		},
+		{
+			// files without ids are grouped by time, so the file of svc-b
+			// at 1h leads the broken set at 1h and is in the kept set at 0
+			name:       "a dropped set does not take the files of a kept set",
+			policy:     RetentionPolicy{Latest: 1},
+			dropBroken: true,
+			snaps:      []pruneTestSnap{{ago: 0, services: "a"}, {ago: time.Hour, services: "b"}},
+			verdicts:   []string{"0s latest", "1h0m0s drop"},
+			files:      []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := PrunePlanMake(pruneTestSetMake(t, test.snaps), &test.policy, test.dropBroken)
+			if verdicts := pruneTestVerdicts(plan); strings.Join(verdicts, "; ") != strings.Join(test.verdicts, "; ") {
+				t.Errorf("verdicts are %q, want %q", verdicts, test.verdicts)
+			}
+			if files := pruneTestFiles(plan); strings.Join(files, "; ") != strings.Join(test.files, "; ") {
+				t.Errorf("files are %q, want %q", files, test.files)
+			}
+		})
+	}
+}
@@ -1,37 +1,25 @@
 package schema
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/kube"
+	"golang.org/x/sync/errgroup"
 )
 
-func EnvRestore(kubeClient *kube.Client, srcArchiveSpecs, dstServiceSpecs []string) {
+// EnvRestore restores a snapshot picked from srcArchiveSet to the
+// services of dstServiceSet and records it in journal. Unless safety is
+// nil, it first snapshots the services the restore resets as told by
+// safety, so the restore can be rolled back.
+func EnvRestore(kubeClient *kube.Client, srcArchiveSet *ArchiveSet, dstServiceSet *ServiceSet, pick *SnapshotPick, safety *RestoreSafety, journal *RestoreJournal) {
 	var err error
 
-	// get srcArchiveSet from specs
-	var srcArchiveSet *ArchiveSet
-	{
-		srcArchiveSet = ArchiveSetNew()
-		err := srcArchiveSet.ArchiveAddAll(srcArchiveSpecs, "")
-		if err != nil {
-			core.Log.Fatalf("could not add srcArchive %v", err)
-		}
-	}
-
-	// get dstServiceSet from specs
-	var dstServiceSet *ServiceSet
-	{
-		dstServiceSet = ServiceSetNew()
-		err = dstServiceSet.ServiceAddAll(dstServiceSpecs)
-		if err != nil {
-			core.Log.Fatalf("could not add dstArchive %v", err)
-		}
-	}
-
 	// User picks the snapshot
-	srcArchiveFileSet, err := srcArchiveSet.PickSnapshot(kubeClient)
+	srcArchiveFileSet, err := srcArchiveSet.PickSnapshot(kubeClient, pick)
 	if err != nil {
-		core.Log.Fatalf("snapshot not picked... cancelling operation")
+		core.Log.Fatalf("snapshot not picked... cancelling operation: %v", err)
 	}
 
 	// narrow down the dstServiceSet to those with references in the srcArchiveFileSet
@@ -42,47 +30,276 @@ func EnvRestore(kubeClient *kube.Client, srcArchiveSpecs, dstServiceSpecs []stri
 			if err != nil {
 				core.Log.Fatalf("could not find dstService to match srcArchiveFile '%s': %v", srcArchiveFile.Name, err)
 			}
+			if _, err := newDstServiceSet.ServiceGetByName(dstService.Name); err == nil {
+				continue
+			}
 			newDstServiceSet.ServiceAdd(dstService)
 		}
 		dstServiceSet = newDstServiceSet
 	}
 
-	// Prepare all endpoints
-	if err = dstServiceSet.DoOncePerEndpoint(
-		func(dstService *Service) (err error) {
-			if err = dstService.StartStop(kubeClient, false); err != nil {
+	// show the manifest and check it against the dstServices
+	for _, srcArchiveFile := range srcArchiveFileSet.ArchiveFiles {
+		meta := srcArchiveFile.Meta
+		if meta == nil {
+			core.Log.Warnf("%s/%s has no manifest", srcArchiveFile.Archive.Spec, srcArchiveFile.Name)
+			continue
+		}
+		core.Log.Warnf("manifest: %s", meta)
+
+		dstService, _ := dstServiceSet.ServiceGetByName(srcArchiveFile.Archive.ServiceName)
+		imageDigest, err := dstService.ImageDigestGet(kubeClient)
+		if err != nil {
+			core.Log.Warnf("could not get image digest for %s: %v", dstService.Spec, err)
+		} else if imageDigest != "" && meta.ImageDigest != "" && imageDigest != meta.ImageDigest {
+			core.Log.Warnf("%s runs image %s but %s was taken with image %s",
+				dstService.Spec, imageDigest, srcArchiveFile.Name, meta.ImageDigest)
+		}
+	}
+
+	// record the restore and snapshot the target before touching it
+	journal.SnapshotID = srcArchiveFileSet.SnapshotID()
+	_, journal.SnapshotTime = srcArchiveFileSet.FirstAndLastArchiveFileTime()
+	journal.Files = archiveFileSpecs(srcArchiveFileSet.ArchiveFiles)
+	if safety == nil {
+		core.Log.Warnf("skipping the pre-restore snapshot. this restore cannot be rolled back")
+	} else if err = envRestoreSafetySnap(kubeClient, dstServiceSet.Services, safety, journal); err != nil {
+		core.Log.Fatalf("could not take the pre-restore snapshot... cancelling operation: %v", err)
+	}
+	if err = journal.Put(); err != nil {
+		core.Log.Fatalf("could not record restore... cancelling operation: %v", err)
+	}
+	core.Log.Warnf("restore journal %s", journal.ID)
+
+	// lay out the steps and run them
+	if err = journal.StepsPlan(dstServiceSet, srcArchiveFileSet); err != nil {
+		core.Log.Fatalf("could not plan restore... cancelling operation: %v", err)
+	}
+	if err = journal.Put(); err != nil {
+		core.Log.Fatalf("could not record restore... cancelling operation: %v", err)
+	}
+	if err = EnvRestoreResume(kubeClient, journal); err != nil {
+		core.Log.Fatalf("restore %s stopped: %v. services may be left paused. fix the cause and run: jerriedr restore resume %s",
+			journal.ID, err, journal.ID)
+	}
+	if PlanRecordingGet() != nil {
+		return
+	}
+	if journal.SafetySnapshotID != "" {
+		core.Log.Warnf("restore %s done. to roll back: jerriedr restore rollback %s", journal.ID, journal.ID)
+	}
+}
+
+// EnvRestoreResume runs the steps of journal that are not done, in order.
+// Services and files are parsed from the specs in the journal, so it
+// works the same for a new restore and one picked up after a crash. It
+// stops at the first step that fails. While a plan is recording, the
+// steps are recorded into it one after another instead.
+func EnvRestoreResume(kubeClient *kube.Client, journal *RestoreJournal) error {
+	services := make(map[string]*Service)
+	files := make(map[string]*ArchiveFile)
+	for _, step := range journal.Steps {
+		if _, ok := services[step.Service]; !ok {
+			service := ServiceNew()
+			if err := service.Parse(step.Service); err != nil {
+				return err
+			}
+			services[step.Service] = service
+		}
+		if _, ok := files[step.File]; step.File != "" && (!ok || len(step.Copies) > 0) {
+			file, err := step.fileParse(journal.SnapshotID)
+			if err != nil {
 				return err
 			}
-			if err = dstService.WaitForDrain(kubeClient); err != nil {
+			files[step.File] = file
+		}
+	}
+
+	// record the steps into the plan one after another
+	if plan := PlanRecordingGet(); plan != nil {
+		plan.Journal = journal
+		plan.JournalDir = journal.dir
+		for i, step := range journal.Steps {
+			if step.Status == RestoreStepDone {
+				continue
+			}
+			plan.stepSet(i + 1)
+			if err := envRestoreStepDo(kubeClient, step, services[step.Service], files[step.File]); err != nil {
 				return err
 			}
-			return dstService.Reset(kubeClient)
-		}); err != nil {
-		core.Log.Fatal(err)
+		}
+		plan.stepSet(0)
+		return nil
 	}
 
-	// for each archiveFile
-	for _, srcArchiveFile := range srcArchiveFileSet.ArchiveFiles {
-		dstService, _ := dstServiceSet.ServiceGetByName(srcArchiveFile.Archive.ServiceName)
+	return envRestoreStepsRun(journal, func(i int, step *RestoreStep) error {
+		return envRestoreStepDo(kubeClient, step, services[step.Service], files[step.File])
+	})
+}
+
+// envRestoreStepsRun runs the steps of journal that are not done with do,
+// records their progress in journal and sets it finished at the end.
+// Steps of endpoints in the same phase run together.
+func envRestoreStepsRun(journal *RestoreJournal, do func(i int, step *RestoreStep) error) error {
+	for i := 0; i < len(journal.Steps); {
+		if journal.Steps[i].Status == RestoreStepDone {
+			i++
+			continue
+		}
 
-		// do this one at a time.
-		if err = dstService.Stage(kubeClient, srcArchiveFile); err != nil {
-			core.Log.Fatalf("could not stage %s to %s: %v", srcArchiveFile.Name, dstService.Spec, err)
+		// run steps of endpoints in the same phase together
+		batch := []int{i}
+		for i++; i < len(journal.Steps) && journal.Steps[batch[0]].IsConcurrent() && journal.Steps[i].Phase == journal.Steps[batch[0]].Phase; i++ {
+			if journal.Steps[i].Status != RestoreStepDone {
+				batch = append(batch, i)
+			}
 		}
 
-		if err = dstService.Restore(kubeClient); err != nil {
-			core.Log.Fatalf("could not restore %s to %s: %v", srcArchiveFile.Name, dstService.Spec, err)
+		eg := errgroup.Group{}
+		for _, j := range batch {
+			j := j
+			eg.Go(func() error {
+				return envRestoreStepRun(journal, journal.Steps[j], func() error {
+					return do(j, journal.Steps[j])
+				})
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return err
 		}
 	}
 
-	// Restart all endpoints
-	if err = dstServiceSet.DoOncePerEndpoint(
-		func(dstService *Service) (err error) {
-			if err = dstService.RAFTReset(kubeClient); err != nil {
-				return err
-			}
-			return dstService.StartStop(kubeClient, true)
-		}); err != nil {
-		core.Log.Fatal(err)
+	journal.Finished = time.Now()
+	return journal.Put()
+}
+
+// envRestoreStepRun runs one step with do and records its progress in
+// journal
+func envRestoreStepRun(journal *RestoreJournal, step *RestoreStep, do func() error) error {
+	if err := journal.stepUpdate(step, func(step *RestoreStep) {
+		step.Status = RestoreStepRunning
+		step.Started = time.Now()
+		step.Finished = time.Time{}
+		step.Error = ""
+	}); err != nil {
+		return err
 	}
+	core.Log.Warnf("restore: %s %s %s", step.Phase, step.Service, step.File)
+
+	err := do()
+	if err != nil {
+		err = fmt.Errorf("could not %s %s: %w", step.Phase, step.Service, err)
+	}
+
+	if putErr := journal.stepUpdate(step, func(step *RestoreStep) {
+		step.Finished = time.Now()
+		if err != nil {
+			step.Status = RestoreStepFailed
+			step.Error = err.Error()
+		} else {
+			step.Status = RestoreStepDone
+		}
+	}); putErr != nil && err == nil {
+		err = putErr
+	}
+	return err
+}
+
+// envRestoreStepDo does what the phase of step does to service
+func envRestoreStepDo(kubeClient *kube.Client, step *RestoreStep, service *Service, file *ArchiveFile) error {
+	switch step.Phase {
+	case RestorePhasePause:
+		return service.Pause(kubeClient)
+	case RestorePhaseDrain:
+		return service.WaitForDrain(kubeClient)
+	case RestorePhaseReset:
+		return service.Reset(kubeClient)
+	case RestorePhaseStage:
+		return service.Stage(kubeClient, file)
+	case RestorePhaseRestore:
+		return service.Restore(kubeClient)
+	case RestorePhaseRAFTReset:
+		return service.RAFTReset(kubeClient)
+	case RestorePhaseResume:
+		return service.Resume(kubeClient)
+	}
+	return fmt.Errorf("unknown restore phase '%s'", step.Phase)
+}
+
+// envRestoreSafetySnap snapshots the endpoints of the services a restore
+// resets and pins the snapshot for safety.PinFor so prune keeps it
+func envRestoreSafetySnap(kubeClient *kube.Client, services []*Service, safety *RestoreSafety, journal *RestoreJournal) error {
+	services = envRestoreSafetyServices(services, safety)
+	snapshotID, files, err := EnvSnap(kubeClient, services, safety.SnapArchiveSet, safety.Timeout)
+	if err != nil {
+		return err
+	}
+
+	label := journal.SafetyLabel()
+	if !planned(PlanOpPin, snapshotID, []string{label, safety.PinFor.String()}, "", func() string {
+		if safety.PinFor == 0 {
+			return fmt.Sprintf("label the files of snapshot %s %s and pin them", snapshotID, label)
+		}
+		return fmt.Sprintf("label the files of snapshot %s %s and pin them for %s", snapshotID, label, safety.PinFor)
+	}) {
+		sss := ArchiveFileSetNew()
+		for _, file := range files {
+			sss.ArchiveFileAdd(file)
+		}
+		if err = archiveFileSetPin(kubeClient, sss, label, safety.PinFor); err != nil {
+			return fmt.Errorf("could not pin snapshot %s: %w", snapshotID, err)
+		}
+	}
+
+	journal.SafetySrc = safety.Src
+	journal.SafetySnapshotID = snapshotID
+	journal.SafetyFiles = archiveFileSpecs(files)
+	journal.SafetyServices = make([]string, 0, len(services))
+	for _, service := range services {
+		journal.SafetyServices = append(journal.SafetyServices, service.Spec)
+	}
+	core.Log.Warnf("took pre-restore snapshot %s in %s", snapshotID, safety.Src)
+	return nil
+}
+
+// envRestoreSafetyServices returns the services to snapshot before a
+// restore resets services. Services that share an endpoint are one
+// server, so each endpoint is snapped once. It is snapped as the service
+// of the target env at that endpoint, if there is one, since the snap
+// archives of the env are for its own services and not for the restore
+// services of another env.
+func envRestoreSafetyServices(services []*Service, safety *RestoreSafety) []*Service {
+	envServices := make(map[string]*Service)
+	if safety.Services != nil {
+		for _, service := range safety.Services.EndpointServicesGet() {
+			envServices[service.EndpointKey()] = service
+		}
+	}
+
+	serviceSet := ServiceSetNew()
+	for _, service := range services {
+		serviceSet.ServiceAdd(service)
+	}
+	safetyServices := make([]*Service, 0)
+	for _, service := range serviceSet.EndpointServicesGet() {
+		if envService, ok := envServices[service.EndpointKey()]; ok {
+			service = envService
+		}
+		safetyServices = append(safetyServices, service)
+	}
+	return safetyServices
+}
+
+// archiveFileSetPin labels the files of sss and pins them for pinFor, or
+// until unpinned if pinFor is 0
+func archiveFileSetPin(kubeClient *kube.Client, sss *ArchiveFileSet, label string, pinFor time.Duration) error {
+	until := time.Now().Add(pinFor)
+	return ArchiveFileMetaUpdate(kubeClient, sss, func(meta *ArchiveFileMeta) {
+		meta.LabelAdd(label)
+		if pinFor == 0 {
+			meta.Pinned = true
+		} else {
+			meta.PinnedUntil = &until
+		}
+	})
 }
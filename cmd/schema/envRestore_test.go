@@ -0,0 +1,89 @@
+package schema
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// envTestConfGet reads the envs of the conf shipped with jerriedr
+func envTestConfGet(t *testing.T) *EnvConf {
+	v := viper.New()
+	v.SetConfigFile("../jerriedr.yaml")
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	envConf := EnvConfNew()
+	if err := v.UnmarshalKey("envs", &envConf.Envs); err != nil {
+		t.Fatal(err)
+	}
+	for envName, env := range envConf.Envs {
+		env.Name = envName
+	}
+	return envConf
+}
+
+func TestEnvRestoreSafetySnap(t *testing.T) {
+	env, err := envTestConfGet(t).EnvGet("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstServiceSet, err := env.ServiceSetGet("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapArchiveSet, err := env.ArchiveSetGet(EnvStageSnap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceSet, err := env.ServiceSetGet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	safety := &RestoreSafety{
+		SnapArchiveSet: snapArchiveSet,
+		Services:       serviceSet,
+		Src:            "dev:snap",
+		Timeout:        time.Minute,
+		PinFor:         14 * 24 * time.Hour,
+	}
+
+	// record the snapshot of the dev server before a restore of prod
+	plan := PlanNew("restore --from prod:backup --to dev:service")
+	PlanRecord(plan)
+	defer PlanRecord(nil)
+	journal := RestoreJournalNew(t.TempDir(), "prod:backup", "dev:service")
+	if err := envRestoreSafetySnap(nil, dstServiceSet.Services, safety, journal); err != nil {
+		t.Fatal(err)
+	}
+
+	// the six prod services share the one dev server. it is snapped once,
+	// into its own snap archive.
+	snaps := make([]*PlanAction, 0)
+	for _, action := range plan.Actions {
+		if action.Op == PlanOpSnap {
+			snaps = append(snaps, action)
+		}
+	}
+	if len(snaps) != 1 {
+		t.Fatalf("took %d snaps, want 1: %v", len(snaps), plan)
+	}
+	if snaps[0].Target != env.Services[0] || snaps[0].Args[1] != env.SnapArchives[0] {
+		t.Errorf("snapped %s into %s, want %s into %s", snaps[0].Target, snaps[0].Args[1], env.Services[0], env.SnapArchives[0])
+	}
+
+	// a rollback restores the snapshot to the service it was taken of
+	rollbackServiceSet, err := journal.SafetyServiceSetGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollbackServiceSet.Services) != 1 {
+		t.Fatalf("rolls back %d services, want 1", len(rollbackServiceSet.Services))
+	}
+	for _, service := range rollbackServiceSet.Services {
+		if _, err := snapArchiveSet.ArchiveGetByService(service.Name); err != nil {
+			t.Errorf("cannot roll back %s: %v", service.Spec, err)
+		}
+	}
+}
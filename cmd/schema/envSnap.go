@@ -1,21 +1,68 @@
 package schema
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/kube"
 	"golang.org/x/sync/errgroup"
 )
 
-func EnvSnap(kubeClient *kube.Client, services []*Service) (err error) {
+// EnvSnap snaps every service with one backup request UUID, waits up to
+// timeout for the files in snapArchiveSet and tags them with it, so they
+// group as one snapshot. The tag is the meta of each file and together
+// they are the manifest of the snapshot. It returns the files.
+func EnvSnap(kubeClient *kube.Client, services []*Service, snapArchiveSet *ArchiveSet, timeout time.Duration) (snapshotID string, files []*ArchiveFile, err error) {
+	snapshotID = uuid.NewString()
+	core.Log.Warnf("taking snapshot %s", snapshotID)
+
 	// establish an errgroup
 	eg := errgroup.Group{}
+	filesMutex := sync.Mutex{}
 
 	// start backups on podServices
 	for _, service := range services {
 		service := service
+		snapArchive, err := snapArchiveSet.ArchiveGetByService(service.Name)
+		if err != nil {
+			return snapshotID, nil, err
+		}
 		eg.Go(func() error {
-			return service.Snap(kubeClient)
+			serviceFiles, err := envSnapService(kubeClient, service, snapshotID, snapArchive, timeout)
+			if err != nil {
+				return err
+			}
+			filesMutex.Lock()
+			files = append(files, serviceFiles...)
+			filesMutex.Unlock()
+			return nil
 		})
 	}
 
-	return eg.Wait()
+	err = eg.Wait()
+	return snapshotID, files, err
+}
+
+// envSnapService snaps service into snapArchive and tags the files
+func envSnapService(kubeClient *kube.Client, service *Service, snapshotID string, snapArchive *Archive, timeout time.Duration) ([]*ArchiveFile, error) {
+	if planned(PlanOpSnap, service.Spec, []string{snapshotID, snapArchive.Spec, timeout.String()}, "", func() string {
+		return fmt.Sprintf("snapshot %s: %s, wait up to %s for the files in %s and tag them",
+			snapshotID, service.backupNote(kubeClient), timeout, snapArchive.Spec)
+	}) {
+		return nil, nil
+	}
+
+	files, err := service.Snap(kubeClient, snapshotID, snapArchive, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if err := ArchiveFileTag(kubeClient, file, snapshotID, service); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
 }
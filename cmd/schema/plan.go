@@ -0,0 +1,350 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	"github.com/jkassis/jerriedr/cmd/ui"
+)
+
+// Plan lists in order what a command does to services and archives.
+// While a plan is recording, every operation that changes a service or an
+// archive adds an action to it instead of running: requests to services,
+// pausing, staging, snapping, copying, removing and writing metas. Reads
+// still run, so the actions name the real pods, files and endpoints.
+// A plan written out can be run later as it is.
+//
+// The actions of a restore belong to the steps of its journal, so a
+// restore run from a plan is journaled, resumable and can be rolled back
+// like any other.
+type Plan struct {
+	Command string        `json:"command"`
+	Created time.Time     `json:"created"`
+	Actions []*PlanAction `json:"actions"`
+
+	// Journal is the journal of a restore plan. JournalDir is where it is
+	// kept when the plan runs.
+	Journal    *RestoreJournal `json:"journal,omitempty"`
+	JournalDir string          `json:"journalDir,omitempty"`
+
+	step      int
+	snapshots map[string][]*ArchiveFile // files of the snaps of a run
+	mutex     sync.Mutex
+}
+
+// PlanAction is one operation of a plan. Target is the spec of the
+// service or archive file it acts on. Step is the index of the journal
+// step of a restore it belongs to, counting from 1, or 0 for actions
+// outside the steps. Note says what the action does in terms of pods,
+// paths and URLs.
+type PlanAction struct {
+	Step   int      `json:"step,omitempty"`
+	Op     string   `json:"op"`
+	Target string   `json:"target"`
+	Args   []string `json:"args,omitempty"`
+	Body   string   `json:"body,omitempty"`
+	Note   string   `json:"note"`
+}
+
+// ops of a PlanAction
+const (
+	PlanOpPause     = "pause"
+	PlanOpResume    = "resume"
+	PlanOpDrain     = "drain"
+	PlanOpReset     = "reset"
+	PlanOpClear     = "clear"
+	PlanOpLink      = "link"
+	PlanOpStage     = "stage"
+	PlanOpRestore   = "restore"
+	PlanOpRAFTReset = "raftReset"
+	PlanOpSnap      = "snap"
+	PlanOpPin       = "pin"
+	PlanOpCopy      = "copy"
+	PlanOpRemove    = "remove"
+	PlanOpMeta      = "meta"
+)
+
+// planRecording is the plan being recorded, or nil
+var planRecording *Plan
+
+// PlanNew makes an empty plan for command
+func PlanNew(command string) *Plan {
+	return &Plan{
+		Command: command,
+		Created: time.Now(),
+		Actions: make([]*PlanAction, 0),
+	}
+}
+
+// PlanRecord makes operations record their actions in plan instead of
+// running. nil makes them run again.
+func PlanRecord(plan *Plan) {
+	planRecording = plan
+}
+
+// PlanRecordingGet returns the plan being recorded, or nil
+func PlanRecordingGet() *Plan {
+	return planRecording
+}
+
+// planned records an action if a plan is recording and reports if it did.
+// note is only made when it is needed.
+func planned(op, target string, args []string, body string, note func() string) bool {
+	plan := planRecording
+	if plan == nil {
+		return false
+	}
+	plan.record(op, target, args, body, note())
+	return true
+}
+
+func (p *Plan) record(op, target string, args []string, body, note string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Actions = append(p.Actions, &PlanAction{
+		Step:   p.step,
+		Op:     op,
+		Target: target,
+		Args:   args,
+		Body:   body,
+		Note:   note,
+	})
+}
+
+// PlanGet reads a plan written by Put
+func PlanGet(path string) (*Plan, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read plan %s: %w", path, err)
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(content, plan); err != nil {
+		return nil, fmt.Errorf("could not parse plan %s: %w", path, err)
+	}
+	return plan, nil
+}
+
+// Put writes the plan to path as JSON
+func (p *Plan) Put(path string) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("could not write plan %s: %w", path, err)
+	}
+	return nil
+}
+
+// String lists the actions in order under the steps they belong to
+func (p *Plan) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "plan for %s made %s\n", p.Command, p.Created.Format(time.RFC3339))
+	if j := p.Journal; j != nil {
+		fmt.Fprintf(&b, "restore %s of %s to %s: snapshot %s of %s\n",
+			j.ID, j.Src, j.Dst, j.SnapshotID, j.SnapshotTime.Format(time.RFC3339))
+		if j.SafetySnapshotID != "" {
+			fmt.Fprintf(&b, "pre-restore snapshot %s in %s\n", j.SafetySnapshotID, j.SafetySrc)
+		}
+	}
+	actionsWrite := func(step int) (n int) {
+		for i, action := range p.Actions {
+			if action.Step == step {
+				fmt.Fprintf(&b, "  %d. %s: %s\n", i+1, action.Op, action.Note)
+				n++
+			}
+		}
+		return n
+	}
+
+	if p.Journal == nil {
+		if actionsWrite(0) == 0 {
+			fmt.Fprintln(&b, "nothing to do")
+		}
+		return b.String()
+	}
+
+	fmt.Fprintln(&b, "before the restore:")
+	if actionsWrite(0) == 0 {
+		fmt.Fprintln(&b, "  nothing to do")
+	}
+	for i, step := range p.Journal.Steps {
+		fmt.Fprintf(&b, "step %d: %s %s\n", i+1, step.Phase, step.Service)
+		if step.Status == RestoreStepDone {
+			fmt.Fprintln(&b, "  done already")
+		} else if actionsWrite(i+1) == 0 {
+			fmt.Fprintln(&b, "  nothing to do for this service")
+		}
+	}
+	return b.String()
+}
+
+// Run does the actions of the plan in order and stops at the first that
+// fails. A restore plan writes its journal and runs its actions as the
+// steps of the journal. If the journal is there already, the restore was
+// started before and picks up at its first step not done.
+func (p *Plan) Run(kubeClient *kube.Client) error {
+	p.snapshots = make(map[string][]*ArchiveFile)
+	if p.Journal == nil {
+		return p.stepRun(kubeClient, 0)
+	}
+
+	journal, err := RestoreJournalGet(p.JournalDir, p.Journal.ID)
+	if err == nil {
+		if !journal.Finished.IsZero() {
+			return fmt.Errorf("restore %s of this plan is done", journal.ID)
+		}
+		core.Log.Warnf("restore %s of this plan was started before: %s", journal.ID, journal.State())
+	} else {
+		journal = p.Journal
+		journal.dir = p.JournalDir
+		journal.Started = time.Now()
+		if err := p.stepRun(kubeClient, 0); err != nil {
+			return err
+		}
+		if journal.SafetySnapshotID != "" {
+			journal.SafetyFiles = archiveFileSpecs(p.snapshots[journal.SafetySnapshotID])
+		}
+		if err := journal.Put(); err != nil {
+			return err
+		}
+		core.Log.Warnf("restore journal %s", journal.ID)
+	}
+
+	return envRestoreStepsRun(journal, func(i int, step *RestoreStep) error {
+		return p.stepRun(kubeClient, i+1)
+	})
+}
+
+// stepRun does the actions of a step in order
+func (p *Plan) stepRun(kubeClient *kube.Client, step int) error {
+	for i, action := range p.Actions {
+		if action.Step != step {
+			continue
+		}
+		core.Log.Warnf("plan: %d. %s %s", i+1, action.Op, action.Note)
+		if err := action.run(kubeClient, p); err != nil {
+			return fmt.Errorf("action %d. %s %s failed: %w", i+1, action.Op, action.Target, err)
+		}
+	}
+	return nil
+}
+
+// run does the action by calling what recorded it
+func (a *PlanAction) run(kubeClient *kube.Client, plan *Plan) error {
+	switch a.Op {
+	case PlanOpCopy, PlanOpRemove, PlanOpMeta:
+		file := &ArchiveFile{}
+		if err := file.Parse(a.Target); err != nil {
+			return err
+		}
+		switch a.Op {
+		case PlanOpCopy:
+			if len(a.Args) != 1 {
+				return fmt.Errorf("copy needs the src file")
+			}
+			srcFile := &ArchiveFile{}
+			if err := srcFile.Parse(a.Args[0]); err != nil {
+				return err
+			}
+			_, err := ArchiveFileCopy(kubeClient, srcFile, file, ui.ProgressWatcherNew())
+			return err
+		case PlanOpRemove:
+			return archiveFileRemove(kubeClient, file)
+		default:
+			meta := &ArchiveFileMeta{}
+			if err := json.Unmarshal([]byte(a.Body), meta); err != nil {
+				return fmt.Errorf("could not parse meta: %w", err)
+			}
+			store, err := file.Archive.StoreGet(kubeClient)
+			if err != nil {
+				return err
+			}
+			return ArchiveFileMetaPut(store, file, meta)
+		}
+	case PlanOpPin:
+		if len(a.Args) == 0 {
+			return fmt.Errorf("pin needs the label")
+		}
+		// plans from before pins expired have no duration
+		var pinFor time.Duration
+		if len(a.Args) > 1 {
+			var err error
+			if pinFor, err = time.ParseDuration(a.Args[1]); err != nil {
+				return fmt.Errorf("could not parse pin duration: %v", err)
+			}
+		}
+		sss := ArchiveFileSetNew()
+		for _, file := range plan.snapshots[a.Target] {
+			sss.ArchiveFileAdd(file)
+		}
+		return archiveFileSetPin(kubeClient, sss, a.Args[0], pinFor)
+	}
+
+	service := ServiceNew()
+	if err := service.Parse(a.Target); err != nil {
+		return err
+	}
+	switch a.Op {
+	case PlanOpPause:
+		return service.Pause(kubeClient)
+	case PlanOpResume:
+		return service.Resume(kubeClient)
+	case PlanOpDrain:
+		return service.WaitForDrain(kubeClient)
+	case PlanOpReset:
+		return service.Reset(kubeClient)
+	case PlanOpRestore:
+		return service.Restore(kubeClient)
+	case PlanOpRAFTReset:
+		return service.RAFTReset(kubeClient)
+	case PlanOpClear:
+		return service.stageClear(kubeClient)
+	case PlanOpLink, PlanOpStage:
+		if len(a.Args) != 1 {
+			return fmt.Errorf("%s needs the src file", a.Op)
+		}
+		srcFile := &ArchiveFile{}
+		if err := srcFile.Parse(a.Args[0]); err != nil {
+			return err
+		}
+		if a.Op == PlanOpLink {
+			return service.stageLink(kubeClient, srcFile)
+		}
+		return service.stageCopy(kubeClient, srcFile)
+	case PlanOpSnap:
+		if len(a.Args) != 3 {
+			return fmt.Errorf("snap needs the snapshot id, snap archive and timeout")
+		}
+		snapArchive := ArchiveNew()
+		if err := snapArchive.Parse(a.Args[1]); err != nil {
+			return err
+		}
+		timeout, err := time.ParseDuration(a.Args[2])
+		if err != nil {
+			return err
+		}
+		files, err := envSnapService(kubeClient, service, a.Args[0], snapArchive, timeout)
+		if err != nil {
+			return err
+		}
+		plan.mutex.Lock()
+		plan.snapshots[a.Args[0]] = append(plan.snapshots[a.Args[0]], files...)
+		plan.mutex.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unknown plan op '%s'", a.Op)
+}
+
+// stepSet makes the actions recorded from now on belong to step
+func (p *Plan) stepSet(step int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.step = step
+}
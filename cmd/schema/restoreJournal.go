@@ -0,0 +1,343 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RestoreJournal records a restore so it can be rolled back. Before the
+// target services are touched, EnvRestore snapshots them into the snap
+// archives of their env and records that snapshot as the safety
+// snapshot. Restoring it puts the services back as they were.
+// The journal also lists the steps of the restore with their status and
+// is written before and after each step, so a restore that stops half
+// way can be resumed from the first step that is not done.
+type RestoreJournal struct {
+	ID         string    `json:"id"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Src        string    `json:"src"`
+	Dst        string    `json:"dst"`
+	RollbackOf string    `json:"rollbackOf,omitempty"`
+
+	// the snapshot restored
+	SnapshotID   string    `json:"snapshotID,omitempty"`
+	SnapshotTime time.Time `json:"snapshotTime"`
+	Files        []string  `json:"files"`
+
+	// the snapshot of the target taken before the restore, in SafetySrc,
+	// and the specs of the services it was taken of
+	SafetySrc        string   `json:"safetySrc,omitempty"`
+	SafetySnapshotID string   `json:"safetySnapshotID,omitempty"`
+	SafetyFiles      []string `json:"safetyFiles,omitempty"`
+	SafetyServices   []string `json:"safetyServices,omitempty"`
+
+	// Steps are the steps of the restore in order
+	Steps []*RestoreStep `json:"steps"`
+
+	dir   string
+	mutex sync.Mutex
+}
+
+// phases of a restore in the order they run
+const (
+	RestorePhasePause     = "pause"
+	RestorePhaseDrain     = "drain"
+	RestorePhaseReset     = "reset"
+	RestorePhaseStage     = "stage"
+	RestorePhaseRestore   = "restore"
+	RestorePhaseRAFTReset = "raftReset"
+	RestorePhaseResume    = "resume"
+)
+
+// states of a RestoreStep
+const (
+	RestoreStepPending = "pending"
+	RestoreStepRunning = "running"
+	RestoreStepDone    = "done"
+	RestoreStepFailed  = "failed"
+)
+
+// RestoreStep is one phase of a restore for one service. File is the
+// spec of the archive file for the stage and restore phases. Copies are
+// the specs of the copies of File on the other replicas of its
+// statefulset archive, so each pod can stage the one it has.
+type RestoreStep struct {
+	Phase    string    `json:"phase"`
+	Service  string    `json:"service"`
+	File     string    `json:"file,omitempty"`
+	Copies   []string  `json:"copies,omitempty"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// IsConcurrent is true for phases that run for all endpoints at once.
+// Files are staged and restored one at a time.
+func (step *RestoreStep) IsConcurrent() bool {
+	return step.Phase != RestorePhaseStage && step.Phase != RestorePhaseRestore
+}
+
+// RestoreSafety tells EnvRestore how to snapshot the target services
+// before it resets them. Src is the <env>:<stage> of SnapArchiveSet.
+// Services are the services of the target env, if it has any. The
+// snapshot is pinned for PinFor, or until unpinned if PinFor is 0.
+type RestoreSafety struct {
+	SnapArchiveSet *ArchiveSet
+	Services       *ServiceSet
+	Src            string
+	Timeout        time.Duration
+	PinFor         time.Duration
+}
+
+// RestoreJournalNew makes a journal for a restore from src to dst kept in dir
+func RestoreJournalNew(dir, src, dst string) *RestoreJournal {
+	return &RestoreJournal{
+		ID:      uuid.NewString(),
+		Started: time.Now(),
+		Src:     src,
+		Dst:     dst,
+		dir:     dir,
+	}
+}
+
+// RestoreJournalGet reads the journal with id from dir. id may be any
+// unique prefix of the id.
+func RestoreJournalGet(dir, id string) (*RestoreJournal, error) {
+	journals, err := RestoreJournalsList(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *RestoreJournal
+	for _, journal := range journals {
+		if !strings.HasPrefix(journal.ID, id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("'%s' matches more than one restore journal in %s", id, dir)
+		}
+		found = journal
+	}
+	if found == nil {
+		return nil, fmt.Errorf("could not find restore journal '%s' in %s", id, dir)
+	}
+	return found, nil
+}
+
+// RestoreJournalsList reads all journals in dir, most recent first
+func RestoreJournalsList(dir string) ([]*RestoreJournal, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	journals := make([]*RestoreJournal, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read restore journal %s: %w", path, err)
+		}
+		journal := &RestoreJournal{dir: dir}
+		if err := json.Unmarshal(content, journal); err != nil {
+			return nil, fmt.Errorf("could not parse restore journal %s: %w", path, err)
+		}
+		journals = append(journals, journal)
+	}
+	sort.Slice(journals, func(i, j int) bool {
+		return journals[i].Started.After(journals[j].Started)
+	})
+	return journals, nil
+}
+
+// Put writes the journal to its dir. It goes to a temp file first, so a
+// crash never leaves a partial journal.
+func (j *RestoreJournal) Put() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.put()
+}
+
+func (j *RestoreJournal) put() error {
+	// a recorded restore is not started, so it has no journal yet
+	if PlanRecordingGet() != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(j.dir, 0o755); err != nil {
+		return fmt.Errorf("could not make restore journal dir %s: %w", j.dir, err)
+	}
+
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, j.ID+".json")
+	if err := os.WriteFile(path+ArchiveFileTempSuffix, append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("could not write restore journal %s: %w", path, err)
+	}
+	if err := os.Rename(path+ArchiveFileTempSuffix, path); err != nil {
+		return fmt.Errorf("could not write restore journal %s: %w", path, err)
+	}
+	return nil
+}
+
+// StepsPlan lays out the steps to restore the files of sss to the services
+// of dstServiceSet. Endpoints are paused, drained and reset, then each
+// file is staged and restored, then endpoints get a raft reset and are
+// resumed.
+func (j *RestoreJournal) StepsPlan(dstServiceSet *ServiceSet, sss *ArchiveFileSet) error {
+	steps := make([]*RestoreStep, 0)
+	endpointServices := dstServiceSet.EndpointServicesGet()
+	stepAdd := func(phase, serviceSpec, fileSpec string) {
+		steps = append(steps, &RestoreStep{Phase: phase, Service: serviceSpec, File: fileSpec, Status: RestoreStepPending})
+	}
+
+	for _, phase := range []string{RestorePhasePause, RestorePhaseDrain, RestorePhaseReset} {
+		for _, service := range endpointServices {
+			stepAdd(phase, service.Spec, "")
+		}
+	}
+	for _, archiveFile := range sss.ArchiveFiles {
+		dstService, err := dstServiceSet.ServiceGetByName(archiveFile.Archive.ServiceName)
+		if err != nil {
+			return err
+		}
+		fileSpec := archiveFile.Spec()
+		stepAdd(RestorePhaseStage, dstService.Spec, fileSpec)
+		for _, file := range archiveFile.CopiesGet() {
+			if file != archiveFile {
+				steps[len(steps)-1].Copies = append(steps[len(steps)-1].Copies, file.Spec())
+			}
+		}
+		stepAdd(RestorePhaseRestore, dstService.Spec, fileSpec)
+	}
+	for _, phase := range []string{RestorePhaseRAFTReset, RestorePhaseResume} {
+		for _, service := range endpointServices {
+			stepAdd(phase, service.Spec, "")
+		}
+	}
+
+	j.Steps = steps
+	return nil
+}
+
+// fileParse parses the File of step with its Copies. The copies are put
+// back in a statefulset archive, so CopiesGet finds them. They are known
+// to hold snapshot snapshotID, if it is not "".
+func (step *RestoreStep) fileParse(snapshotID string) (*ArchiveFile, error) {
+	file := &ArchiveFile{}
+	if err := file.Parse(step.File); err != nil {
+		return nil, err
+	}
+	if len(step.Copies) == 0 {
+		return file, nil
+	}
+
+	parent := ArchiveNew()
+	parent.Scheme = "statefulset"
+	parent.ServiceName = file.Archive.ServiceName
+	parent.KubeNamespace = file.Archive.KubeNamespace
+	parent.Files = append(parent.Files, file)
+	for _, copySpec := range step.Copies {
+		copyFile := &ArchiveFile{}
+		if err := copyFile.Parse(copySpec); err != nil {
+			return nil, err
+		}
+		parent.Files = append(parent.Files, copyFile)
+	}
+	for _, f := range parent.Files {
+		f.Archive.Parent = parent
+		if snapshotID != "" {
+			f.Meta = &ArchiveFileMeta{Name: f.Name, SnapshotID: snapshotID}
+		}
+	}
+	return file, nil
+}
+
+// StepNextGet returns the index of the first step that is not done, or -1
+func (j *RestoreJournal) StepNextGet() int {
+	for i, step := range j.Steps {
+		if step.Status != RestoreStepDone {
+			return i
+		}
+	}
+	return -1
+}
+
+// State sums up where the restore stands
+func (j *RestoreJournal) State() string {
+	if !j.Finished.IsZero() {
+		return "done"
+	}
+	i := j.StepNextGet()
+	if i == -1 {
+		if len(j.Steps) == 0 {
+			return "not started"
+		}
+		return "done"
+	}
+	step := j.Steps[i]
+	return fmt.Sprintf("%s at %s %s", step.Status, step.Phase, step.Service)
+}
+
+// stepUpdate changes a step under the lock and writes the journal
+func (j *RestoreJournal) stepUpdate(step *RestoreStep, update func(step *RestoreStep)) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	update(step)
+	return j.put()
+}
+
+// ServiceSetGet returns the services the steps of the restore touch
+func (j *RestoreJournal) ServiceSetGet() (*ServiceSet, error) {
+	serviceSet := ServiceSetNew()
+	seen := make(map[string]bool)
+	for _, step := range j.Steps {
+		if seen[step.Service] {
+			continue
+		}
+		seen[step.Service] = true
+		if err := serviceSet.ServiceAddBySpec(step.Service); err != nil {
+			return nil, err
+		}
+	}
+	return serviceSet, nil
+}
+
+// SafetyServiceSetGet returns the services the safety snapshot was taken
+// of. Journals that do not list them took it of the services of the steps.
+func (j *RestoreJournal) SafetyServiceSetGet() (*ServiceSet, error) {
+	if len(j.SafetyServices) == 0 {
+		return j.ServiceSetGet()
+	}
+	serviceSet := ServiceSetNew()
+	if err := serviceSet.ServiceAddAll(j.SafetyServices); err != nil {
+		return nil, err
+	}
+	return serviceSet, nil
+}
+
+// SafetyLabel is the label of the safety snapshot of the restore
+func (j *RestoreJournal) SafetyLabel() string {
+	return "pre-restore-" + j.ID
+}
+
+func archiveFileSpecs(files []*ArchiveFile) []string {
+	specs := make([]string, 0, len(files))
+	for _, file := range files {
+		specs = append(specs, file.Spec())
+	}
+	sort.Strings(specs)
+	return specs
+}
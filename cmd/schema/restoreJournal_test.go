@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRestoreStepCopies(t *testing.T) {
+	for _, snapshotID := range []string{"s0", ""} {
+		as := pruneTestSetMake(t, []pruneTestSnap{{id: snapshotID}})
+		as.SeekTo(pruneTestBase.Add(1))
+		sss := as.ArchiveFileSetGetNext()
+
+		dstServiceSet := ServiceSetNew()
+		for _, spec := range []string{
+			"local|svc-a|8080|/v1/Backup|/v1/Restore|/restore",
+			"statefulset|ns/svc-b|8080|/v1/Backup|/v1/Restore|/restore/<pod>",
+		} {
+			if err := dstServiceSet.ServiceAddBySpec(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// plan the steps and read them back as a resume would
+		journal := &RestoreJournal{SnapshotID: snapshotID}
+		if err := journal.StepsPlan(dstServiceSet, sss); err != nil {
+			t.Fatal(err)
+		}
+		content, err := json.Marshal(journal.Steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := make([]*RestoreStep, 0)
+		if err := json.Unmarshal(content, &steps); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, step := range steps {
+			if step.Phase != RestorePhaseStage {
+				continue
+			}
+			file, err := step.fileParse(snapshotID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			service := ServiceNew()
+			if err := service.Parse(step.Service); err != nil {
+				t.Fatal(err)
+			}
+
+			if !service.IsStatefulSet() {
+				if len(step.Copies) != 0 || len(file.CopiesGet()) != 1 {
+					t.Errorf("%q: %s has copies %q", snapshotID, step.File, step.Copies)
+				}
+				continue
+			}
+
+			// each pod stages its own copy, and a pod without one the file
+			if len(step.Copies) != 1 {
+				t.Fatalf("%q: %s has copies %q, want 1", snapshotID, step.File, step.Copies)
+			}
+			copies := file.CopiesGet()
+			for i, want := range []string{"svc-b-0", "svc-b-1", file.Archive.KubeName} {
+				servicePod, err := service.ServicePodGet(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if src := servicePod.stageSrcPick(copies, file); src.Archive.KubeName != want {
+					t.Errorf("%q: %s stages %s, want the copy on %s", snapshotID, servicePod.KubeName, src.Spec(), want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy keeps grandfather-father-son generations of snapshots.
+// Each count keeps the most recent snapshot of that many of the most
+// recent hours, days, weeks and months that have one. Buckets are in UTC
+// and weeks are ISO weeks. Latest keeps that many of the most recent
+// snapshots whatever their time.
+type RetentionPolicy struct {
+	Latest  int `yaml:"latest,omitempty"`
+	Hourly  int `yaml:"hourly,omitempty"`
+	Daily   int `yaml:"daily,omitempty"`
+	Weekly  int `yaml:"weekly,omitempty"`
+	Monthly int `yaml:"monthly,omitempty"`
+}
+
+// retentionBucket names the period of a generation that t falls in
+type retentionBucket func(t time.Time) string
+
+var retentionBuckets = []struct {
+	Name   string
+	Bucket retentionBucket
+	Count  func(p *RetentionPolicy) int
+}{
+	{"hourly", func(t time.Time) string { return t.UTC().Format("2006-01-02T15") }, func(p *RetentionPolicy) int { return p.Hourly }},
+	{"daily", func(t time.Time) string { return t.UTC().Format("2006-01-02") }, func(p *RetentionPolicy) int { return p.Daily }},
+	{"weekly", func(t time.Time) string {
+		year, week := t.UTC().ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}, func(p *RetentionPolicy) int { return p.Weekly }},
+	{"monthly", func(t time.Time) string { return t.UTC().Format("2006-01") }, func(p *RetentionPolicy) int { return p.Monthly }},
+}
+
+// Validate returns an error if the policy would keep nothing
+func (p *RetentionPolicy) Validate() error {
+	counts := []int{p.Latest, p.Hourly, p.Daily, p.Weekly, p.Monthly}
+	keeps := false
+	for _, count := range counts {
+		if count < 0 {
+			return fmt.Errorf("retention counts must not be negative: %s", p)
+		}
+		if count > 0 {
+			keeps = true
+		}
+	}
+	if !keeps {
+		return fmt.Errorf("retention keeps nothing. set at least one of latest | hourly | daily | weekly | monthly")
+	}
+	return nil
+}
+
+// Keep returns for each of times, most recent first, the generations
+// that keep it joined by ",". Times the policy drops get "".
+func (p *RetentionPolicy) Keep(times []time.Time) []string {
+	reasons := make([][]string, len(times))
+	for i := 0; i < len(times) && i < p.Latest; i++ {
+		reasons[i] = append(reasons[i], "latest")
+	}
+
+	for _, generation := range retentionBuckets {
+		count := generation.Count(p)
+		buckets := make(map[string]bool)
+		for i, t := range times {
+			if len(buckets) >= count {
+				break
+			}
+			bucket := generation.Bucket(t)
+			if buckets[bucket] {
+				continue
+			}
+			buckets[bucket] = true
+			reasons[i] = append(reasons[i], generation.Name)
+		}
+	}
+
+	keep := make([]string, len(times))
+	for i := range times {
+		keep[i] = strings.Join(reasons[i], ",")
+	}
+	return keep
+}
+
+func (p *RetentionPolicy) String() string {
+	return fmt.Sprintf("latest %d, hourly %d, daily %d, weekly %d, monthly %d",
+		p.Latest, p.Hourly, p.Daily, p.Weekly, p.Monthly)
+}
@@ -0,0 +1,104 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	at := func(spec string) time.Time {
+		t, err := time.Parse(time.RFC3339, spec)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		times  []time.Time
+		keep   []string
+	}{
+		{
+			name:   "latest",
+			policy: RetentionPolicy{Latest: 2},
+			times:  []time.Time{at("2026-01-10T12:00:00Z"), at("2026-01-10T11:00:00Z"), at("2026-01-10T10:00:00Z")},
+			keep:   []string{"latest", "latest", ""},
+		},
+		{
+			name:   "hourly keeps the newest of each hour",
+			policy: RetentionPolicy{Hourly: 2},
+			times: []time.Time{
+				at("2026-01-10T12:40:00Z"), at("2026-01-10T12:10:00Z"),
+				at("2026-01-10T11:50:00Z"), at("2026-01-10T11:20:00Z"),
+				at("2026-01-10T10:30:00Z"),
+			},
+			keep: []string{"hourly", "", "hourly", "", ""},
+		},
+		{
+			name:   "daily skips days without a snapshot",
+			policy: RetentionPolicy{Daily: 2},
+			times:  []time.Time{at("2026-01-10T12:00:00Z"), at("2026-01-10T01:00:00Z"), at("2026-01-07T12:00:00Z"), at("2026-01-06T12:00:00Z")},
+			keep:   []string{"daily", "", "daily", ""},
+		},
+		{
+			name:   "days are in UTC",
+			policy: RetentionPolicy{Daily: 2},
+			times:  []time.Time{at("2026-01-10T01:00:00+02:00"), at("2026-01-09T22:00:00Z")},
+			keep:   []string{"daily", ""},
+		},
+		{
+			// 2026-01-04 is a sunday, the last day of ISO week 1
+			name:   "weekly uses ISO weeks",
+			policy: RetentionPolicy{Weekly: 2},
+			times:  []time.Time{at("2026-01-05T12:00:00Z"), at("2026-01-04T12:00:00Z"), at("2025-12-29T12:00:00Z"), at("2025-12-28T12:00:00Z")},
+			keep:   []string{"weekly", "weekly", "", ""},
+		},
+		{
+			name:   "monthly",
+			policy: RetentionPolicy{Monthly: 3},
+			times:  []time.Time{at("2026-03-01T00:00:00Z"), at("2026-02-28T00:00:00Z"), at("2026-02-01T00:00:00Z"), at("2025-12-31T00:00:00Z"), at("2025-11-30T00:00:00Z")},
+			keep:   []string{"monthly", "monthly", "", "monthly", ""},
+		},
+		{
+			name:   "generations add up",
+			policy: RetentionPolicy{Latest: 1, Hourly: 1, Daily: 2, Weekly: 1, Monthly: 2},
+			times:  []time.Time{at("2026-01-10T12:00:00Z"), at("2026-01-10T11:00:00Z"), at("2026-01-09T12:00:00Z"), at("2025-12-31T12:00:00Z")},
+			keep:   []string{"latest,hourly,daily,weekly,monthly", "", "daily", "monthly"},
+		},
+		{
+			name:   "nothing",
+			policy: RetentionPolicy{Daily: 1},
+			times:  []time.Time{},
+			keep:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep := test.policy.Keep(test.times)
+			if strings.Join(keep, "; ") != strings.Join(test.keep, "; ") || len(keep) != len(test.keep) {
+				t.Errorf("keep is %q, want %q", keep, test.keep)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy RetentionPolicy
+		ok     bool
+	}{
+		{RetentionPolicy{Daily: 7}, true},
+		{RetentionPolicy{Latest: 1, Monthly: 12}, true},
+		{RetentionPolicy{}, false},
+		{RetentionPolicy{Daily: 7, Weekly: -1}, false},
+	}
+	for _, test := range tests {
+		if err := test.policy.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: have %v, want ok %t", &test.policy, err, test.ok)
+		}
+	}
+}
@@ -1,19 +1,18 @@
 package schema
 
 import (
-	"context"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jkassis/jerrie/core"
 	"github.com/jkassis/jerriedr/cmd/http"
 	"github.com/jkassis/jerriedr/cmd/kube"
+	"github.com/jkassis/jerriedr/cmd/ui"
 	"golang.org/x/sync/errgroup"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func ServiceNew() *Service {
@@ -256,6 +255,15 @@ func (s *Service) IsStatefulSet() bool {
 	return s.Scheme == "statefulset"
 }
 
+// EndpointKey names the endpoint of the service. Kube services are their
+// own endpoint. Host and local services share one if they share a port.
+func (s *Service) EndpointKey() string {
+	if s.IsStatefulSet() || s.IsPod() {
+		return s.Scheme + "|" + s.KubeNamespace + "/" + s.KubeName
+	}
+	return s.Host + ":" + strconv.Itoa(s.Port)
+}
+
 func (s *Service) Replicas(kubeClient *kube.Client) (n int, err error) {
 	if !s.IsStatefulSet() {
 		return 0, fmt.Errorf("iterating requires a statefulset")
@@ -281,6 +289,7 @@ func (s *Service) ServicePodGet(replica int) (*Service, error) {
 		return nil, fmt.Errorf("%s is not a statefulset spec", s.Spec)
 	}
 	podName := s.KubeName + "-" + strconv.Itoa(replica)
+	restorePath := strings.ReplaceAll(s.RestorePath, "<pod>", podName)
 
 	// TODO check this
 	host := fmt.Sprintf(
@@ -292,15 +301,19 @@ func (s *Service) ServicePodGet(replica int) (*Service, error) {
 		KubeNamespace: s.KubeNamespace,
 		Name:          s.Name,
 		Port:          s.Port,
+		BackupURL:     s.BackupURL,
+		RestoreURL:    s.RestoreURL,
+		RestorePath:   restorePath,
 		Scheme:        "pod",
-		Spec: fmt.Sprintf("pod|%s|%s/%s/%s|%d|%s|%s",
+		Spec: fmt.Sprintf("pod|%s|%s/%s/%s|%d|%s|%s|%s",
 			s.Name,
 			s.KubeNamespace,
 			podName,
 			s.KubeContainer,
 			s.Port,
 			s.BackupURL,
-			s.RestoreURL),
+			s.RestoreURL,
+			restorePath),
 	}, nil
 }
 
@@ -330,16 +343,23 @@ func (s *Service) ForEachServicePod(
 func (s *Service) RequestsInFlight(kubeClient *kube.Client) (n int, err error) {
 	if s.IsStatefulSet() {
 		n := 0
+		nMutex := sync.Mutex{}
 		err = s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
 			m, err := servicePod.RequestsInFlight(kubeClient)
+			nMutex.Lock()
 			n += m
+			nMutex.Unlock()
 			return err
 		})
 		return n, err
 	}
 
-	// make the HTTP request to the reset endpoint
-	reqURL := fmt.Sprintf("http://%s:%d/metrics", s.Host, s.Port)
+	// make the HTTP request to the metrics endpoint
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return 0, err
+	}
+	reqURL := endpoint + "/metrics"
 	core.Log.Warnf("trying: %s", reqURL)
 	if res, err := http.Get(reqURL, "application/json"); err != nil {
 		err = fmt.Errorf("could not scrape %s: %s", reqURL, res)
@@ -360,50 +380,165 @@ func (s *Service) RequestsInFlight(kubeClient *kube.Client) (n int, err error) {
 	}
 }
 
-// Snap initiates a snapshop / backup of the service.
+// ImageDigestGet returns the digest of the image the service runs. It is
+// "" for services outside of kube.
+func (s *Service) ImageDigestGet(kubeClient *kube.Client) (string, error) {
+	if s.IsStatefulSet() {
+		servicePod, err := s.ServicePodGet(0)
+		if err != nil {
+			return "", err
+		}
+		return servicePod.ImageDigestGet(kubeClient)
+	}
+	if !s.IsPod() {
+		return "", nil
+	}
+	return podImageDigestGet(kubeClient, s.KubeNamespace, s.KubeName, s.KubeContainer)
+}
+
+func podImageDigestGet(kubeClient *kube.Client, namespace, podName, containerName string) (string, error) {
+	if kubeClient == nil {
+		return "", fmt.Errorf("need kubeClient")
+	}
+	pod, err := kubeClient.PodGetByName(namespace, podName)
+	if err != nil {
+		return "", fmt.Errorf("could not get pod: %v", err)
+	}
+	return kubeClient.ImageDigestGet(pod, containerName)
+}
+
+// EndpointGet returns the base URL of the service, eg.
+// http://localhost:8080. Pods are reached by cluster DNS when jerriedr
+// runs in the cluster and through a port forward from the pool of
+// kubeClient when it does not. A statefulset has an endpoint for each of
+// its pods instead.
+func (s *Service) EndpointGet(kubeClient *kube.Client) (string, error) {
+	if s.IsStatefulSet() {
+		return "", fmt.Errorf("%s has an endpoint for each pod. use the pods", s.Spec)
+	}
+	if !s.IsPod() {
+		return fmt.Sprintf("http://%s:%d", s.Host, s.Port), nil
+	}
+
+	if kubeClient == nil {
+		return "", fmt.Errorf("need kubeClient")
+	}
+	if kubeClient.InCluster {
+		host, err := s.podHostGet(kubeClient)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("http://%s:%d", host, s.Port), nil
+	}
+	localPort, err := kubeClient.PortForwardPooled(s.KubeNamespace, s.KubeName, s.Port)
+	if err != nil {
+		return "", fmt.Errorf("could not port forward to kube service %s: %v", s.Spec, err)
+	}
+	return fmt.Sprintf("http://localhost:%d", localPort), nil
+}
+
+// podHostGet returns the cluster DNS name of the pod. Pods of a
+// statefulset have one through its headless service. Other pods get the
+// name made from their IP.
+func (s *Service) podHostGet(kubeClient *kube.Client) (string, error) {
+	if s.Host != "" {
+		return s.Host, nil
+	}
+	pod, err := kubeClient.PodGetByName(s.KubeNamespace, s.KubeName)
+	if err != nil {
+		return "", fmt.Errorf("could not get pod: %v", err)
+	}
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("pod %s/%s has no IP", s.KubeNamespace, s.KubeName)
+	}
+	return fmt.Sprintf("%s.%s.pod.cluster.local",
+		strings.ReplaceAll(pod.Status.PodIP, ".", "-"), s.KubeNamespace), nil
+}
+
+// requestNote says where requests to path on the service go, for plans.
+// It opens no port forwards.
+func (s *Service) requestNote(kubeClient *kube.Client, method, path string) string {
+	if !s.IsStatefulSet() {
+		if !s.IsPod() || (kubeClient != nil && kubeClient.InCluster && s.Host != "") {
+			return fmt.Sprintf("%s http://%s:%d%s", method, s.Host, s.Port, path)
+		}
+		via := "a port forward"
+		if kubeClient != nil && kubeClient.InCluster {
+			via = "cluster DNS"
+		}
+		return fmt.Sprintf("%s %s to %s/%s:%d through %s", method, path, s.KubeNamespace, s.KubeName, s.Port, via)
+	}
+	replicas, err := s.Replicas(kubeClient)
+	if err != nil {
+		return fmt.Sprintf("%s %s on each pod of %s/%s", method, path, s.KubeNamespace, s.KubeName)
+	}
+	notes := make([]string, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		servicePod, err := s.ServicePodGet(i)
+		if err != nil {
+			continue
+		}
+		notes = append(notes, servicePod.requestNote(kubeClient, method, path))
+	}
+	return strings.Join(notes, "; ")
+}
+
+// backupNote says where backupRequest posts, for plans
+func (s *Service) backupNote(kubeClient *kube.Client) string {
+	if s.IsStatefulSet() {
+		if servicePod, err := s.ServicePodGet(0); err == nil {
+			return servicePod.requestNote(kubeClient, "POST", "/raft/leader/read")
+		}
+	}
+	return s.requestNote(kubeClient, "POST", "/raft/leader/read")
+}
+
+// Snap initiates a snapshop / backup of the service and waits for the
+// file it makes on each replica of snapArchive. snapshotID is the UUID of
+// the backup request. If snapArchive is nil, Snap does not wait.
+func (s *Service) Snap(kubeClient *kube.Client, snapshotID string, snapArchive *Archive, timeout time.Duration) (files []*ArchiveFile, err error) {
+	// note the files there already to tell the new ones
+	var baseline map[string]*ArchiveFile
+	if snapArchive != nil {
+		if baseline, err = snapArchive.SnapBaselineGet(kubeClient); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = s.backupRequest(kubeClient, snapshotID); err != nil {
+		return nil, err
+	}
+
+	if snapArchive == nil {
+		return nil, nil
+	}
+	core.Log.Warnf("waiting for the backup of %s in %s", s.Spec, snapArchive.Spec)
+	return snapArchive.SnapWait(kubeClient, baseline, timeout)
+}
+
+// backupRequest posts the backup request for the service.
 // the snap message is posted to the raft, so there is no
-// need to send this to each server in the StatefulSet
-func (s *Service) Snap(kubeClient *kube.Client) (err error) {
+// need to send this to each server in the StatefulSet.
+func (s *Service) backupRequest(kubeClient *kube.Client, snapshotID string) (err error) {
 	core.Log.Warnf("running remote backup for %s", s.Spec)
 
-	var reqURL string
-	{
-		if s.IsStatefulSet() {
-			b, err := s.ServicePodGet(0)
-			if err != nil {
-				return err
-			}
-			return b.Snap(kubeClient)
-		} else if s.IsPod() {
-			// yes. make sure we have a kube client
-			if kubeClient == nil {
-				return fmt.Errorf("need kubeClient")
-			}
-
-			// forward a local port
-			forwardedPort, err := kubeClient.PortForward(&kube.PortForwardRequest{
-				LocalPort:    0,
-				PodName:      s.KubeName,
-				PodNamespace: s.KubeNamespace,
-				PodPort:      s.Port,
-			})
-			if err != nil {
-				return fmt.Errorf(
-					"could not port forward to kube service %s: %v", s.Spec, err)
-			}
-			localPort := forwardedPort.Local
-			reqURL = fmt.Sprintf(
-				"%s://%s:%d/raft/leader/read", "http", "localhost", localPort)
-		} else if s.IsHost() {
-			reqURL = fmt.Sprintf("http://%s:%d/raft/leader/read", s.Host, s.Port)
-		} else if s.IsLocal() {
-			reqURL = fmt.Sprintf("http://localhost:%d/raft/leader/read", s.Port)
+	if s.IsStatefulSet() {
+		b, err := s.ServicePodGet(0)
+		if err != nil {
+			return err
 		}
+		return b.backupRequest(kubeClient, snapshotID)
+	}
+
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return err
 	}
+	reqURL := endpoint + "/raft/leader/read"
 
 	// make the request
 	reqBody := fmt.Sprintf(
-		`{ "UUID": "%s", "Fn": "/v1/Backup", "Body": {} }`, uuid.NewString())
+		`{ "UUID": "%s", "Fn": "/v1/Backup", "Body": {} }`, snapshotID)
 	if res, err := http.Post(reqURL, "application/json", reqBody); err != nil {
 		return fmt.Errorf("could not request %s: %v", reqURL, err)
 	} else {
@@ -416,6 +551,12 @@ func (s *Service) Snap(kubeClient *kube.Client) (err error) {
 // The service defines the behavior, but this should basically clean
 // the datasource in preparation for data loading.
 func (s *Service) Reset(kubeClient *kube.Client) (err error) {
+	if planned(PlanOpReset, s.Spec, nil, "", func() string {
+		return s.requestNote(kubeClient, "POST", "/v1/Reset/App")
+	}) {
+		return nil
+	}
+
 	if s.IsStatefulSet() {
 		return s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
 			return servicePod.Reset(kubeClient)
@@ -423,7 +564,11 @@ func (s *Service) Reset(kubeClient *kube.Client) (err error) {
 	}
 
 	// make the HTTP request to the reset endpoint
-	reqURL := fmt.Sprintf("http://%s:%d/v1/Reset/App", s.Host, s.Port)
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	reqURL := endpoint + "/v1/Reset/App"
 	core.Log.Warnf("trying: %s", reqURL)
 	reqBody := fmt.Sprintf(
 		`{ "UUID": "%s", "Fn": "/v1/Reset/App", "Body": {} }`, uuid.NewString())
@@ -443,84 +588,168 @@ func (s *Service) Reset(kubeClient *kube.Client) (err error) {
 // Stage prepares a service for restoration. We might stage and restore
 // multiple data files to the service (eg. when we restore prod data to a
 // dev service), so we break this out.
+// A file on the same pod or host as the restore folder, or local for a
+// local service, is linked into it. A file anywhere else is copied into
+// it and checked against its md5. A statefulset stages the file to the
+// restore folder of each pod, from the copy on that pod if it has one.
 func (s *Service) Stage(
 	kubeClient *kube.Client, srcArchiveFile *ArchiveFile) error {
 	if s.IsStatefulSet() {
-		if s.IsStatefulSet() {
-			return s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
-				return servicePod.Reset(kubeClient)
-			})
-		}
+		copies := srcArchiveFile.CopiesGet()
+		return s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
+			return servicePod.Stage(kubeClient, servicePod.stageSrcPick(copies, srcArchiveFile))
+		})
 	}
 
-	if s.IsPod() {
-		pod, err := kubeClient.PodGetByName(s.KubeNamespace, s.KubeName)
-		if err != nil {
-			return err
-		}
+	// reset the restore folder
+	if err := s.stageClear(kubeClient); err != nil {
+		return err
+	}
 
-		// reset the restore folder
-		_, err = kubeClient.Rm(s.RestorePath, pod, "")
-		if err != nil {
-			return err
-		}
+	restoreArchive, err := s.RestoreArchiveGet()
+	if err != nil {
+		return err
+	}
+	if restoreArchive.IsColocated(srcArchiveFile.Archive) {
+		// make a symlink
+		return s.stageLink(kubeClient, srcArchiveFile)
+	}
+	return s.stageCopy(kubeClient, srcArchiveFile)
+}
 
-		// make the restore folder
-		_, err = kubeClient.MkDir(s.RestorePath, pod, "")
-		if err != nil {
-			return err
+// stageSrcPick returns the copy that is at the same place as the restore
+// folder of the service, or src if none is
+func (s *Service) stageSrcPick(copies []*ArchiveFile, src *ArchiveFile) *ArchiveFile {
+	restoreArchive, err := s.RestoreArchiveGet()
+	if err != nil {
+		return src
+	}
+	for _, file := range copies {
+		if restoreArchive.IsColocated(file.Archive) {
+			return file
 		}
+	}
+	return src
+}
 
-		// can only stage archives on the same machine
-		if srcArchiveFile.Archive.KubeName != s.KubeName ||
-			srcArchiveFile.Archive.KubeNamespace != s.KubeNamespace {
-			return fmt.Errorf("can only stage files on the same "+
-				"pod. trying to stage %s on %s",
-				srcArchiveFile.Archive.KubeName,
-				s.KubeName)
-		}
+// stagerGet returns the restore folder of the service and its stager
+func (s *Service) stagerGet(kubeClient *kube.Client) (*Archive, ArchiveStager, error) {
+	restoreArchive, err := s.RestoreArchiveGet()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// make a symlink
-		srcArchiveFilePath := srcArchiveFile.Archive.Path + "/" + srcArchiveFile.Name
-		dstArchiveFilePath := s.RestorePath + "/" + srcArchiveFile.Name
-		_, err = kubeClient.Ln(s.RestorePath, dstArchiveFilePath, pod, "")
-		if err != nil {
-			return fmt.Errorf("cound not create symlink: src %s to %s: %v",
-				srcArchiveFilePath, dstArchiveFilePath, err)
-		}
-	} else if s.IsHost() {
-		return fmt.Errorf("cannot Stage for hosts yet")
-	} else if s.IsLocal() {
-		// clear the content of the restore folder
-		if err := os.RemoveAll(s.RestorePath); err != nil {
-			return fmt.Errorf("cound not clear the content of the restore folder: %v", err)
-		}
+	store, err := restoreArchive.StoreGet(kubeClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	stager, ok := store.(ArchiveStager)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot stage files for %s", s.Spec)
+	}
+	return restoreArchive, stager, nil
+}
 
-		// recreate it
-		if err := os.MkdirAll(s.RestorePath, 0774); err != nil {
-			return fmt.Errorf("cound not create the restore folder: %v", err)
-		}
+// stageClear empties the restore folder of the service
+func (s *Service) stageClear(kubeClient *kube.Client) error {
+	restoreArchive, stager, err := s.stagerGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	if planned(PlanOpClear, s.Spec, nil, "", func() string {
+		return fmt.Sprintf("rm -rf %s and make it again in %s", restoreArchive.Path, restoreArchive.Spec)
+	}) {
+		return nil
+	}
+	return stager.Clear(restoreArchive)
+}
 
-		// can only do local to local
-		if srcArchiveFile.Archive.Scheme != "local" {
-			return fmt.Errorf("can only restore to local from local. srcArchive is %v",
-				srcArchiveFile.Archive)
-		}
+// stageLink links srcArchiveFile into the restore folder of the service
+func (s *Service) stageLink(kubeClient *kube.Client, srcArchiveFile *ArchiveFile) error {
+	restoreArchive, stager, err := s.stagerGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	dstArchiveFile := &ArchiveFile{
+		Archive: restoreArchive,
+		Name:    srcArchiveFile.Name,
+	}
+	if planned(PlanOpLink, s.Spec, []string{srcArchiveFile.Spec()}, "", func() string {
+		return fmt.Sprintf("ln -s %s %s in %s", srcArchiveFile.Path(), dstArchiveFile.Path(), restoreArchive.Spec)
+	}) {
+		return nil
+	}
+	return stager.Link(srcArchiveFile, dstArchiveFile)
+}
 
-		// make a symlink
-		srcArchiveFilePath := srcArchiveFile.Archive.Path + "/" + srcArchiveFile.Name
-		dstArchiveFilePath := s.RestorePath + "/" + srcArchiveFile.Name
-		err := os.Symlink(srcArchiveFilePath, dstArchiveFilePath)
-		if err != nil {
-			return fmt.Errorf("cound not create symlink: src %s to %s: %v",
-				srcArchiveFilePath, dstArchiveFilePath, err)
+// stageCopy copies srcArchiveFile into the restore folder of the service.
+// The copy is checked against the md5 of the src. Its sidecars are removed
+// after, so the folder holds the file alone as it does when linked.
+func (s *Service) stageCopy(kubeClient *kube.Client, srcArchiveFile *ArchiveFile) error {
+	restoreArchive, err := s.RestoreArchiveGet()
+	if err != nil {
+		return err
+	}
+	dstArchiveFile := &ArchiveFile{
+		Archive: restoreArchive,
+		Name:    srcArchiveFile.Name,
+	}
+	if planned(PlanOpStage, s.Spec, []string{srcArchiveFile.Spec()}, "", func() string {
+		return fmt.Sprintf("copy %s to %s in %s and check its md5", srcArchiveFile.Spec(), dstArchiveFile.Path(), restoreArchive.Spec)
+	}) {
+		return nil
+	}
+
+	if _, err := ArchiveFileCopy(kubeClient, srcArchiveFile, dstArchiveFile, ui.ProgressWatcherNew()); err != nil {
+		return fmt.Errorf("could not stage %s for %s: %w", srcArchiveFile.Spec(), s.Spec, err)
+	}
+
+	store, err := restoreArchive.StoreGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{ArchiveFileChecksumSuffix, ArchiveFileMetaSuffix} {
+		if err := store.Remove(restoreArchive, dstArchiveFile.Name+suffix); err != nil {
+			core.Log.Debugf("could not remove sidecar %s%s: %v", dstArchiveFile.Spec(), suffix, err)
 		}
 	}
+	core.Log.Warnf("staged %s to %s", srcArchiveFile.Spec(), dstArchiveFile.Spec())
 	return nil
 }
 
-// StartStop starts the service
+// RestoreArchiveGet returns the restore folder of the service as an
+// Archive so it can be staged through the ArchiveStore of its scheme
+func (s *Service) RestoreArchiveGet() (*Archive, error) {
+	restoreArchive := ArchiveNew()
+	restoreArchive.Path = s.RestorePath
+	restoreArchive.ServiceName = s.Name
+	if s.IsPod() {
+		restoreArchive.Scheme = "pod"
+		restoreArchive.KubeNamespace = s.KubeNamespace
+		restoreArchive.KubeName = s.KubeName
+		restoreArchive.KubeContainer = s.KubeContainer
+		restoreArchive.Spec = fmt.Sprintf("pod|%s/%s/%s|%s", s.KubeNamespace, s.Name, s.KubeName, s.RestorePath)
+	} else if s.IsHost() {
+		restoreArchive.Scheme = "host"
+		restoreArchive.Host = s.Host
+		restoreArchive.Spec = fmt.Sprintf("host|%s/%s|%s", s.Host, s.Name, s.RestorePath)
+	} else if s.IsLocal() {
+		restoreArchive.Scheme = "local"
+		restoreArchive.Spec = fmt.Sprintf("local|%s|%s", s.Name, s.RestorePath)
+	} else {
+		return nil, fmt.Errorf("%s has no restore folder of its own", s.Spec)
+	}
+	return restoreArchive, nil
+}
+
+// WaitForDrain waits for the requests in flight to the service to finish
 func (s *Service) WaitForDrain(kubeClient *kube.Client) error {
+	if planned(PlanOpDrain, s.Spec, nil, "", func() string {
+		return "wait up to 20s for no requests in flight: " + s.requestNote(kubeClient, "GET", "/metrics")
+	}) {
+		return nil
+	}
+
 	// loop once per second for 20 seconds
 	for i := 0; i < 20; i++ {
 		n, err := s.RequestsInFlight(kubeClient)
@@ -537,30 +766,14 @@ func (s *Service) WaitForDrain(kubeClient *kube.Client) error {
 	return fmt.Errorf("service %s did not drain in 20 seconds", s.Name)
 }
 
-// StartStop starts the service
-func (s *Service) StartStop(kubeClient *kube.Client, start bool) error {
-	if s.IsStatefulSet() {
-		service, err := kubeClient.ServiceGetByName(s.KubeNamespace, s.KubeName)
-		if err != nil {
-			return err
-		}
-		if start {
-			service.Spec.Selector["Pause"] = "True"
-		} else {
-			delete(service.Spec.Selector, "Pause")
-		}
-
-		ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancelFn()
-		kubeClient.Clientset.CoreV1().Services(s.KubeNamespace).
-			Update(ctx, service, metav1.UpdateOptions{})
-	}
-
-	return nil
-}
-
 // Restore actuates the actual loading of data after staging
 func (s *Service) Restore(kubeClient *kube.Client) error {
+	if planned(PlanOpRestore, s.Spec, nil, "", func() string {
+		return s.requestNote(kubeClient, "POST", s.RestoreURL)
+	}) {
+		return nil
+	}
+
 	if s.IsStatefulSet() {
 		return s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
 			return servicePod.Restore(kubeClient)
@@ -568,7 +781,11 @@ func (s *Service) Restore(kubeClient *kube.Client) error {
 	}
 
 	core.Log.Warnf("restoring %s", s.Name)
-	reqURL := fmt.Sprintf("http://%s:%d%s", s.Host, s.Port, s.RestoreURL)
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	reqURL := endpoint + s.RestoreURL
 	core.Log.Warnf("trying: %s", reqURL)
 	reqBod := fmt.Sprintf(`{ "UUID": "%s", "Fn": "/v1/Restore", "Body": {} }`,
 		uuid.NewString())
@@ -584,13 +801,23 @@ func (s *Service) Restore(kubeClient *kube.Client) error {
 // RAFTReset resets the raft after a restore. This is necessary in
 // The service decides how to do this, ultimately.
 func (s *Service) RAFTReset(kubeClient *kube.Client) error {
+	if planned(PlanOpRAFTReset, s.Spec, nil, "", func() string {
+		return s.requestNote(kubeClient, "POST", "/v1/Reset/Raft")
+	}) {
+		return nil
+	}
+
 	if s.IsStatefulSet() {
 		return s.ForEachServicePod(kubeClient, func(servicePod *Service) error {
 			return servicePod.RAFTReset(kubeClient)
 		})
 	}
 
-	reqURL := fmt.Sprintf("http://%s:%d/v1/Reset/Raft", s.Host, s.Port)
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	reqURL := endpoint + "/v1/Reset/Raft"
 	reqBod := fmt.Sprintf(`{ "UUID": "%s", "Fn": "/v1/Reset/Raft", "Body": {} }`,
 		uuid.NewString())
 	if res, err := http.Post(reqURL, "application/json", reqBod); err != nil {
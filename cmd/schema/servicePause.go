@@ -0,0 +1,267 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/http"
+	"github.com/jkassis/jerriedr/cmd/kube"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Pause and Resume stop and start the traffic to a service.
+//
+// A statefulset is paused at its kube service. Pause saves the selector
+// of the kube service in the ServicePauseAnnotation and adds the
+// ServicePauseLabel to it, which no pod has, so the service loses its
+// endpoints. Resume puts the saved selector back as it was.
+//
+// Pods, host and local services are paused by their maintenance
+// endpoint. They take POSTs to ServiceMaintenancePauseURL and
+// ServiceMaintenanceResumeURL and answer GETs to ServiceMaintenanceURL
+// with {"Paused": <bool>}. A service without them is not paused.
+const (
+	ServicePauseAnnotation      = "jerriedr/paused-selector"
+	ServicePauseLabel           = "jerriedr-paused"
+	ServiceMaintenanceURL       = "/v1/Maintenance"
+	ServiceMaintenancePauseURL  = "/v1/Maintenance/Pause"
+	ServiceMaintenanceResumeURL = "/v1/Maintenance/Resume"
+)
+
+// servicePauseLegacyLabel is the selector jerriedr used to add to kube
+// services before the annotation. Pause and Resume remove it.
+const servicePauseLegacyLabel = "Pause"
+
+// ServicePauseTimeout is how long Pause waits for the endpoints of a kube
+// service to go
+var ServicePauseTimeout = 30 * time.Second
+
+// ServicePauseStatus says whether the traffic to a service is paused
+type ServicePauseStatus struct {
+	Service string `json:"service" yaml:"service"`
+	By      string `json:"by" yaml:"by"` // selector | maintenance
+	Paused  bool   `json:"paused" yaml:"paused"`
+
+	// the selector of the kube service now and the one Resume puts back
+	Selector      map[string]string `json:"selector,omitempty" yaml:"selector,omitempty"`
+	SavedSelector map[string]string `json:"savedSelector,omitempty" yaml:"savedSelector,omitempty"`
+
+	// Endpoints is the number of ready endpoints of the kube service, or
+	// -1 for services paused by maintenance endpoint
+	Endpoints int `json:"endpoints" yaml:"endpoints"`
+
+	// Error says why the status could not be had
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Pause stops the traffic to the service. Pausing a paused service keeps
+// the selector saved the first time.
+func (s *Service) Pause(kubeClient *kube.Client) error {
+	if planned(PlanOpPause, s.Spec, nil, "", func() string {
+		if s.IsStatefulSet() {
+			return fmt.Sprintf("save the selector of service %s/%s in its %s annotation, add %s=true to it and wait up to %s for 0 endpoints",
+				s.KubeNamespace, s.KubeName, ServicePauseAnnotation, ServicePauseLabel, ServicePauseTimeout)
+		}
+		return s.requestNote(kubeClient, "POST", ServiceMaintenancePauseURL)
+	}) {
+		return nil
+	}
+
+	if !s.IsStatefulSet() {
+		return s.maintenanceRequest(kubeClient, ServiceMaintenancePauseURL)
+	}
+
+	if kubeClient == nil {
+		return fmt.Errorf("need kubeClient")
+	}
+	_, err := kubeClient.ServiceUpdate(s.KubeNamespace, s.KubeName, func(service *corev1.Service) error {
+		if _, ok := service.Annotations[ServicePauseAnnotation]; ok {
+			core.Log.Warnf("service %s/%s is paused already", s.KubeNamespace, s.KubeName)
+			return nil
+		}
+		if len(service.Spec.Selector) == 0 {
+			return fmt.Errorf("service %s/%s has no selector to pause", s.KubeNamespace, s.KubeName)
+		}
+
+		// older jerriedr left the legacy label on services it resumed
+		if _, ok := service.Spec.Selector[servicePauseLegacyLabel]; ok {
+			core.Log.Warnf("removing the legacy %s selector from service %s/%s", servicePauseLegacyLabel, s.KubeNamespace, s.KubeName)
+			delete(service.Spec.Selector, servicePauseLegacyLabel)
+		}
+
+		saved, err := json.Marshal(service.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		if service.Annotations == nil {
+			service.Annotations = make(map[string]string)
+		}
+		service.Annotations[ServicePauseAnnotation] = string(saved)
+		service.Spec.Selector[ServicePauseLabel] = "true"
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not pause %s: %w", s.Spec, err)
+	}
+
+	// wait for the endpoints to go
+	deadline := time.Now().Add(ServicePauseTimeout)
+	for {
+		n, err := kubeClient.EndpointsCount(s.KubeNamespace, s.KubeName)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			core.Log.Warnf("paused service %s/%s", s.KubeNamespace, s.KubeName)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s/%s still has %d endpoints %s after the pause", s.KubeNamespace, s.KubeName, n, ServicePauseTimeout)
+		}
+		<-time.After(time.Second)
+	}
+}
+
+// Resume starts the traffic to the service again. A statefulset gets back
+// the selector saved by Pause.
+func (s *Service) Resume(kubeClient *kube.Client) error {
+	if planned(PlanOpResume, s.Spec, nil, "", func() string {
+		if s.IsStatefulSet() {
+			return fmt.Sprintf("put back the selector of service %s/%s saved in its %s annotation",
+				s.KubeNamespace, s.KubeName, ServicePauseAnnotation)
+		}
+		return s.requestNote(kubeClient, "POST", ServiceMaintenanceResumeURL)
+	}) {
+		return nil
+	}
+
+	if !s.IsStatefulSet() {
+		return s.maintenanceRequest(kubeClient, ServiceMaintenanceResumeURL)
+	}
+
+	if kubeClient == nil {
+		return fmt.Errorf("need kubeClient")
+	}
+	_, err := kubeClient.ServiceUpdate(s.KubeNamespace, s.KubeName, func(service *corev1.Service) error {
+		saved, ok := service.Annotations[ServicePauseAnnotation]
+		if !ok {
+			if _, ok := service.Spec.Selector[servicePauseLegacyLabel]; ok {
+				delete(service.Spec.Selector, servicePauseLegacyLabel)
+				return nil
+			}
+			core.Log.Warnf("service %s/%s is not paused", s.KubeNamespace, s.KubeName)
+			return nil
+		}
+
+		selector := make(map[string]string)
+		if err := json.Unmarshal([]byte(saved), &selector); err != nil {
+			return fmt.Errorf("could not parse the %s annotation of service %s/%s: %v", ServicePauseAnnotation, s.KubeNamespace, s.KubeName, err)
+		}
+		service.Spec.Selector = selector
+		delete(service.Annotations, ServicePauseAnnotation)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not resume %s: %w", s.Spec, err)
+	}
+	core.Log.Warnf("resumed service %s/%s", s.KubeNamespace, s.KubeName)
+	return nil
+}
+
+// PauseStatusGet says whether the traffic to the service is paused
+func (s *Service) PauseStatusGet(kubeClient *kube.Client) (*ServicePauseStatus, error) {
+	status := &ServicePauseStatus{Service: s.Spec, Endpoints: -1}
+	if !s.IsStatefulSet() {
+		status.By = "maintenance"
+		endpoint, err := s.EndpointGet(kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		res, err := http.Get(endpoint+ServiceMaintenanceURL, "application/json")
+		if isMaintenanceMissing(err) {
+			return nil, fmt.Errorf("%s has no maintenance endpoint", s.Spec)
+		} else if err != nil {
+			return nil, err
+		}
+		maintenance := struct{ Paused bool }{}
+		if err := json.Unmarshal([]byte(res), &maintenance); err != nil {
+			return nil, fmt.Errorf("could not parse %s of %s: %v", ServiceMaintenanceURL, s.Spec, err)
+		}
+		status.Paused = maintenance.Paused
+		return status, nil
+	}
+
+	if kubeClient == nil {
+		return nil, fmt.Errorf("need kubeClient")
+	}
+	status.By = "selector"
+	service, err := kubeClient.ServiceGetByName(s.KubeNamespace, s.KubeName)
+	if err != nil {
+		return nil, err
+	}
+	status.Selector = service.Spec.Selector
+	if saved, ok := service.Annotations[ServicePauseAnnotation]; ok {
+		status.Paused = true
+		if err := json.Unmarshal([]byte(saved), &status.SavedSelector); err != nil {
+			return nil, fmt.Errorf("could not parse the %s annotation of service %s/%s: %v", ServicePauseAnnotation, s.KubeNamespace, s.KubeName, err)
+		}
+	} else if _, ok := service.Spec.Selector[servicePauseLegacyLabel]; ok {
+		status.Paused = true
+	}
+	if status.Endpoints, err = kubeClient.EndpointsCount(s.KubeNamespace, s.KubeName); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// maintenanceRequest posts to the maintenance endpoint at path. A service
+// without one is only warned about, so services that predate it can still
+// be restored.
+func (s *Service) maintenanceRequest(kubeClient *kube.Client, path string) error {
+	endpoint, err := s.EndpointGet(kubeClient)
+	if err != nil {
+		return err
+	}
+	reqURL := endpoint + path
+	reqBody := fmt.Sprintf(`{ "UUID": "%s", "Fn": "%s", "Body": {} }`, uuid.NewString(), path)
+	res, err := http.Post(reqURL, "application/json", reqBody)
+	if isMaintenanceMissing(err) {
+		core.Log.Warnf("%s has no maintenance endpoint. its traffic is not paused or resumed", s.Spec)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", reqURL, err)
+	}
+	core.Log.Warnf("%s: %s", reqURL, res)
+	return nil
+}
+
+// isMaintenanceMissing is true if err says the service has no maintenance
+// endpoint
+func isMaintenanceMissing(err error) bool {
+	statusErr := &http.StatusError{}
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case nethttp.StatusNotFound, nethttp.StatusMethodNotAllowed, nethttp.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// SelectorString writes a selector as sorted <key>=<value> pairs
+func SelectorString(selector map[string]string) string {
+	pairs := make([]string, 0, len(selector))
+	for key, value := range selector {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -2,7 +2,6 @@ package schema
 
 import (
 	"fmt"
-	"strconv"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -57,15 +56,8 @@ func (as *ServiceSet) ServiceGetByName(serviceName string) (a *Service, err erro
 }
 
 func (as *ServiceSet) DoOncePerEndpoint(fn func(*Service) error) (err error) {
-	doneOnce := make(map[string]struct{})
 	eg := errgroup.Group{}
-	for _, service := range as.Services {
-		key := service.Host + ":" + strconv.Itoa(service.Port)
-		if _, ok := doneOnce[key]; ok {
-			continue
-		}
-		doneOnce[key] = struct{}{}
-
+	for _, service := range as.EndpointServicesGet() {
 		service := service
 		eg.Go(func() (err error) {
 			return fn(service)
@@ -74,3 +66,20 @@ func (as *ServiceSet) DoOncePerEndpoint(fn func(*Service) error) (err error) {
 
 	return eg.Wait()
 }
+
+// EndpointServicesGet returns the first service of each endpoint. Services
+// that share an endpoint, like those restored into one local server, are
+// paused and reset together.
+func (as *ServiceSet) EndpointServicesGet() []*Service {
+	services := make([]*Service, 0)
+	seen := make(map[string]bool)
+	for _, service := range as.Services {
+		key := service.EndpointKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		services = append(services, service)
+	}
+	return services
+}
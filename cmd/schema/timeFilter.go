@@ -1,39 +1,303 @@
 package schema
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// TimeFilter matches times that meet all of its conditions. An archive
+// keeps the files that match any of its filters, so a list of filters is
+// an OR of ANDs.
+//
+// Filters are written as conditions separated by spaces, eg.
+//
+//	since=7d weekday=sat,sun hour=0
+//
+// and lists of filters are joined by " | ". Conditions are
+//
+//	since=<ago>|<time>           at or after
+//	until=<ago>|<time>           at or before
+//	between=<ago>|<time>,<ago>|<time>
+//	year= month= day= weekday= hour= minute= second=<v>,<v>...
+//
+// where <ago> is a duration before now like 36h, 7d or 2w and <time> is
+// RFC3339. Calendar conditions match any of their values in the zone of
+// the file time.
 type TimeFilter struct {
-	Year    *int
-	Month   *time.Month
-	Day     *int
-	Weekday *time.Weekday
-	Hour    *int
-	Minute  *int
-	Second  *int
+	conditions []timeCondition
 }
 
-func (tf *TimeFilter) isOK(t time.Time) bool {
-	if tf.Year != nil && *tf.Year != t.Year() {
-		return false
+type timeCondition interface {
+	isOK(t time.Time) bool
+	String() string
+}
+
+// TimeFilterParse parses the conditions of one filter
+func TimeFilterParse(spec string) (*TimeFilter, error) {
+	tf := &TimeFilter{}
+	for _, term := range strings.Fields(spec) {
+		if err := tf.ConditionAdd(term); err != nil {
+			return nil, err
+		}
 	}
-	if tf.Month != nil && *tf.Month != t.Month() {
-		return false
+	return tf, nil
+}
+
+// TimeFiltersParse parses a list of filters joined by "|"
+func TimeFiltersParse(spec string) ([]*TimeFilter, error) {
+	filters := make([]*TimeFilter, 0)
+	for _, filterSpec := range strings.Split(spec, "|") {
+		if strings.TrimSpace(filterSpec) == "" {
+			continue
+		}
+		tf, err := TimeFilterParse(filterSpec)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, tf)
 	}
-	if tf.Day != nil && *tf.Day != t.Day() {
-		return false
+	return filters, nil
+}
+
+// TimeFiltersString writes filters as TimeFiltersParse reads them
+func TimeFiltersString(filters []*TimeFilter) string {
+	specs := make([]string, 0, len(filters))
+	for _, tf := range filters {
+		specs = append(specs, tf.String())
+	}
+	return strings.Join(specs, " | ")
+}
+
+// ConditionAdd parses a <key>=<value> condition and adds it to the filter
+func (tf *TimeFilter) ConditionAdd(term string) error {
+	i := strings.Index(term, "=")
+	if i == -1 {
+		return fmt.Errorf("%s must be <key>=<value>", term)
 	}
-	if tf.Weekday != nil && *tf.Weekday != t.Weekday() {
-		return false
+	key, value := term[:i], term[i+1:]
+	if value == "" {
+		return fmt.Errorf("%s has no value", term)
 	}
-	if tf.Hour != nil && *tf.Hour != t.Hour() {
-		return false
+
+	var condition timeCondition
+	var err error
+	switch key {
+	case "since", "until":
+		var bound *timeBound
+		if bound, err = timeBoundParse(value); err == nil {
+			condition = &timeRange{Since: key == "since", Bound: bound}
+		}
+	case "between":
+		condition, err = timeBetweenParse(value)
+	default:
+		condition, err = timeFieldParse(key, value)
 	}
-	if tf.Minute != nil && *tf.Minute != t.Minute() {
-		return false
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", term, err)
 	}
-	if tf.Second != nil && *tf.Second != t.Second() {
-		return false
+	tf.conditions = append(tf.conditions, condition)
+	return nil
+}
+
+// And adds the conditions of other to the filter
+func (tf *TimeFilter) And(other *TimeFilter) {
+	tf.conditions = append(tf.conditions, other.conditions...)
+}
+
+// IsEmpty is true if the filter has no conditions and so matches anything
+func (tf *TimeFilter) IsEmpty() bool {
+	return len(tf.conditions) == 0
+}
+
+func (tf *TimeFilter) String() string {
+	terms := make([]string, 0, len(tf.conditions))
+	for _, condition := range tf.conditions {
+		terms = append(terms, condition.String())
 	}
+	return strings.Join(terms, " ")
+}
 
+func (tf *TimeFilter) isOK(t time.Time) bool {
+	for _, condition := range tf.conditions {
+		if !condition.isOK(t) {
+			return false
+		}
+	}
 	return true
 }
+
+// timeBound is a time, or a duration before now when the filter is used
+type timeBound struct {
+	Ago  time.Duration
+	Time time.Time
+	spec string
+}
+
+func timeBoundParse(spec string) (*timeBound, error) {
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return &timeBound{Time: t, spec: spec}, nil
+	}
+	ago, err := durationParse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be RFC3339 or a duration like 36h, 7d or 2w", spec)
+	}
+	return &timeBound{Ago: ago, spec: spec}, nil
+}
+
+func (b *timeBound) Get() time.Time {
+	if b.Time.IsZero() {
+		return time.Now().Add(-b.Ago)
+	}
+	return b.Time
+}
+
+// durationParse is time.ParseDuration with d for days and w for weeks
+func durationParse(spec string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(spec, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(spec, suffix))
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(spec)
+}
+
+// timeRange matches times at or after (Since) or at or before a bound
+type timeRange struct {
+	Since bool
+	Bound *timeBound
+}
+
+func (r *timeRange) isOK(t time.Time) bool {
+	if r.Since {
+		return !t.Before(r.Bound.Get())
+	}
+	return !t.After(r.Bound.Get())
+}
+
+func (r *timeRange) String() string {
+	if r.Since {
+		return "since=" + r.Bound.spec
+	}
+	return "until=" + r.Bound.spec
+}
+
+// timeBetween matches times between two bounds in either order
+type timeBetween struct {
+	From, To *timeBound
+}
+
+func timeBetweenParse(spec string) (*timeBetween, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s must be <from>,<to>", spec)
+	}
+	from, err := timeBoundParse(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := timeBoundParse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &timeBetween{From: from, To: to}, nil
+}
+
+func (b *timeBetween) isOK(t time.Time) bool {
+	from, to := b.From.Get(), b.To.Get()
+	if to.Before(from) {
+		from, to = to, from
+	}
+	return !t.Before(from) && !t.After(to)
+}
+
+func (b *timeBetween) String() string {
+	return "between=" + b.From.spec + "," + b.To.spec
+}
+
+// timeField matches times with a calendar field equal to any of values
+type timeField struct {
+	Key    string
+	Values []int
+}
+
+var timeFieldGetters = map[string]func(t time.Time) int{
+	"year":    func(t time.Time) int { return t.Year() },
+	"month":   func(t time.Time) int { return int(t.Month()) },
+	"day":     func(t time.Time) int { return t.Day() },
+	"weekday": func(t time.Time) int { return int(t.Weekday()) },
+	"hour":    func(t time.Time) int { return t.Hour() },
+	"minute":  func(t time.Time) int { return t.Minute() },
+	"second":  func(t time.Time) int { return t.Second() },
+}
+
+func timeFieldParse(key, spec string) (*timeField, error) {
+	if _, ok := timeFieldGetters[key]; !ok {
+		return nil, fmt.Errorf("unknown key '%s'. must be since | until | between | year | month | day | weekday | hour | minute | second", key)
+	}
+	field := &timeField{Key: key}
+	for _, valueSpec := range strings.Split(spec, ",") {
+		value, err := timeFieldValueParse(key, valueSpec)
+		if err != nil {
+			return nil, err
+		}
+		field.Values = append(field.Values, value)
+	}
+	return field, nil
+}
+
+// timeFieldValueParse parses a number, or a name for weekdays and months
+func timeFieldValueParse(key, spec string) (int, error) {
+	name := strings.ToLower(spec)
+	switch key {
+	case "weekday":
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			dayName := strings.ToLower(d.String())
+			if name == dayName || name == dayName[:3] {
+				return int(d), nil
+			}
+		}
+	case "month":
+		for m := time.January; m <= time.December; m++ {
+			monthName := strings.ToLower(m.String())
+			if name == monthName || name == monthName[:3] {
+				return int(m), nil
+			}
+		}
+	}
+	value, err := strconv.Atoi(spec)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a %s", spec, key)
+	}
+	return value, nil
+}
+
+func (f *timeField) isOK(t time.Time) bool {
+	value := timeFieldGetters[f.Key](t)
+	for _, v := range f.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *timeField) String() string {
+	values := make([]string, 0, len(f.Values))
+	for _, v := range f.Values {
+		switch f.Key {
+		case "weekday":
+			values = append(values, strings.ToLower(time.Weekday(v).String()[:3]))
+		case "month":
+			values = append(values, strings.ToLower(time.Month(v).String()[:3]))
+		default:
+			values = append(values, strconv.Itoa(v))
+		}
+	}
+	return f.Key + "=" + strings.Join(values, ",")
+}
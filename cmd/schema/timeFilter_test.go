@@ -0,0 +1,105 @@
+package schema
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeFiltersParse(t *testing.T) {
+	at := func(spec string) time.Time {
+		t, err := time.Parse(time.RFC3339, spec)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	now := time.Now()
+
+	tests := []struct {
+		spec   string
+		err    bool
+		string string
+		match  []time.Time
+		miss   []time.Time
+	}{
+		{
+			// 2026-01-04 is a sunday
+			spec:   "weekday=sun hour=0",
+			string: "weekday=sun hour=0",
+			match:  []time.Time{at("2026-01-04T00:30:00Z")},
+			miss:   []time.Time{at("2026-01-04T01:00:00Z"), at("2026-01-05T00:00:00Z")},
+		},
+		{
+			spec:   "weekday=sat,Sunday | since=1d",
+			string: "weekday=sat,sun | since=1d",
+			match:  []time.Time{at("2026-01-03T12:00:00Z"), now.Add(-time.Hour)},
+			miss:   []time.Time{at("2026-01-05T12:00:00Z")},
+		},
+		{
+			spec:   "since=2w until=36h",
+			string: "since=2w until=36h",
+			match:  []time.Time{now.Add(-7 * 24 * time.Hour)},
+			miss:   []time.Time{now.Add(-15 * 24 * time.Hour), now.Add(-time.Hour)},
+		},
+		{
+			spec:   "between=2026-01-10T00:00:00Z,2026-01-01T00:00:00Z",
+			string: "between=2026-01-10T00:00:00Z,2026-01-01T00:00:00Z",
+			match:  []time.Time{at("2026-01-01T00:00:00Z"), at("2026-01-05T00:00:00Z"), at("2026-01-10T00:00:00Z")},
+			miss:   []time.Time{at("2025-12-31T23:59:59Z"), at("2026-01-10T00:00:01Z")},
+		},
+		{
+			spec:   "month=feb,3 day=1",
+			string: "month=feb,mar day=1",
+			match:  []time.Time{at("2026-02-01T12:00:00Z"), at("2026-03-01T12:00:00Z")},
+			miss:   []time.Time{at("2026-01-01T12:00:00Z"), at("2026-02-02T12:00:00Z")},
+		},
+		{
+			spec:   " | ",
+			string: "",
+		},
+		{spec: "weekday=funday", err: true},
+		{spec: "hour", err: true},
+		{spec: "hour=", err: true},
+		{spec: "since=yesterday", err: true},
+		{spec: "between=1d", err: true},
+		{spec: "fortnight=1", err: true},
+		{spec: "day=1 | since=xd", err: true},
+	}
+
+	for _, test := range tests {
+		filters, err := TimeFiltersParse(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: want an error, have %q", test.spec, TimeFiltersString(filters))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if s := TimeFiltersString(filters); s != test.string {
+			t.Errorf("%q: string is %q, want %q", test.spec, s, test.string)
+		}
+
+		// a list of filters matches a time that any of them match
+		isOK := func(tm time.Time) bool {
+			for _, tf := range filters {
+				if tf.isOK(tm) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, tm := range test.match {
+			if !isOK(tm) {
+				t.Errorf("%q: does not match %s", test.spec, tm.Format(time.RFC3339))
+			}
+		}
+		for _, tm := range test.miss {
+			if isOK(tm) {
+				t.Errorf("%q: matches %s", test.spec, tm.Format(time.RFC3339))
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
+)
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "service",
+		Short: "Pause, resume and check the traffic to the services of an env.",
+		Long: `Pause, resume and check the traffic to the services of an env.
+Statefulsets are paused at their kube service. The selector of the kube
+service is saved in an annotation and replaced by one that selects no
+pods, and pause waits for the service to have no endpoints. Resume puts
+the saved selector back as it was. Pods, host and local services are
+paused by their maintenance endpoint.
+
+Without service names, the commands act on every service of the env.
+
+eg. jerriedr service pause dev
+    jerriedr service status dev
+    jerriedr service resume dev`,
+	}
+
+	c.AddCommand(&cobra.Command{
+		Use:   "pause <env> [<service>...]",
+		Short: "Stop the traffic to services of an env.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDServicePause(v, args[0], args[1:], true)
+		},
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "resume <env> [<service>...]",
+		Short: "Start the traffic to services of an env again.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDServicePause(v, args[0], args[1:], false)
+		},
+	})
+
+	status := &cobra.Command{
+		Use:   "status <env> [<service>...]",
+		Short: "Show whether the traffic to services of an env is paused.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDServiceStatus(v, args[0], args[1:])
+		},
+	}
+	FlagsAddOutputFlag(status, v)
+	c.AddCommand(status)
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddConfFlag(c, v)
+	MAIN.AddCommand(c)
+}
+
+// ServicesPick returns the services of envName with names, or one service
+// for each endpoint of the env if there are no names
+func ServicesPick(v *viper.Viper, envName string, names []string) ([]*schema.Service, error) {
+	serviceSet, err := EnvServiceSetGet(v, envName, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return serviceSet.EndpointServicesGet(), nil
+	}
+
+	services := make([]*schema.Service, 0, len(names))
+	for _, name := range names {
+		service, err := serviceSet.ServiceGetByName(name)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// CMDServicePause pauses the services, or resumes them if pause is false
+func CMDServicePause(v *viper.Viper, envName string, names []string, pause bool) {
+	cmdName := "service resume"
+	if pause {
+		cmdName = "service pause"
+	}
+
+	services, err := ServicesPick(v, envName, names)
+	if err != nil {
+		core.Log.Fatalf("%s: %v", cmdName, err)
+	}
+
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	eg := errgroup.Group{}
+	for _, service := range services {
+		service := service
+		eg.Go(func() error {
+			if pause {
+				return service.Pause(kubeClient)
+			}
+			return service.Resume(kubeClient)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		core.Log.Fatalf("%s: %v", cmdName, err)
+	}
+}
+
+func CMDServiceStatus(v *viper.Viper, envName string, names []string) {
+	services, err := ServicesPick(v, envName, names)
+	if err != nil {
+		core.Log.Fatalf("service status: %v", err)
+	}
+
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	// get the statuses in the order of the services
+	statuses := make([]*schema.ServicePauseStatus, len(services))
+	wg := sync.WaitGroup{}
+	for i, service := range services {
+		i, service := i, service
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := service.PauseStatusGet(kubeClient)
+			if err != nil {
+				status = &schema.ServicePauseStatus{Service: service.Spec, Endpoints: -1, Error: err.Error()}
+			}
+			statuses[i] = status
+		}()
+	}
+	wg.Wait()
+
+	err = Output(v, statuses, func(w io.Writer) {
+		fmt.Fprintln(w, "SERVICE\tBY\tPAUSED\tENDPOINTS\tSELECTOR\tERROR")
+		for _, status := range statuses {
+			endpoints := ""
+			if status.Endpoints >= 0 {
+				endpoints = strconv.Itoa(status.Endpoints)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n",
+				status.Service, status.By, status.Paused, endpoints, schema.SelectorString(status.Selector), status.Error)
+		}
+	})
+	if err != nil {
+		core.Log.Fatalf("service status: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jkassis/jerrie/core"
+	"github.com/jkassis/jerriedr/cmd/schema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const FLAG_RM = "rm"
+
+func init() {
+	// A general configuration object (feed with flags, conf files, etc.)
+	v := viper.New()
+
+	// CLI Command with flag parsing
+	c := &cobra.Command{
+		Use:   "snapshot",
+		Short: "List, label and pin the snapshots of an env stage.",
+		Long: `List, label and pin the snapshots of an env stage.
+Labels and pins are kept in the meta sidecars of every file of the
+snapshot and travel with it when it is copied. Pinned snapshots are
+never pruned.
+
+eg. jerriedr snapshot label prod:backup pre-migration-2026-10 --latest
+    jerriedr snapshot pin prod:backup --label pre-migration-2026-10`,
+	}
+
+	label := &cobra.Command{
+		Use:   "label <env>:<stage> <label>",
+		Short: "Add a label to a snapshot, or remove it with --rm.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			label, rm := args[1], v.GetBool(FLAG_RM)
+			CMDSnapshotMetaUpdate(v, "snapshot label", args[0], func(meta *schema.ArchiveFileMeta) {
+				if rm {
+					meta.LabelRemove(label)
+				} else {
+					meta.LabelAdd(label)
+				}
+			})
+		},
+	}
+	label.Flags().Bool(FLAG_RM, false, "remove the label instead")
+	v.BindPFlag(FLAG_RM, label.Flags().Lookup(FLAG_RM))
+	c.AddCommand(label)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "pin <env>:<stage>",
+		Short: "Pin a snapshot so prune never deletes it.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDSnapshotMetaUpdate(v, "snapshot pin", args[0], func(meta *schema.ArchiveFileMeta) {
+				meta.Pinned = true
+			})
+		},
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "unpin <env>:<stage>",
+		Short: "Unpin a snapshot.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDSnapshotMetaUpdate(v, "snapshot unpin", args[0], func(meta *schema.ArchiveFileMeta) {
+				meta.Pinned = false
+				meta.PinnedUntil = nil
+			})
+		},
+	})
+
+	ls := &cobra.Command{
+		Use:   "ls",
+		Short: "List the snapshots of an env stage with their status.",
+		Long: `List the snapshots of an env stage, most recent first, with their
+status, the reasons for it, labels and files.
+
+eg. jerriedr snapshot ls --env prod --stage backup -o yaml`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			CMDSnapshotLs(v)
+		},
+	}
+	FlagsAddEnvStageFlags(ls, v)
+	FlagsAddOutputFlag(ls, v)
+	c.AddCommand(ls)
+
+	FlagsAddKubeFlags(c, v)
+	FlagsAddSSHFlags(c, v)
+	FlagsAddS3Flags(c, v)
+	FlagsAddConfFlag(c, v)
+	FlagsAddSnapshotPickFlags(c, v)
+	MAIN.AddCommand(c)
+}
+
+func CMDSnapshotLs(v *viper.Viper) {
+	archiveSet := ArchiveSetFetch(v, "snapshot ls")
+	archiveSet.Label = v.GetString(FLAG_LABEL)
+	filters, err := TimeFiltersGet(v)
+	if err != nil {
+		core.Log.Fatalf("snapshot ls: %v", err)
+	}
+	archiveSet.FiltersSet(filters)
+	listings := archiveSet.SnapshotsList()
+	err = Output(v, listings, func(w io.Writer) {
+		fmt.Fprintln(w, "TIME\tSNAPSHOT\tFILES\tSTATUS\tLABELS\tREASONS")
+		for _, l := range listings {
+			labels := strings.Join(l.Labels, ",")
+			if l.Pinned {
+				labels = strings.TrimPrefix(labels+",pinned", ",")
+			}
+			reasons := make([]string, 0, len(l.Reasons))
+			for _, reason := range l.Reasons {
+				reasons = append(reasons, reason.Message)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+				l.Time.Format(time.RFC3339), l.SnapshotID, len(l.Files), l.Status, labels, strings.Join(reasons, "; "))
+		}
+	})
+	if err != nil {
+		core.Log.Fatalf("snapshot ls: %v", err)
+	}
+}
+
+// CMDSnapshotMetaUpdate picks a snapshot of the env stage ref and applies
+// update to the metas of all its files
+func CMDSnapshotMetaUpdate(v *viper.Viper, name, ref string, update func(meta *schema.ArchiveFileMeta)) {
+	envName, stage, err := schema.EnvStageParse(ref)
+	if err != nil {
+		core.Log.Fatalf("%s: %v", name, err)
+	}
+
+	archiveSet, err := EnvArchiveSetGet(v, envName, stage)
+	if err != nil {
+		core.Log.Fatalf("%s: %v", name, err)
+	}
+
+	pick, err := SnapshotPickGet(v)
+	if err != nil {
+		core.Log.Fatalf("%s: %v", name, err)
+	}
+
+	HostConfigure(v)
+	S3Configure(v)
+	kubeClient, err := KubeClientGet(v)
+	if err != nil {
+		core.Log.Warnf("could not init kubeClient: %v", err)
+	}
+
+	archiveFileSet, err := archiveSet.PickSnapshot(kubeClient, pick)
+	if err != nil {
+		core.Log.Fatalf("%s: snapshot not picked: %v", name, err)
+	}
+
+	if err := schema.ArchiveFileMetaUpdate(kubeClient, archiveFileSet, update); err != nil {
+		core.Log.Fatalf("%s: %v", name, err)
+	}
+
+	_, last := archiveFileSet.FirstAndLastArchiveFileTime()
+	core.Log.Warnf("%s: done for snapshot at %s", name, last.Format(time.RFC3339))
+}